@@ -6,6 +6,7 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -15,12 +16,13 @@ import (
 	"github.com/thb-cmyk/aliyum-demo/databasic"
 
 	"github.com/thb-cmyk/aliyum-demo/utils"
+	"pack.ag/amqp"
 )
 
 /*
 The function is used to intialize the amqp client connecting to aliyun amqp sever.
 */
-func Aliyun_Connect() {
+func Aliyun_Connect(ctx context.Context) {
 
 	/* patch the required information from the yaml configuration file */
 	configmap := utils.GetYamlConfig("config/config.yaml")
@@ -67,8 +69,8 @@ func Aliyun_Connect() {
 	/* create a daemon thread that receive data from the amqp server */
 	go amqpbasic.ReceiveThread(root_ctx)
 
-	/* prehandle the data receiving from amqp server and send the result to databasic */
-	for {
+	/* prehandle the data receiving from amqp server and send the result to databasic, until the ctx is done */
+	for ctx.Err() == nil {
 		// prehandle the recevied data and send the result to databasic
 		dataPreHandle(aliyun_session, "receiver_voltage", 1)
 
@@ -78,121 +80,226 @@ func Aliyun_Connect() {
 
 /*
 The function is used to prehandle the data receiving from aliyun amqp server. And creating
-a raw node which contian the prehandled datato send to databasic.
+a raw node which contian the prehandled datato send to databasic. The message malformed or rejected
+by the validation is quarantined to the dead letter store with the failure reason, and the message
+undelivered while the broker is shut down or the write-ahead log is failed is released to be redelivered.
 */
 func dataPreHandle(session *amqpbasic.AmqpSessionHandler, linkid string, num int) {
 
 	// the data Prehandle function can handle the device status update message and device data update message
 	message, index := session.ReceiverMessage(linkid, num)
-	if index != 0 {
-		for i := 0; i < index; i++ {
-			// get the topic of the message belong to
-			topic := message[i].ApplicationProperties["topic"].(string)
-			// jugde the message type and what to handle it
-			// the device status update message topic model is "as/mqtt/status/${productKey}/${deviceName}"
-			// the device data update message topic model is "/${productKey}/${deviceName}/user/update"
-			if strings.Contains(topic, "as/mqtt/status") {
-				// the device status update message
-				deviceName := strings.Split(topic, "/")[5]
-				fmt.Printf("topic: %s, deviceName: %s\n\r", topic, deviceName)
-				// get the generate time of the message and convert it to yyyy-MM-dd HH:mm:ss SSS format
-				generateTime := message[i].ApplicationProperties["generateTime"].(int64)
-				fmt.Printf("generateTime: %d\n\r", generateTime)
-				time := time.UnixMilli(generateTime)
-				time_split := strings.Split(time.String(), " ")
-				formattedTime := time_split[0] + "|" + time_split[1]
-				fmt.Printf("formattedTime: %s\n\r", formattedTime)
-
-				// get the message payload
-				payload := message[i].GetData()
-
-				// struct the message payload
-				var gt GeneralStructure
-				var ss StatusStructure
-				err := json.Unmarshal(payload, &ss)
-				if err != nil {
-					fmt.Printf("json unmarshal error: %s\n\r", err)
-					return
-				} else {
-					fmt.Printf("status: %s\n\r", ss.Status)
-					value := ss.Status
-					// create a general value structure
-					vs := ValueStructure{
-						Params: map[string]interface{}{
-							"status": value},
-					}
-					log.Printf("%v\n\r", vs.Params)
-					gt.DeviceName = deviceName
-					gt.Time = formattedTime
-					gt.Value = vs
-					raw_node := databasic.RawNode_create("aliyun", &gt)
-					databasic.Send_raw(raw_node)
-				}
-
-			} else if strings.Contains(topic, "/user/update") {
-				// get the device name of the message belong to
-				// the topic model is "/${productKey}/${deviceName}/user/update"
-				deviceName := strings.Split(topic, "/")[2]
-				fmt.Printf("topic: %s, deviceName: %s\n\r", topic, deviceName)
-
-				// get the generate time of the message and convert it to yyyy-MM-dd HH:mm:ss SSS format
-				generateTime := message[i].ApplicationProperties["generateTime"].(int64)
-				fmt.Printf("generateTime: %d\n\r", generateTime)
-				time := time.UnixMilli(generateTime)
-				time_split := strings.Split(time.String(), " ")
-				formattedTime := time_split[0] + "|" + time_split[1]
-				fmt.Printf("formattedTime: %s\n\r", formattedTime)
-				// get the message payload
-				payload := message[i].GetData()
-
-				// struct the message payload
-				var gt GeneralStructure
-				var vs ValueStructure
-				err := json.Unmarshal(payload, &vs)
-				if err != nil {
-					fmt.Print(err.Error())
-				} else {
-					log.Printf("%v\n\r", vs.Params)
-					gt.DeviceName = deviceName
-					gt.Time = formattedTime
-					gt.Value = vs
-					raw_node := databasic.RawNode_create("aliyun", &gt)
-					databasic.Send_raw(raw_node)
-				}
-			} else {
-				fmt.Printf("The message topic is not correct!\n\r")
-				fmt.Printf("topic: %s\n\r", topic)
+	for i := 0; i < index; i++ {
+		msg := message[i]
+		properties := msg.ApplicationProperties
+		payload := msg.GetData()
+
+		// the message is accepted after the broker admits it, and released to be redelivered if the broker rejects it
+		err := messageDeliver(properties, payload, func(rawnode *databasic.RawNode, err error) {
+			messageSettle(msg, err)
+		})
+		if errors.Is(err, databasic.ErrBrokerClosed) || errors.Is(err, databasic.ErrWALWrite) {
+			// the message is not malformed, it is redelivered after restarting or while the disk is recovered
+			messageSettle(msg, err)
+		} else if err != nil {
+			_, put_err := deadLetterPut(properties, payload, err)
+			if put_err != nil {
+				log.Printf("The message unable to quarantine, it is released: %s\n\r", put_err.Error())
+				messageSettle(msg, put_err)
+				continue
 			}
+			log.Printf("The message is quarantined to the dead letter store.\n\r error info: %s\n\r", err.Error())
+			messageSettle(msg, nil)
+		}
+	}
+}
+
+/*
+The function settles the message. The message is released to be redelivered by the amqp server, if the err
+is not nil, otherwise it is accepted. The message dropped by the rate limit is accepted, because the redelivery
+makes the device exceed the limit again.
+*/
+func messageSettle(message *amqp.Message, err error) {
+	var settle_err error
+	if errors.Is(err, databasic.ErrRateLimited) {
+		log.Printf("The message is dropped, because the device exceeds the rate limit.\n\r")
+		settle_err = message.Accept()
+	} else if err != nil {
+		log.Printf("The message is released, because the broker rejects it: %s\n\r", err.Error())
+		settle_err = message.Release()
+	} else {
+		settle_err = message.Accept()
+	}
+	if settle_err != nil {
+		log.Printf("The message unable to settle: %s\n\r", settle_err.Error())
+	}
+}
+
+/*
+The function handles a message received from aliyun amqp server. It returns a error instead of panic,
+if the message is malformed or unable to process. The function is also used to replay the dead letter.
+*/
+func messagePreHandle(properties map[string]interface{}, payload []byte) error {
+	return messageDeliver(properties, payload, nil)
+}
 
+/*
+The function is the same as the messagePreHandle, and the admit is called by the broker while the
+rawnode is admitted or rejected by the task.
+*/
+func messageDeliver(properties map[string]interface{}, payload []byte, admit func(*databasic.RawNode, error)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while prehandling the message: %v", r)
 		}
+	}()
+
+	// get the topic of the message belong to
+	topic, ok := properties["topic"].(string)
+	if !ok {
+		return fmt.Errorf("the topic property %v is not a string", properties["topic"])
+	}
+	topic_split := strings.Split(topic, "/")
+
+	// get the generate time of the message and convert it to yyyy-MM-dd HH:mm:ss SSS format
+	generateTime, ok := properties["generateTime"].(int64)
+	if !ok {
+		return fmt.Errorf("the generateTime property %v is not a int64", properties["generateTime"])
 	}
+	fmt.Printf("generateTime: %d\n\r", generateTime)
+	time := time.UnixMilli(generateTime)
+	time_split := strings.Split(time.String(), " ")
+	formattedTime := time_split[0] + "|" + time_split[1]
+	fmt.Printf("formattedTime: %s\n\r", formattedTime)
+
+	// jugde the message type and what to handle it
+	// the device status update message topic model is "as/mqtt/status/${productKey}/${deviceName}"
+	// the device data update message topic model is "/${productKey}/${deviceName}/user/update"
+	var gt GeneralStructure
+	var kind string
+	if strings.Contains(topic, "as/mqtt/status") && len(topic_split) > 5 {
+		// the device status update message
+		productKey := topic_split[4]
+		deviceName := topic_split[5]
+		fmt.Printf("topic: %s, deviceName: %s\n\r", topic, deviceName)
+
+		// struct the message payload
+		var ss StatusStructure
+		err := json.Unmarshal(payload, &ss)
+		if err != nil {
+			return fmt.Errorf("json unmarshal error: %s", err)
+		}
+		fmt.Printf("status: %s\n\r", ss.Status)
+		// create a general value structure
+		vs := ValueStructure{
+			Params: map[string]interface{}{
+				"status": ss.Status},
+		}
+		log.Printf("%v\n\r", vs.Params)
+		gt.ProductKey = productKey
+		gt.DeviceName = deviceName
+		gt.Time = formattedTime
+		gt.Value = vs
+		kind = "status"
 
-	// messages, index := session.ReceiverMessage(linkid, num)
-	// for i := 0; i < index; i++ {
-	// 	fmt.Printf("data: %v\n\r", messages[i])
-	// }
+	} else if strings.Contains(topic, "/user/update") && len(topic_split) > 2 {
+		// get the device name of the message belong to
+		// the topic model is "/${productKey}/${deviceName}/user/update"
+		productKey := topic_split[1]
+		deviceName := topic_split[2]
+		fmt.Printf("topic: %s, deviceName: %s\n\r", topic, deviceName)
 
-	// data, index := session.ReceiverData(linkid, num)
-	// for i := 0; i < index; i++ {
-	// 	fmt.Printf("data: %s\n\r", data[i])
-	// }
+		// struct the message payload
+		var vs ValueStructure
+		err := json.Unmarshal(payload, &vs)
+		if err != nil {
+			return fmt.Errorf("json unmarshal error: %s", err)
+		}
+		err = dataValidate(productKey, deviceName, &vs)
+		if err != nil {
+			return err
+		}
+		log.Printf("%v\n\r", vs.Params)
+		gt.ProductKey = productKey
+		gt.DeviceName = deviceName
+		gt.Time = formattedTime
+		gt.Value = vs
+		kind = "property"
+
+	} else {
+		return fmt.Errorf("the message topic %s is not correct", topic)
+	}
+
+	// the route is "aliyun.${productKey}.${deviceName}.${kind}", which can be subscribed by product or device
+	// the device is the partition key, which keep the data of a device in order and limit the rate of it, the
+	// device name is unique only in the product, so the key is "${productKey}/${deviceName}"
+	route := databasic.Route_join("aliyun", gt.ProductKey, gt.DeviceName, kind)
+	raw_node := databasic.RawNode_create_key(route, deviceKey(gt.ProductKey, gt.DeviceName), &gt)
+	raw_node.Admit = admit
+	err = databasic.Send(raw_node)
+	if err != nil {
+		return fmt.Errorf("%w, the message of device %s is not delivered", err, gt.DeviceName)
+	}
+
+	return nil
+}
+
+// the function returns the key of the device, which is unique among all the products
+func deviceKey(productKey string, deviceName string) string {
+	return productKey + "/" + deviceName
+}
+
+/*
+The function validates the params against the published thing model of the product. The invalid
+params are removed from the vs and the reasons are logged. It returns a error, if the message should
+be rejected, which the message has no valid param or misses a required property.
+*/
+func dataValidate(productKey string, deviceName string, vs *ValueStructure) error {
+	if thingModels == nil {
+		return nil
+	}
+
+	valid, issues, err := thingModels.Validate(productKey, vs.Params)
+	if err != nil {
+		// the validation is skipped, if the thing model is unavailable
+		log.Printf("Unable to load the thing model of product %s, the validation is skipped.\n\r error info: %s\n\r", productKey, err.Error())
+		return nil
+	}
+
+	var reasons []string
+	reject := false
+	for _, issue := range issues {
+		log.Printf("The param of device %s/%s is invalid, %s\n\r", productKey, deviceName, issue)
+		reasons = append(reasons, issue.String())
+		if _, ok := vs.Params[issue.Identifier]; !ok {
+			// the required property is missing
+			reject = true
+		}
+	}
+	if reject || len(valid) == 0 {
+		return fmt.Errorf("the message of device %s/%s is rejected by the thing model validation: %s", productKey, deviceName, strings.Join(reasons, "; "))
+	}
+	vs.Params = valid
+
+	return nil
 }
 
 /*
 create a processor to handle the received data from aliyun amqp server,we should registry it to databasic
 */
-func dataProccessor(tasknode *databasic.TaskNode, rawnode *databasic.RawNode) bool {
+func dataProccessor(ctx context.Context, tasknode *databasic.TaskNode, gt *GeneralStructure) error {
 
-	gt := rawnode.Raw.(*GeneralStructure)
-	result, err := Insert(*gt)
+	result, err := Insert(ctx, *gt)
 	if err != nil {
 		fmt.Print(err.Error())
-		return false
+		return err
+	}
+	if result == nil {
+		return nil
 	}
 	id, _ := result.LastInsertId()
 	num, _ := result.RowsAffected()
 	fmt.Printf("effected rows: %d, last rows id: %d\n\r", num, id)
-	return true
+	return nil
 
 	// info := rawnode.Raw.(*GeneralStructure)
 	// data := info.Value.Params
@@ -1,238 +1,779 @@
 package databasic
 
 import (
+	"container/list"
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-/* the global channel receive all data from all receiving go routine */
-var global_raw_channel chan *RawNode
-
-/* the channel is global channel, which making the privileger receiving control information from router, scheduler, controler... */
-var main_monitor_channel chan *Monitor
-
-/* the node is the global list entry, You can search all DataClass instance of existing base on the node. */
-var global_dataclass_entry *ListNode
-var global_dataclass_num int
-
-/* the node is the global list entry. You can search all ProceNode instance of existing base on the node. */
-var global_procenode_entry *ListNode
-var global_procenode_num int
+/*
+The Broker type holds the registries, the channels, the running slots and the subscriptions of a broker, so the
+brokers created by the Broker_create are isolated from each other, e.g. the ingestion and the queries run in
+different brokers with separate capacity. The procenodes, tasknodes and dataclasses belong to the broker
+registering them. The package functions, e.g. the Send_raw and the ProceNode_register, operate on the default
+broker created by the All_Init, and each of them has a method of the same name operating on the given broker.
+*/
+type Broker struct {
+	/* the channel receive all data from all receiving go routine */
+	raw_channel chan *RawNode
+
+	/* the channel making the privileger receiving control information from router, scheduler, controler... */
+	monitor_channel chan *Monitor
+
+	/* the registries index the DataClass, ProceNode and TaskNode instances of the broker by the id */
+	dataclass_registry *registry[*DataClass]
+	procenode_registry *registry[*ProceNode]
+	tasknode_registry  *registry[*TaskNode]
+
+	/*
+		the lock protects the closed, the sender checks it and joins the senders while the lock is held, and sends to
+		the raw channel without the lock. The Shutdown closes the stopping to wake up the blocked senders, and closes
+		the raw channel after all the senders return, so nobody sends to the closed channel. The done channel is closed
+		after the broker is drained, which stops the scheduler and the controler.
+	*/
+	lock     sync.RWMutex
+	closed   bool
+	senders  sync.WaitGroup
+	stopping chan struct{}
+	done     chan struct{}
+
+	/* the channel is closed, while the router has routed all the rawnodes of the closed raw channel */
+	router_done chan struct{}
+
+	/* the group waits for the router, scheduler, controler, injector and reaper go routines, which return after the Shutdown */
+	group sync.WaitGroup
+
+	/* the queue holds the registered tasknodes that require a go routine, and the scheduler waits on the cond until the queue is not empty */
+	schedule_queue   []*TaskNode
+	schedule_lock    sync.Mutex
+	schedule_cond    *sync.Cond
+	schedule_stopped bool
+
+	/* the lock protects the running slots, the waiters and the virtual time of the tasks */
+	running_lock   sync.Mutex
+	running_num    int
+	running_max    int
+	running_queue  map[int][]*running_waiter
+	running_vclock map[int]float64
+
+	/* the map holds the subscribers of each pattern and the cache holds the matched pattern of the routes */
+	subscription_lock sync.RWMutex
+	subscriptions     map[string][]*ProceNode
+	route_cache       map[string]string
+
+	/* the dataclasses registered by the Cache_put, the most recently used one is the front */
+	cache_lock   sync.Mutex
+	cache_recent *list.List
+
+	/* the limits of the route patterns and the devices, which are checked by the router */
+	ratelimit_lock sync.Mutex
+	route_limits   map[string]*rate_limiter
+	route_matched  map[string]string /* the cache of the pattern of route_limits matching each route, "" means none */
+	device_limits  map[string]*rate_limiter
+	rate_delayed   rate_queue    /* the rawnodes delayed by the RATE_DELAY, which are released by the delayer */
+	rate_seq       uint64        /* the sequence of the delayed rawnodes */
+	rate_wake      chan struct{} /* the channel wakes up the delayer while a rawnode is delayed */
+
+	/* the jobs injecting the rawnodes on the timer, and the channel wakes up the injector while they are changed */
+	job_registry *registry[*Job]
+	job_wake     chan struct{}
+
+	/* the write-ahead log is nil until the WAL_open */
+	wal      *wal_state
+	wal_lock sync.RWMutex
+
+	/* the coordinator forwarding the rawnodes to the workers, it is nil until the Remote_listen */
+	remote      *remote_state
+	remote_lock sync.Mutex
+
+	/* the dead letter store of the rawnodes failed after the retries and the messages quarantined by the sources */
+	deadletters     *DeadLetterStore
+	deadletter_lock sync.Mutex
+	parked          int64 /* the number of rawnodes parked by the DeadLetter_park, which is counted by the Shutdown */
+
+	/* the time source of the broker, which is the real time unless it is set by the Broker_set_clock */
+	clock Clock
+
+	/* the function is called with the lifecycle events of the tasks, and the number of created and reaped tasks */
+	lifecycle_listener func(event TaskEvent)
+	Stat_created       int64
+	Stat_reaped        int64
+
+	/* the function is called, while a calling is slow or overruns the deadline */
+	slow_reporter func(tasknode *TaskNode, rawnode *RawNode, elapsed time.Duration, overrun bool)
+}
 
-/* the node is the global list entry. You can search all TaskNode instance of existing base on the node */
-var global_tasknode_entry *ListNode
-var global_tasknode_num int
+/* the default broker operated by the package functions, it is created by the All_Init */
+var global_broker *Broker
 
+/* the following const is the default limits of the registries, which can be changed after All_Init */
 const (
-	MAX_TASKNODE_NUMBER  int = 10
-	MAX_PROCENODE_NUMBER int = 10
-	MAX_DATACLASS_NUMBER int = 100
+	MAX_TASKNODE_NUMBER  int = 1000
+	MAX_PROCENODE_NUMBER int = 100
+	MAX_DATACLASS_NUMBER int = 1000
 	MAX_RAWNODE_NUMBER   int = 100
 )
 
 /* the following const should be cared by user */
 const (
 	DEFAULT_MONITOR_SIZE   int           = 200
-	DEFAULT_TIMEPEICE      time.Duration = time.Millisecond
+	DEFAULT_TIMEPEICE      time.Duration = 10 * time.Second
 	DEFAUT_SLEEP_TIMEPEICE time.Duration = time.Millisecond
 	DEFAULT_TIMEOUT        time.Duration = time.Millisecond
 )
 
+/*
+the following const is the op codes of the monitor handled by the Controler. The Information of the monitor is
+the *ProceNode or the procenode id for the Update, the buffer size int for the Resize and the time.Duration for
+the Timepeice. The Add, Remove and Perform are reserved.
+*/
 const (
 	Add        int = 1
 	Remove     int = 2
-	Update     int = 3
+	Update     int = 3 /* swap the procenode of the tasknode */
 	Unregister int = 4
 	Perform    int = 5
+	Pause      int = 6
+	Resume     int = 7
+	Resize     int = 8 /* change the buffer size of the tasknode */
+	Timepeice  int = 9 /* change the timepeice of the tasknode */
 )
 
-func Broker() {
-	/* the unique functionality of broker is to create router, scheduler, controler, privileger go routine */
-	go Router()
-	go Scheduler()
-	// we should create a go routine based on Controler(), but the conroler() is empty.
-	//go Controler()
-}
+/*
+the function creates a broker, the raw_size is the capacity of the raw channel and the running_max is the max
+number of running callings of all the tasks, the 0 means unlimited. The broker runs after the Broker_start.
+*/
+func Broker_create(raw_size int, running_max int) *Broker {
+	broker := new(Broker)
 
-func Router() {
+	broker.dataclass_registry = registry_create[*DataClass](MAX_DATACLASS_NUMBER)
+	broker.cache_recent = list.New()
+	broker.procenode_registry = registry_create[*ProceNode](MAX_PROCENODE_NUMBER)
+	broker.tasknode_registry = registry_create[*TaskNode](MAX_TASKNODE_NUMBER)
+	broker.job_registry = registry_create[*Job](MAX_JOB_NUMBER)
+	broker.job_wake = make(chan struct{}, 1)
 
-	for {
-		/* receiving rawnode from global channel. */
-		/* we should sleep to wait the rawnode, if the global channel is empty. */
-		var rawnode *RawNode
+	/* the dead letter store parks the rawnodes failed after the retries */
+	broker.deadletters = DeadLetterStore_create(DEFAULT_DEADLETTER_SIZE)
+
+	/* the running slots shared by all the tasks of the broker */
+	broker.running_max = running_max
+	broker.running_init()
+
+	/* the subscriptions of the routes */
+	broker.subscription_init()
+
+	/* the rate limits of the routes and devices */
+	broker.ratelimit_init()
+
+	broker.schedule_cond = sync.NewCond(&broker.schedule_lock)
+
+	broker.raw_channel = make(chan *RawNode, raw_size)
+	broker.stopping = make(chan struct{})
+	broker.done = make(chan struct{})
+	broker.router_done = make(chan struct{})
+
+	/* initialize the main monitor control channel */
+	broker.monitor_channel = make(chan *Monitor, DEFAULT_MONITOR_SIZE)
+
+	broker.slow_reporter = slow_report_log
+	broker.lifecycle_listener = lifecycle_log
+	broker.clock = real_clock{}
+
+	return broker
+}
+
+/*
+the broker runs until the ctx is done, then it is shut down by the Shutdown with the DEFAULT_SHUTDOWN_TIMEOUT.
+The Shutdown can be called before the ctx is done, which returns the report of the undelivered rawnodes.
+*/
+func (b *Broker) Broker_start(ctx context.Context) {
+	/* the unique functionality of broker is to create router, scheduler, controler, injector, reaper, delayer go routine */
+	b.group.Add(6)
+	go func() {
+		defer b.group.Done()
+		b.Router()
+	}()
+	go func() {
+		defer b.group.Done()
+		b.Scheduler()
+	}()
+	go func() {
+		defer b.group.Done()
+		b.Controler()
+	}()
+	go func() {
+		defer b.group.Done()
+		b.Injector()
+	}()
+	go func() {
+		defer b.group.Done()
+		b.Reaper()
+	}()
+	go func() {
+		defer b.group.Done()
+		b.Delayer()
+	}()
+
+	go func() {
 		select {
-		case rawnode = <-Receive_raw():
-			/* we should to ignore the rawnode and receive next rawnode, if the rawnode id is empty */
-			if rawnode.Id == "" {
-				continue
+		case <-ctx.Done():
+		case <-b.done:
+			return
+		}
+		shutdown_ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_SHUTDOWN_TIMEOUT)
+		defer cancel()
+		report, err := b.Shutdown(shutdown_ctx)
+		if report != nil {
+			/* nobody receives the report, so the rawnodes admitted but not logged are parked */
+			for _, rawnode := range report.Rawnodes {
+				b.DeadLetter_park(rawnode)
 			}
-		default:
-			/* sleeping go routine to wait rawnode */
-			time.Sleep(DEFAUT_SLEEP_TIMEPEICE)
-			continue
+			report.Parked += len(report.Rawnodes)
+			shutdown_report_log(report, err)
 		}
+	}()
+}
 
-		/* select a proper tasknode base on rawnode id */
-		tasknode := TaskNode_find(rawnode.Id)
-		/* we should to create a new tasknode, if the task list no matched tasknode */
-		if tasknode == nil {
-			/* select a proper procenode base on rawnode id */
-			procenode := ProceNode_find(rawnode.Id)
-			/* we should ignore the rawnode, if the procenode list no matched procenode */
-			if procenode == nil {
-				/* we should to handle the condition that a raw data receiving from global
-				channel which is not capability to process */
-				fmt.Printf("The process receiving from the global a raw data named %s that no capability to handler\n\r", rawnode.Id)
-				continue
-			} else {
-				tasknode = TaskNode_register(rawnode.Id, procenode, DEFAULT_TIMEPEICE)
-				if tasknode == nil {
-					fmt.Printf("The task of aiming to process the raw data named %s unable to register!\n\r", rawnode.Id)
-					continue
+func (b *Broker) Router() {
+	defer close(b.router_done)
+
+	/* receiving rawnode from global channel. the router is blocked until a rawnode arrives. */
+	for rawnode := range b.Receive_raw() {
+		/* the rawnode over the rate limit is dropped before routing */
+		if b.router_limit(rawnode) {
+			b.router_route(rawnode)
+		}
+	}
+
+}
+
+/*
+the function routes the rawnode to the tasks. The rawnode is copied to the tasks of all the procenodes
+subscribing the rawnode id, or it is routed to the task named the rawnode id if no procenode subscribes it.
+It is called by the router and the Emit of the pipeline stages. The error is returned, if the rawnode is
+not delivered to any task.
+*/
+func (b *Broker) router_route(rawnode *RawNode) error {
+	/* we should to ignore the rawnode and receive next rawnode, if the rawnode id is empty */
+	if rawnode == nil {
+		return ErrNoRoute
+	} else if rawnode.Id == "" {
+		wal_done(rawnode)
+		rawnode.rawnode_fail(ErrNoRoute)
+		return ErrNoRoute
+	}
+
+	subscribers := b.route_subscribers(rawnode.Id)
+	if len(subscribers) > 1 {
+		/*
+			each subscriber receives a copy, and the source is admitted once. The source is admitted with the first
+			error only if every copy is refused, so it is redelivered without duplicating the copies accepted.
+			Otherwise the copies refused are parked in the dead letter to be re-driven to their tasks, and the
+			source is admitted. The call is failed by the first error instead.
+		*/
+		var first error
+		var refused []*RawNode
+		for _, procenode := range subscribers {
+			copied := rawnode_copy(rawnode, procenode.Id)
+			err := b.router_offer(copied, procenode.Id, procenode)
+			if err != nil {
+				if first == nil {
+					first = err
 				}
+				copied.Failure = err
+				refused = append(refused, copied)
 			}
 		}
-		//
-		/* 		monitor := Monitor_Create(tasknode, rawnode, Add)
-		   		Send_mon(monitor) */
-
-		// we will add a component that handle this rawnode of failed to push rawnode
-		ok := tasknode.TaskNode_Push(rawnode)
-		if !ok {
-			log.Printf("The task of aiming to process the raw data named %s unable to push rawnode!\n\r", rawnode.Id)
+		if first != nil && len(refused) < len(subscribers) && rawnode.reply == nil {
+			for _, copied := range refused {
+				b.DeadLetter_park(copied)
+			}
+			first = nil
 		}
+		/* the copies hold the entry of the write-ahead log, the source is done */
+		wal_done(rawnode)
+		rawnode.rawnode_admit(first)
+		return first
+	} else if len(subscribers) == 1 {
+		return b.router_offer(rawnode, subscribers[0].Id, subscribers[0])
 	}
 
+	/* select a proper tasknode base on rawnode id */
+	tasknode := b.TaskNode_find(rawnode.Id)
+	if tasknode != nil {
+		return b.router_offer(rawnode, rawnode.Id, tasknode.TaskNode_method())
+	}
+	/* select a proper procenode base on rawnode id */
+	procenode := b.ProceNode_find(rawnode.Id)
+	/* we should ignore the rawnode, if the procenode list no matched procenode */
+	if procenode == nil {
+		/* we should to handle the condition that a raw data receiving from global
+		channel which is not capability to process */
+		fmt.Printf("The process receiving from the global a raw data named %s that no capability to handler\n\r", rawnode.Id)
+		wal_done(rawnode)
+		rawnode.rawnode_fail(ErrNoRoute)
+		return ErrNoRoute
+	}
+	return b.router_offer(rawnode, rawnode.Id, procenode)
 }
 
-func Scheduler() {
+/* the function offers the rawnode to the task named id, the task is registered if it does not exist. */
+func (b *Broker) router_offer(rawnode *RawNode, id string, procenode *ProceNode) error {
 	for {
-		/* select a proper tasknode to work. now we select the first tasknode */
-		tasknode := TaskNode_find("first")
+		/* select a proper tasknode base on the id */
+		tasknode := b.TaskNode_find(id)
+		/* we should to create a new tasknode, if the task list no matched tasknode */
 		if tasknode == nil {
-			/* we print the information to handle the condition of the task list is empty */
-			//fmt.Printf("The urgent task is not found due to the task list is empty!\n\r")
-			time.Sleep(DEFAUT_SLEEP_TIMEPEICE)
-			continue
-		} else if tasknode.Goroutine {
-			time.Sleep(DEFAUT_SLEEP_TIMEPEICE)
-			continue
+			tasknode = TaskNode_register(id, procenode, DEFAULT_TIMEPEICE)
+			if tasknode == nil {
+				/* the tasknode is possible registered by the user at the same time */
+				tasknode = b.TaskNode_find(id)
+			}
+			if tasknode == nil {
+				fmt.Printf("The task of aiming to process the raw data named %s unable to register!\n\r", rawnode.Id)
+				return fmt.Errorf("the task %s unable to register", id)
+			}
 		}
-		/* the method is forced convert to the type of func(*RawNode, *TaskNode) bool */
-		method := tasknode.Method.Operation.(func(*TaskNode, *RawNode) bool)
-		if method == nil {
-			/* the branch is no possible arriving */
+
+		/* the rawnode is handled by the overflow policy of the task, while the buffer is full */
+		err := tasknode.TaskNode_offer(rawnode)
+		if errors.Is(err, ErrTaskReaped) {
+			/* the task is reaped after it is found, the rawnode is offered to a new one */
 			continue
 		}
+		if err != nil {
+			log.Printf("The task of aiming to process the raw data named %s unable to push rawnode: %s\n\r", rawnode.Id, err.Error())
+		}
+		return err
+	}
+}
+
+func (b *Broker) Scheduler() {
+	for {
+		/* select a tasknode that has no go routine. the scheduler is blocked on the cond until
+		the TaskNode_register signals a new tasknode. */
+		b.schedule_lock.Lock()
+		for len(b.schedule_queue) == 0 && !b.schedule_stopped {
+			b.schedule_cond.Wait()
+		}
+		/* the scheduler returns, while the broker is shut down */
+		if b.schedule_stopped {
+			b.schedule_lock.Unlock()
+			return
+		}
+		tasknode := b.schedule_queue[0]
+		b.schedule_queue = b.schedule_queue[1:]
+		b.schedule_lock.Unlock()
 		tasknode.Goroutine = true
+
+		/* the operation is validated while registering the procenode */
+		procenode := tasknode.TaskNode_method()
+		if procenode == nil || !procenode.version_valid() {
+			fmt.Printf("The method of the task %s is not a valid operation!\n\r", tasknode.Id)
+			continue
+		}
 		/* you should to consider the argument that the go routine that will be created required */
-		go func(tasknode *TaskNode) {
-			// we should to create a context by use the context.WithDeadLine(), if we want to add timepeice for the go routine
-			ctx := context.TODO()
-
-			for {
-				select {
-				// the case check if the context expity or not
-				case <-ctx.Done():
-					return
-				// the case check if the task has canceled or not
-				case <-tasknode.Cancel:
-					return
-				// the case check if have rawnode or not in task buffer
-				default:
-					rawnode := tasknode.TaskNode_Fetch()
-					if rawnode == nil {
-						time.Sleep(DEFAUT_SLEEP_TIMEPEICE)
-						continue
-					}
-					ok := method(tasknode, rawnode)
-					if !ok {
-						fmt.Printf("in the task go routine %s, the method return a error!\n\r", tasknode.Id)
-					} else {
-						// Now, we dont to handle the condition
-					}
-				}
+		go task_run(tasknode, procenode)
+	}
+}
 
-			}
-		}(tasknode)
-		/* move the tasknode to list hail */
-		{
-			listnode := tasknode.List
-			ok := ListNode_delete(listnode)
+/* the function adds the tasknode to the queue of the scheduler, which creates the go routines of the task */
+func (b *Broker) schedule(tasknode *TaskNode) {
+	b.schedule_lock.Lock()
+	b.schedule_queue = append(b.schedule_queue, tasknode)
+	b.schedule_lock.Unlock()
+	b.schedule_cond.Signal()
+}
+
+/*
+the function runs the tasknode. The rawnodes in the task buffer are dispatched to the worker go routines
+base on the partition key, if the concurrency of the procenode is greater than 1. The concurrency and partition
+of the procenode running the task at first are kept, even if the procenode is swapped by the Controler.
+*/
+func task_run(tasknode *TaskNode, procenode *ProceNode) {
+	if procenode.Concurrency <= 1 {
+		task_worker(tasknode, nil)
+		return
+	}
+	partition := procenode.Partition
+	if partition == nil {
+		partition = RawNode_key
+	}
+
+	workers := make([]chan *RawNode, procenode.Concurrency)
+	for i := range workers {
+		workers[i] = make(chan *RawNode, DEFAULT_WORKER_BUFFER_SIZE)
+		go task_worker(tasknode, workers[i])
+	}
+	for {
+		/* the buffer is fetched in each loop, because it is replaced while the task is resized */
+		select {
+		case <-tasknode.Cancel:
+			return
+		case rawnode, ok := <-tasknode.TaskNode_buffer():
 			if !ok {
-				fmt.Printf("")
+				continue
+			}
+			/* the buffer has space, the spilled rawnodes are reloaded and the blocked offerings are waked up */
+			tasknode.task_unspill()
+			tasknode.task_signal_space()
+			/* the rawnodes having the same key are always dispatched to the same worker to keep the order */
+			hash := fnv.New32a()
+			hash.Write([]byte(partition(rawnode)))
+			index := hash.Sum32() % uint32(len(workers))
+			select {
+			case workers[index] <- rawnode:
+			case <-tasknode.Cancel:
+				return
 			}
-			ok = ListNode_insert_prev(global_tasknode_entry, listnode)
+		}
+	}
+}
+
+/*
+the function processes the rawnodes received from the input one by one, until the task is canceled. The buffer
+of the task is the input, if the input is nil. The procenode is fetched for each rawnode, so the procenode
+swapped by the Controler takes effect from the next rawnode.
+*/
+func task_worker(tasknode *TaskNode, input <-chan *RawNode) {
+	atomic.AddInt64(&tasknode.Stat_workers, 1)
+	defer atomic.AddInt64(&tasknode.Stat_workers, -1)
+
+	for {
+		/* the go routine is blocked while the task is paused */
+		if !tasknode.task_wait_resume() {
+			return
+		}
+		source := input
+		if source == nil {
+			source = tasknode.TaskNode_buffer()
+		}
+		/* the go routine is blocked until a rawnode is pushed to the input or the task is canceled */
+		select {
+		// the case check if the task has canceled or not
+		case <-tasknode.Cancel:
+			return
+		// the case receive the rawnode from the input
+		case rawnode, ok := <-source:
 			if !ok {
-				fmt.Printf("")
+				/* the buffer is replaced by the TaskNode_resize */
+				continue
+			}
+			if input == nil {
+				tasknode.task_unspill()
+				tasknode.task_signal_space()
 			}
+			/* the rawnode received before pausing is processed after resuming */
+			if !tasknode.task_wait_resume() {
+				return
+			}
+			task_handle(tasknode, rawnode)
 		}
 	}
 }
 
-func Controler() {
+/*
+the function processes a rawnode received from the task buffer with the retries, and records the result. The
+failed rawnode is parked in the dead letter, unless it is a call.
+*/
+func task_handle(tasknode *TaskNode, rawnode *RawNode) {
+	err := task_retry(tasknode, tasknode.TaskNode_method(), rawnode)
+	tasknode.task_record_result(err)
+	if rawnode.rawnode_complete(err) {
+		/* the result of a call is returned to the caller instead of the dead letter */
+	} else if err != nil {
+		/* the rawnode is parked in the dead letter, which can be re-driven after the failure is fixed */
+		fmt.Printf("in the task go routine %s, the method return a error after %d attempts: %s\n\r", tasknode.Id, rawnode.Attempts, err.Error())
+		tasknode.broker.DeadLetter_park(rawnode)
+	} else {
+		wal_done(rawnode)
+	}
+	tasknode.task_touch()
+	atomic.AddInt64(&tasknode.Stat_pending, -1)
+}
 
+/*
+the function calls the method under the context returned by the TaskNode_context. The context is canceled and the
+overrun is reported at once, if the method does not return before the deadline, but the function still waits for
+the method to return. So the retry and the next rawnode of the key never run beside the overrun calling, which
+keeps the order of the key, and the running slot and the version are held until the calling really returns. The
+overrun calling returning nil at last is processed, so it is never retried to make a duplicate.
+The slow and overrun callings are reported by the slow reporter.
+*/
+func task_process(tasknode *TaskNode, method Processor, rawnode *RawNode) error {
+	/* the context of a call is the parent, so the calling is canceled while the caller gives up */
+	ctx, cancel := tasknode.TaskNode_context(rawnode.rawnode_context())
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("the method panics: %v", r)
+			}
+		}()
+		done <- method.Process(ctx, tasknode, rawnode)
+	}()
+
+	select {
+	case err := <-done:
+		elapsed := time.Since(start)
+		tasknode.task_record_latency(elapsed)
+		if timepeice := tasknode.TaskNode_timepeice(); timepeice > 0 && elapsed > timepeice/2 {
+			atomic.AddInt64(&tasknode.Stat_slow, 1)
+			tasknode.broker.slow_reporter(tasknode, rawnode, elapsed, false)
+		}
+		return err
+	case <-ctx.Done():
+		atomic.AddInt64(&tasknode.Stat_overrun, 1)
+		tasknode.broker.slow_reporter(tasknode, rawnode, time.Since(start), true)
+		/* the method ignoring the context is waited, the key is blocked until it returns */
+		err := <-done
+		tasknode.task_record_latency(time.Since(start))
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("%w: %s: %s", ErrOverrun, ctx.Err(), err.Error())
+	}
 }
 
-func Receive_raw() <-chan *RawNode {
-	return global_raw_channel
+/* the function sets the slow reporter of the broker, it should be called before the Broker_start */
+func (b *Broker) Slow_report_set(reporter func(tasknode *TaskNode, rawnode *RawNode, elapsed time.Duration, overrun bool)) {
+	if reporter == nil {
+		reporter = slow_report_log
+	}
+	b.slow_reporter = reporter
 }
 
-func Send_raw(rawnode *RawNode) {
-	global_raw_channel <- rawnode
+func slow_report_log(tasknode *TaskNode, rawnode *RawNode, elapsed time.Duration, overrun bool) {
+	if overrun {
+		log.Printf("The method of the task %s overruns the deadline after %s, the key waits for it to return!\n\r", tasknode.Id, elapsed)
+	} else {
+		log.Printf("The method of the task %s is slow, the calling takes %s!\n\r", tasknode.Id, elapsed)
+	}
 }
 
-func Send_mon(Monitor *Monitor) {
-	main_monitor_channel <- Monitor
+/*
+the controler handles the monitors received from the main monitor channel one by one, and acknowledges each
+monitor with the result. The controler is blocked until a monitor arrives.
+*/
+func (b *Broker) Controler() {
+	monitors := b.Receive_mon()
+	for {
+		var monitor *Monitor
+		select {
+		case monitor = <-monitors:
+		case <-b.done:
+			/* the controler returns, while the broker is shut down */
+			return
+		}
+		if monitor == nil {
+			continue
+		}
+		err := b.controler_handle(monitor)
+		if err != nil {
+			log.Printf("The controler unable to handle the monitor %d: %s\n\r", monitor.Operation, err.Error())
+		}
+		monitor.monitor_ack(err)
+	}
 }
 
-func Receive_mon() <-chan *Monitor {
-	return main_monitor_channel
+func (b *Broker) controler_handle(monitor *Monitor) error {
+	tasknode := monitor.Tasknode
+	if tasknode == nil {
+		return fmt.Errorf("%w: the tasknode is nil", ErrMonitorInformation)
+	}
+
+	switch monitor.Operation {
+	case Pause:
+		if !tasknode.TaskNode_pause() {
+			return fmt.Errorf("the task %s is paused already", tasknode.Id)
+		}
+	case Resume:
+		if !tasknode.TaskNode_resume() {
+			return fmt.Errorf("the task %s is not paused", tasknode.Id)
+		}
+	case Update:
+		var procenode *ProceNode
+		switch information := monitor.Information.(type) {
+		case *ProceNode:
+			procenode = information
+		case string:
+			procenode = b.ProceNode_find(information)
+		}
+		if procenode == nil || !procenode.version_valid() {
+			return fmt.Errorf("%w: the procenode %v is not found", ErrMonitorInformation, monitor.Information)
+		}
+		tasknode.TaskNode_update_mthod(procenode, context.Background())
+	case Resize:
+		size, ok := monitor.Information.(int)
+		if !ok {
+			return fmt.Errorf("%w: the size is %T, want int", ErrMonitorInformation, monitor.Information)
+		}
+		return tasknode.TaskNode_resize(size)
+	case Timepeice:
+		timepeice, ok := monitor.Information.(time.Duration)
+		if !ok {
+			return fmt.Errorf("%w: the timepeice is %T, want time.Duration", ErrMonitorInformation, monitor.Information)
+		}
+		return tasknode.TaskNode_update_timepeice(int64(timepeice))
+	case Unregister:
+		return b.task_abandon(tasknode)
+	default:
+		return fmt.Errorf("%w: %d", ErrMonitorOperation, monitor.Operation)
+	}
+	return nil
+}
+
+/*
+the function unregisters the tasknode for the Unregister monitor. The offering is blocked like reaping, so the router
+offers the following rawnodes to a new task, and the rawnodes left in the buffer and the spill are failed with the
+ErrTaskUnregistered: the call is completed with it, and the others are parked in the dead letter to be re-driven.
+*/
+func (b *Broker) task_abandon(tasknode *TaskNode) error {
+	tasknode.offer_lock.Lock()
+	if tasknode.reaped || !tasknode.TaskNode_unregister() {
+		tasknode.offer_lock.Unlock()
+		return fmt.Errorf("the task %s is not registered", tasknode.Id)
+	}
+	tasknode.reaped = true
+	tasknode.offer_lock.Unlock()
+
+	failed := 0
+	for {
+		tasknode.task_unspill()
+		rawnode := tasknode.TaskNode_Fetch()
+		if rawnode == nil {
+			break
+		}
+		failed++
+		rawnode.Failure = ErrTaskUnregistered
+		if rawnode.reply != nil {
+			rawnode.rawnode_fail(ErrTaskUnregistered)
+		} else {
+			b.DeadLetter_park(rawnode)
+		}
+	}
+	if failed > 0 {
+		log.Printf("The task %s is unregistered, the %d rawnodes left are failed.\n\r", tasknode.Id, failed)
+	}
+	return nil
 }
 
+func (b *Broker) Receive_raw() <-chan *RawNode {
+	return b.raw_channel
+}
+
+/* the function sends the rawnode to the router. It returns false, if the broker is shut down or the wal is failed. */
+func (b *Broker) Send_raw(rawnode *RawNode) bool {
+	return b.Send(rawnode) == nil
+}
+
+/*
+the function is the same as the Send_raw, but it returns the ErrBrokerClosed if the broker is shut down, or the
+ErrWALWrite if the rawnode unable to write the write-ahead log. The rawnode is not routed, if the error is returned.
+*/
+func (b *Broker) Send(rawnode *RawNode) error {
+	return b.send(context.Background(), rawnode)
+}
+
+/*
+the function is the same as the Send, but it returns the ctx.Err() if the ctx is done while the raw channel is full.
+The lock is not held while waiting for the raw channel, and the ErrBrokerClosed is returned if the broker is shut
+down meanwhile. The rawnode is done in the write-ahead log, if it is not sent.
+*/
+func (b *Broker) send(ctx context.Context, rawnode *RawNode) error {
+	b.lock.RLock()
+	if b.closed {
+		b.lock.RUnlock()
+		return ErrBrokerClosed
+	}
+	/* the rawnode is logged before routing, so it is replayed if the process crashes before it is done */
+	err := b.wal_append(rawnode)
+	if err != nil {
+		b.lock.RUnlock()
+		return err
+	}
+	b.senders.Add(1)
+	b.lock.RUnlock()
+	defer b.senders.Done()
+
+	select {
+	case b.raw_channel <- rawnode:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-b.stopping:
+		err = ErrBrokerClosed
+	}
+	wal_done(rawnode)
+	return err
+}
+
+func (b *Broker) Send_mon(Monitor *Monitor) {
+	b.monitor_channel <- Monitor
+}
+
+func (b *Broker) Receive_mon() <-chan *Monitor {
+	return b.monitor_channel
+}
+
+/* the function creates the default broker, which is operated by the package functions */
 func All_Init() {
-	/* initialize the global resource */
-	global_dataclass_entry = ListNode_create(nil)
-	global_dataclass_num = 0
-
-	global_procenode_entry = ListNode_create(nil)
-	global_procenode_num = 0
-
-	global_tasknode_entry = ListNode_create(nil)
-	global_tasknode_num = 0
-
-	procenode := new(ProceNode)
-	procenode.Id = "global"
-	procenode.List = global_procenode_entry
-	procenode.Lock = 1
-	procenode.Operation = "global"
-
-	dataclass := new(DataClass)
-	dataclass.Id = "global"
-	dataclass.List = global_dataclass_entry
-	dataclass.Node_max = 100
-	dataclass.Node_num = 0
-	dataclass.Node_list = nil /* it is possible to make error */
-
-	tasknode := new(TaskNode)
-	tasknode.Id = "global"
-	tasknode.Method = nil /* it is possible to make error */
-	tasknode.Tiemout_is_set = false
-	tasknode.Timeout = time.Now()
-	tasknode.Timepeice = 0
-	tasknode.Buffer = make(chan *RawNode, 100)
-	tasknode.List = global_tasknode_entry
-
-	global_dataclass_entry.Parent = dataclass
-	global_procenode_entry.Parent = procenode
-	global_tasknode_entry.Parent = tasknode
-
-	/* initialize the global raw channel */
-	global_raw_channel = make(chan *RawNode, MAX_RAWNODE_NUMBER)
+	global_broker = Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+}
 
-	/* initialize the main monitor control channel */
-	main_monitor_channel = make(chan *Monitor, DEFAULT_MONITOR_SIZE)
+/* the function returns the default broker created by the All_Init */
+func Broker_default() *Broker {
+	return global_broker
+}
+
+/* the following functions operate on the default broker, see the methods of the same name */
+
+func Broker_start(ctx context.Context) {
+	global_broker.Broker_start(ctx)
+}
+
+func Router() {
+	global_broker.Router()
+}
+
+func Scheduler() {
+	global_broker.Scheduler()
+}
+
+func Controler() {
+	global_broker.Controler()
+}
+
+func Receive_raw() <-chan *RawNode {
+	return global_broker.Receive_raw()
+}
+
+func Send_raw(rawnode *RawNode) bool {
+	return global_broker.Send_raw(rawnode)
+}
+
+func Send(rawnode *RawNode) error {
+	return global_broker.Send(rawnode)
+}
+
+func Send_mon(Monitor *Monitor) {
+	global_broker.Send_mon(Monitor)
+}
+
+func Receive_mon() <-chan *Monitor {
+	return global_broker.Receive_mon()
+}
 
+func Slow_report_set(reporter func(tasknode *TaskNode, rawnode *RawNode, elapsed time.Duration, overrun bool)) {
+	global_broker.Slow_report_set(reporter)
 }
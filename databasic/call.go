@@ -0,0 +1,158 @@
+package databasic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+The Call sends a rawnode to the route and waits for the reply, which make the synchronous consumers, e.g. the
+http server, use the broker without sharing the response writer with the processors. The processor replies by
+the Reply or the TypedReply. The call is completed while the rawnode is replied, processed without reply,
+failed after the retries, dropped or rejected by the overflow policy, or unable to route, so the caller never
+waits forever. The context of the call is the parent of the context passed to the processor, so the calling
+is canceled while the caller gives up.
+
+The failed call is returned to the caller instead of being parked in the dead letter, and it is never logged
+in the write-ahead log, because nobody waits for its reply after restarting. The copies of a fanned out call
+share the reply, and the first result wins.
+*/
+const (
+	DEFAULT_CALL_TIMEOUT time.Duration = 10 * time.Second /* the timeout of the call, if the ctx has no deadline */
+)
+
+var (
+	/* the error is returned, if the call is not replied while the rawnode is processed */
+	ErrNoReply = errors.New("the call is processed without reply")
+	/* the error is returned by the Reply, if the rawnode is not sent by the Call or it is replied already */
+	ErrReplied = errors.New("the rawnode is not a call or replied already")
+)
+
+/* the future of a call, it is completed once by the reply or the error */
+type reply_future struct {
+	once  sync.Once
+	done  chan struct{}
+	reply interface{}
+	err   error
+	ctx   context.Context
+	then  func(reply interface{}, err error) /* it is called once while the future is completed, e.g. to finish the run of a job */
+}
+
+func (rf *reply_future) complete(reply interface{}, err error) bool {
+	completed := false
+	rf.once.Do(func() {
+		rf.reply = reply
+		rf.err = err
+		close(rf.done)
+		completed = true
+		if rf.then != nil {
+			rf.then(reply, err)
+		}
+	})
+	return completed
+}
+
+/*
+the function sends the payload to the route and waits for the reply of the processor. The ctx is given the
+DEFAULT_CALL_TIMEOUT, if it has no deadline. It returns the ctx.Err(), if the ctx is done before the reply.
+*/
+func (b *Broker) Call(ctx context.Context, route string, payload interface{}) (interface{}, error) {
+	return b.call(ctx, RawNode_create(route, payload))
+}
+
+/* the function sends the rawnode as a call, e.g. the rawnode forwarded by the coordinator keeps its Key */
+func (b *Broker) call(ctx context.Context, rawnode *RawNode) (interface{}, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DEFAULT_CALL_TIMEOUT)
+		defer cancel()
+	}
+	future := &reply_future{done: make(chan struct{}), ctx: ctx}
+	rawnode.reply = future
+	rawnode.Admit = func(rawnode *RawNode, err error) {
+		if err != nil {
+			future.complete(nil, err)
+		}
+	}
+
+	/* the sending waits for the raw channel until the ctx is done, the rawnode is not routed if it is failed */
+	err := b.send(ctx, rawnode)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-future.done:
+		return future.reply, future.err
+	case <-ctx.Done():
+		/* the rawnode is skipped by the task, if it is not processed yet */
+		future.complete(nil, ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+func Call(ctx context.Context, route string, payload interface{}) (interface{}, error) {
+	return global_broker.Call(ctx, route, payload)
+}
+
+/*
+the function replies the rawnode sent by the Call, the caller returns the reply at once. It returns the ErrReplied,
+if the rawnode is not a call or it is replied already, e.g. by another subscriber.
+*/
+func Reply(rawnode *RawNode, reply interface{}) error {
+	if rawnode.reply == nil || !rawnode.reply.complete(reply, nil) {
+		return ErrReplied
+	}
+	return nil
+}
+
+/*
+The function creates a Processor replying the call with the output of the handler. The call is failed with the
+error of the handler, and the rawnode not sent by the Call is failed with the ErrReplied.
+*/
+func TypedReply[I any, O any](handler func(ctx context.Context, tasknode *TaskNode, payload I) (O, error)) Processor {
+	return ProcessorFunc(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		payload, err := RawNode_payload[I](rawnode)
+		if err != nil {
+			return err
+		}
+		output, err := handler(ctx, tasknode, payload)
+		if err != nil {
+			return err
+		}
+		return Reply(rawnode, output)
+	})
+}
+
+/* the function returns the context of the call, or the background if the rawnode is not a call */
+func (rawnode *RawNode) rawnode_context() context.Context {
+	if rawnode.reply == nil {
+		return context.Background()
+	}
+	return rawnode.reply.ctx
+}
+
+/*
+the function completes the call with the result of the task. It returns false, if the rawnode is not a call, so
+the failed rawnode is parked in the dead letter.
+*/
+func (rawnode *RawNode) rawnode_complete(err error) bool {
+	if rawnode.reply == nil {
+		return false
+	}
+	if err != nil {
+		rawnode.rawnode_fail(fmt.Errorf("the call of %s is failed after %d attempts: %w", rawnode.Id, rawnode.Attempts, err))
+	} else {
+		rawnode.rawnode_fail(ErrNoReply)
+	}
+	return true
+}
+
+/* the function fails the call with the err, e.g. it is unable to route. It does nothing, if the rawnode is not a call. */
+func (rawnode *RawNode) rawnode_fail(err error) {
+	if rawnode.reply != nil {
+		rawnode.reply.complete(nil, err)
+	}
+}
@@ -0,0 +1,171 @@
+package databasic
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+The Clock is the time source of the broker, which drives the backoff of the retries, the blocking timeout of the
+overflow policy and the timestamps of the dead letters and the failures. The broker uses the real time by default,
+and the Harness replaces it by a VirtualClock, so the tests never sleep and the results are deterministic. The
+deadline of the callings is always in the real time, because it protects the task from a hung method.
+*/
+type Clock interface {
+	Now() time.Time
+	/* the method returns a channel receiving the time after the duration, and a function stopping it */
+	Timer(duration time.Duration) (<-chan time.Time, func() bool)
+}
+
+/* the clock of the real time */
+type real_clock struct{}
+
+func (real_clock) Now() time.Time {
+	return time.Now()
+}
+
+func (real_clock) Timer(duration time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(duration)
+	return timer.C, timer.Stop
+}
+
+/*
+The VirtualClock is a Clock moved by the Advance only. The timers fire in the order of their deadline while the
+clock is advanced past them. The processing blocked on a timer is marked by the clock_block, and the waiting
+channel is signaled at that time, which tells the Harness to advance the clock. A timer created but not waited,
+e.g. the blocking offer pushed at the next try, never moves the clock.
+*/
+type VirtualClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	timers  []*virtual_timer
+	blocked int /* the number of go routines blocked on the timers */
+	waiting chan struct{}
+}
+
+type virtual_timer struct {
+	deadline time.Time
+	channel  chan time.Time
+}
+
+/* the function creates a virtual clock starting at the start */
+func VirtualClock_create(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start, waiting: make(chan struct{}, 1)}
+}
+
+func (vc *VirtualClock) Now() time.Time {
+	vc.lock.Lock()
+	defer vc.lock.Unlock()
+
+	return vc.now
+}
+
+func (vc *VirtualClock) Timer(duration time.Duration) (<-chan time.Time, func() bool) {
+	vc.lock.Lock()
+	defer vc.lock.Unlock()
+
+	timer := &virtual_timer{deadline: vc.now.Add(duration), channel: make(chan time.Time, 1)}
+	if duration <= 0 {
+		timer.channel <- vc.now
+		return timer.channel, func() bool { return false }
+	}
+	vc.timers = append(vc.timers, timer)
+	/* the timers of the same deadline fire in the order of creating */
+	sort.SliceStable(vc.timers, func(i, j int) bool { return vc.timers[i].deadline.Before(vc.timers[j].deadline) })
+	return timer.channel, func() bool { return vc.timer_stop(timer) }
+}
+
+func (vc *VirtualClock) timer_stop(timer *virtual_timer) bool {
+	vc.lock.Lock()
+	defer vc.lock.Unlock()
+
+	for i, pending := range vc.timers {
+		if pending == timer {
+			vc.timers = append(vc.timers[:i], vc.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/* the method moves the clock forward by the duration, and fires the timers whose deadline is passed */
+func (vc *VirtualClock) Advance(duration time.Duration) {
+	vc.lock.Lock()
+	defer vc.lock.Unlock()
+
+	vc.now = vc.now.Add(duration)
+	for len(vc.timers) != 0 && !vc.timers[0].deadline.After(vc.now) {
+		vc.timers[0].channel <- vc.timers[0].deadline
+		vc.timers = vc.timers[1:]
+	}
+}
+
+/*
+the function marks the go routine blocked on the timers of the clock, until the returned function is called after
+the blocking. It is called by the processing waiting for a timer, e.g. the backoff of the retries, but not by the
+go routines of the broker, e.g. the Reaper, whose steps are run by the Harness itself.
+*/
+func clock_block(clock Clock) func() {
+	vc, ok := clock.(*VirtualClock)
+	if !ok {
+		return func() {}
+	}
+	vc.lock.Lock()
+	vc.blocked++
+	vc.lock.Unlock()
+	select {
+	case vc.waiting <- struct{}{}:
+	default:
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			vc.lock.Lock()
+			vc.blocked--
+			vc.lock.Unlock()
+		})
+	}
+}
+
+/*
+the method moves the clock to the deadline of the earliest timer and fires it. It returns false, if no timer is
+pending or no go routine is blocked on the clock.
+*/
+func (vc *VirtualClock) advance_next() bool {
+	vc.lock.Lock()
+	if len(vc.timers) == 0 || vc.blocked == 0 {
+		vc.lock.Unlock()
+		return false
+	}
+	duration := vc.timers[0].deadline.Sub(vc.now)
+	vc.lock.Unlock()
+
+	vc.Advance(duration)
+	return true
+}
+
+/* the method returns the number of timers not fired yet */
+func (vc *VirtualClock) Pending() int {
+	vc.lock.Lock()
+	defer vc.lock.Unlock()
+
+	return len(vc.timers)
+}
+
+/* the method returns the number of go routines blocked on the clock now */
+func (vc *VirtualClock) Blocked() int {
+	vc.lock.Lock()
+	defer vc.lock.Unlock()
+
+	return vc.blocked
+}
+
+/* the method sets the clock of the broker, it should be called before the Broker_start. The nil means the real time. */
+func (b *Broker) Broker_set_clock(clock Clock) {
+	if clock == nil {
+		clock = real_clock{}
+	}
+	b.clock = clock
+}
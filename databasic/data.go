@@ -1,34 +1,60 @@
 package databasic
 
 import (
+	"container/list"
 	"context"
+	"sync"
 	"time"
 )
 
+/*
+The dataclass holds the recent datanodes of a metric, e.g. the voltage of a device, which is a bounded cache.
+The newest datanode is held at the front of the Node_list, and the oldest ones are evicted while the number of
+datanodes is greater than the Node_max or they are older than the Window. The cache is updated by the Cache_put
+and read by the Cache_recent, so the recent values are served without the database. The dataclasses registered
+by the Cache_put are bounded by the max of the registry, the least recently used one is unregistered to make room
+for a new one. The cache only holds the values written by the process, so the Cache_put_seq compares the sequence
+of the value with the highest one cached, and the Cache_fresh serves the values only within the ttl of the last
+put, which bounds how long the values written by other processes are missed.
+*/
+const (
+	DEFAULT_CACHE_SIZE   int           = 100
+	DEFAULT_CACHE_WINDOW time.Duration = time.Hour
+)
+
 type DataClass struct {
 	List *ListNode /* it is a continer that is used to orgnize the parent type as a list */
 
 	Id string
 
-	Node_list *ListNode /* it is a list holding the datanode, which is processed by some method */
-	Node_num  int       /* the value records the numeber of Node_list holding. */
-	Node_max  int       /* the memeber is unused */
+	broker *Broker /* the broker registering the dataclass */
+
+	Node_list *ListNode     /* it is a list holding the datanode, the newest one is at the front */
+	Node_num  int           /* the value records the numeber of Node_list holding. */
+	Node_max  int           /* the max number of datanodes held, the oldest one is evicted while it is exceeded */
+	Window    time.Duration /* the datanodes older than the window are evicted, the 0 means unlimited */
+
+	lock sync.RWMutex /* it protects the Node_list, Node_num, Node_max and Window, which are accessed by the processors */
+
+	element *list.Element /* the element in the recent list of the cache, it is protected by the cache_lock of the broker */
 }
 
-func DataClass_register(id string) *DataClass {
-	if id == "" || global_dataclass_num == MAX_DATACLASS_NUMBER {
+func (b *Broker) DataClass_register(id string) *DataClass {
+	if id == "" {
 		return nil
 	}
 	dataclass := new(DataClass)
 
 	dataclass.Id = id
+	dataclass.broker = b
 	dataclass.List = ListNode_create(dataclass)
 	dataclass.Node_list = ListNode_create(dataclass)
-	dataclass.Node_max = 100
+	dataclass.Node_max = DEFAULT_CACHE_SIZE
+	dataclass.Window = DEFAULT_CACHE_WINDOW
 	dataclass.Node_num = 0
 
-	/* add the dataclass to the global list */
-	ok := ListNode_insert_next(global_dataclass_entry, dataclass.List)
+	/* add the dataclass to the registry of the broker */
+	ok := b.dataclass_registry.add(id, dataclass)
 	if !ok {
 		dataclass.List.Parent = nil
 		dataclass.Node_list.Parent = nil
@@ -36,50 +62,89 @@ func DataClass_register(id string) *DataClass {
 		dataclass.Node_list = nil
 		return nil
 	}
-	global_dataclass_num++
 
 	return dataclass
 }
 
-func DataClass_find(id string) *DataClass {
-	listnode := global_dataclass_entry
-
-	if listnode.Next == listnode || listnode.Prev == listnode {
+func (b *Broker) DataClass_find(id string) *DataClass {
+	dataclass, ok := b.dataclass_registry.find(id)
+	if !ok {
 		return nil
 	}
+	return dataclass
+}
 
-	if id == "last" {
-		return listnode.Prev.Parent.(*DataClass)
-	} else if id == "first" {
-		return listnode.Next.Parent.(*DataClass)
-	}
+/* the function sets the max number of dataclass, the 0 means unlimited. */
+func (b *Broker) DataClass_set_max(max int) {
+	b.dataclass_registry.set_max(max)
+}
 
-	for i := 0; i < global_dataclass_num; i++ {
-		listnode = ListNode_index_node(listnode, 1)
-		parent := listnode.Parent.(*DataClass)
-		if parent.Id == id {
-			return parent
-		}
-	}
-	return nil
+func DataClass_register(id string) *DataClass {
+	return global_broker.DataClass_register(id)
+}
+
+func DataClass_find(id string) *DataClass {
+	return global_broker.DataClass_find(id)
+}
+
+func DataClass_set_max(max int) {
+	global_broker.DataClass_set_max(max)
 }
 
 func (dc *DataClass) DataClass_unregister(ctx context.Context) bool {
 
-	ok := ListNode_delete(dc.List)
+	ok := dc.broker.dataclass_registry.remove(dc.Id, dc)
 	if !ok {
 		return false
 	}
-	global_dataclass_num--
+	dc.broker.cache_forget(dc)
+
+	return true
+}
+
+/* the method sets the max number of datanodes and the window of the dataclass, the datanodes out of them are evicted. */
+func (dc *DataClass) DataClass_set_bound(max int, window time.Duration) bool {
+	if max < 1 || window < 0 {
+		return false
+	}
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	dc.Node_max = max
+	dc.Window = window
+	dc.dataclass_evict(time.Now())
 
 	return true
 }
 
+/* the method adds the datanode to the front of the dataclass as the newest one, and evicts the oldest ones. */
 func (dc *DataClass) DataClass_add(datanode *DataNode) bool {
 	if datanode == nil {
 		return false
 	}
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	return dc.dataclass_add(datanode)
+}
 
+/*
+the method is the same as the DataClass_add, but the datanodes are cleared at first if the Seq of the datanode is
+not greater than the highest one of the dataclass, e.g. the source is recreated, so the newest one is always first.
+The Seq 0 is unknown and never compared.
+*/
+func (dc *DataClass) dataclass_add_seq(datanode *DataNode) bool {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	if datanode.Seq > 0 && dc.Node_num > 0 && dc.Node_list.Next.Parent.(*DataNode).Seq >= datanode.Seq {
+		dc.dataclass_clear()
+	}
+	return dc.dataclass_add(datanode)
+}
+
+/* the method adds the datanode as the newest one, the dc lock must be held. */
+func (dc *DataClass) dataclass_add(datanode *DataNode) bool {
 	data_entry := dc.Node_list
 	listnode := datanode.List
 	ok := ListNode_insert_next(data_entry, listnode)
@@ -87,24 +152,85 @@ func (dc *DataClass) DataClass_add(datanode *DataNode) bool {
 		return false
 	}
 	dc.Node_num++
+	dc.dataclass_evict(time.Now())
+
 	return true
 }
 
+/* the method removes all the datanodes of the dataclass, e.g. while they are stale */
+func (dc *DataClass) DataClass_clear() {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	dc.dataclass_clear()
+}
+
+/* the method removes all the datanodes of the dataclass, the dc lock must be held. */
+func (dc *DataClass) dataclass_clear() {
+	for dc.Node_num > 0 {
+		ListNode_delete(dc.Node_list.Prev)
+		dc.Node_num--
+	}
+}
+
 func (dc *DataClass) DataClass_remove(datanode *DataNode) bool {
 
 	if datanode == nil {
 		return false
-	} else {
-		ok := ListNode_delete(datanode.List)
-		if !ok {
-			return false
+	}
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	ok := ListNode_delete(datanode.List)
+	if !ok {
+		return false
+	}
+	dc.Node_num--
+
+	return true
+}
+
+/* the method evicts the datanodes out of the Node_max and the Window from the back, the dc lock must be held. */
+func (dc *DataClass) dataclass_evict(now time.Time) {
+	for dc.Node_num > 0 {
+		oldest := dc.Node_list.Prev.Parent.(*DataNode)
+		if dc.Node_num <= dc.Node_max && !oldest.datanode_expired(dc.Window, now) {
+			return
 		}
+		ListNode_delete(oldest.List)
 		dc.Node_num--
 	}
-	return true
+}
+
+/* the method returns the newest datanode in the window, or nil if the dataclass holds nothing. */
+func (dc *DataClass) DataClass_latest() *DataNode {
+	recent := dc.DataClass_recent(1)
+	if len(recent) == 0 {
+		return nil
+	}
+	return recent[0]
+}
+
+/* the method returns at most num datanodes in the window, the newest one is the first. */
+func (dc *DataClass) DataClass_recent(num int) []*DataNode {
+	dc.lock.RLock()
+	defer dc.lock.RUnlock()
+
+	now := time.Now()
+	var recent []*DataNode
+	for listnode := dc.Node_list.Next; listnode != dc.Node_list && len(recent) < num; listnode = listnode.Next {
+		datanode := listnode.Parent.(*DataNode)
+		if datanode.datanode_expired(dc.Window, now) {
+			break
+		}
+		recent = append(recent, datanode)
+	}
+	return recent
 }
 
 func (dc *DataClass) DataClass_search(id string) *DataNode {
+	dc.lock.RLock()
+	defer dc.lock.RUnlock()
 
 	listnode := dc.Node_list
 
@@ -138,6 +264,8 @@ type DataNode struct {
 	Payload []byte /* the Payload pointer is used to point the actual data */
 
 	Timestamp time.Time /* Timestamp records the time instant which the DataNode hold the data at the time */
+
+	Seq int64 /* the sequence of the data in its source, e.g. the auto increment id of the row, 0 means unknown */
 }
 
 func DataNode_create(message interface{}, payload []byte, id string) *DataNode {
@@ -153,3 +281,156 @@ func DataNode_create(message interface{}, payload []byte, id string) *DataNode {
 	return datanode
 
 }
+
+func (dn *DataNode) datanode_expired(window time.Duration, now time.Time) bool {
+	return window > 0 && now.Sub(dn.Timestamp) > window
+}
+
+/*
+the function adds the message as the newest datanode of the dataclass named id, the dataclass is registered if
+it is not found. The least recently used dataclass of the cache is unregistered, if the registry is full. It
+returns nil, if the dataclass unable to register, e.g. the registry is full of the dataclasses not cached.
+*/
+func (b *Broker) Cache_put(id string, message interface{}, payload []byte) *DataNode {
+	return b.Cache_put_seq(id, 0, message, payload)
+}
+
+/*
+the function is the same as the Cache_put, and the seq is the sequence of the data in its source. The seq is compared
+with the highest one cached, the dataclass is cleared if it is not greater, and a gap of the sequences is kept, e.g.
+the rows written by other processes or the ids skipped by the source, which are bounded by the ttl of the Cache_fresh.
+*/
+func (b *Broker) Cache_put_seq(id string, seq int64, message interface{}, payload []byte) *DataNode {
+	dataclass := b.cache_dataclass(id)
+	if dataclass == nil {
+		return nil
+	}
+	datanode := DataNode_create(message, payload, id)
+	datanode.Seq = seq
+	dataclass.dataclass_add_seq(datanode)
+
+	return datanode
+}
+
+/*
+the function returns the num newest datanodes of the dataclass named id, the newest one is the first. It returns
+false, if the dataclass holds less than num datanodes in the window, so the caller should read the source of the data.
+*/
+func (b *Broker) Cache_recent(id string, num int) ([]*DataNode, bool) {
+	dataclass := b.DataClass_find(id)
+	if dataclass == nil || num < 1 {
+		return nil, false
+	}
+	b.cache_touch(dataclass)
+	recent := dataclass.DataClass_recent(num)
+	if len(recent) < num {
+		return nil, false
+	}
+	return recent, true
+}
+
+/*
+the function is the same as the Cache_recent, but the datanodes are returned only if the newest one is put within
+the ttl, the 0 means never expired. Otherwise the cache may miss the data written by other processes since the last
+put, and the dataclass is cleared as stale, so the source is read without the database round trip for each hit.
+*/
+func (b *Broker) Cache_fresh(id string, num int, ttl time.Duration) ([]*DataNode, bool) {
+	recent, ok := b.Cache_recent(id, num)
+	if !ok {
+		return nil, false
+	}
+	if recent[0].datanode_expired(ttl, time.Now()) {
+		b.Cache_invalidate(id)
+		return nil, false
+	}
+	return recent, true
+}
+
+/* the function clears the datanodes of the dataclass named id, e.g. while the source is changed by other processes */
+func (b *Broker) Cache_invalidate(id string) {
+	dataclass := b.DataClass_find(id)
+	if dataclass != nil {
+		dataclass.DataClass_clear()
+	}
+}
+
+/* the function returns the dataclass named id for the cache, which is registered if it is not found */
+func (b *Broker) cache_dataclass(id string) *DataClass {
+	for {
+		dataclass := b.DataClass_find(id)
+		if dataclass == nil {
+			dataclass = b.DataClass_register(id)
+		}
+		if dataclass == nil {
+			/* the dataclass is registered by another processor at the same time */
+			dataclass = b.DataClass_find(id)
+		}
+		if dataclass != nil {
+			b.cache_touch(dataclass)
+			return dataclass
+		}
+		/* the registry is full, the least recently used dataclass is unregistered to make room */
+		if !b.cache_evict() {
+			return nil
+		}
+	}
+}
+
+/* the function moves the dataclass to the front of the recent list, it is added if it is not in the list */
+func (b *Broker) cache_touch(dataclass *DataClass) {
+	b.cache_lock.Lock()
+	defer b.cache_lock.Unlock()
+
+	if dataclass.element != nil {
+		b.cache_recent.MoveToFront(dataclass.element)
+		return
+	}
+	dataclass.element = b.cache_recent.PushFront(dataclass)
+}
+
+/* the function unregisters the least recently used dataclass, it returns false if the cache holds nothing */
+func (b *Broker) cache_evict() bool {
+	b.cache_lock.Lock()
+	element := b.cache_recent.Back()
+	b.cache_lock.Unlock()
+	if element == nil {
+		return false
+	}
+	dataclass := element.Value.(*DataClass)
+	if !dataclass.DataClass_unregister(context.Background()) {
+		/* the dataclass is unregistered already, it is only removed from the list */
+		b.cache_forget(dataclass)
+	}
+	return true
+}
+
+/* the function removes the dataclass from the recent list */
+func (b *Broker) cache_forget(dataclass *DataClass) {
+	b.cache_lock.Lock()
+	defer b.cache_lock.Unlock()
+
+	if dataclass.element != nil {
+		b.cache_recent.Remove(dataclass.element)
+		dataclass.element = nil
+	}
+}
+
+func Cache_put(id string, message interface{}, payload []byte) *DataNode {
+	return global_broker.Cache_put(id, message, payload)
+}
+
+func Cache_put_seq(id string, seq int64, message interface{}, payload []byte) *DataNode {
+	return global_broker.Cache_put_seq(id, seq, message, payload)
+}
+
+func Cache_recent(id string, num int) ([]*DataNode, bool) {
+	return global_broker.Cache_recent(id, num)
+}
+
+func Cache_fresh(id string, num int, ttl time.Duration) ([]*DataNode, bool) {
+	return global_broker.Cache_fresh(id, num, ttl)
+}
+
+func Cache_invalidate(id string) {
+	global_broker.Cache_invalidate(id)
+}
@@ -1,67 +1,1898 @@
 package databasic
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestBroker(t *testing.T) {
-	All_Init()
-	Broker()
-
-	ProceNode_register(func(tasknode *TaskNode, rawnode *RawNode) bool {
-		fmt.Printf("tasknode:%s, rawnode:%s\n\r", tasknode.Id, rawnode.Id)
-		fmt.Printf("data:%s\n\r", rawnode.Raw.(string))
-		return true
-	}, "test001")
-
-	ProceNode_register(func(tasknode *TaskNode, rawnode *RawNode) bool {
-		fmt.Printf("tasknode:%s, rawnode:%s\n\r", tasknode.Id, rawnode.Id)
-		fmt.Printf("data:%s\n\r", rawnode.Raw.(string))
-		return true
-	}, "test002")
-	ProceNode_register(func(tasknode *TaskNode, rawnode *RawNode) bool {
-		fmt.Printf("tasknode:%s, rawnode:%s\n\r", tasknode.Id, rawnode.Id)
-		fmt.Printf("data:%s\n\r", rawnode.Raw.(string))
-		return true
-	}, "test003")
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
 
-	go func() {
-		for i := 0; i < 60; i++ {
-			data := fmt.Sprintf("rawnode data %d", i)
-			rawnode := RawNode_create("test001", data)
-			Send_raw(rawnode)
-			if i == 59 {
-				i = 0
+	for _, id := range []string{"test001", "test002", "test003"} {
+		harness.Harness_register(func(tasknode *TaskNode, rawnode *RawNode) bool {
+			return true
+		}, id)
+	}
+
+	// the rawnodes of the three routes are interleaved, each procenode receives its own rawnodes in order
+	var want []interface{}
+	for i := 0; i < 60; i++ {
+		data := fmt.Sprintf("rawnode data %d", i)
+		want = append(want, data)
+		for _, id := range []string{"test001", "test002", "test003"} {
+			if !harness.Harness_send(RawNode_create(id, data)) {
+				harness.Harness_drain()
+				harness.Harness_send(RawNode_create(id, data))
 			}
 		}
-	}()
+	}
+	harness.Harness_drain()
 
-	go func() {
-		for i := 0; i < 60; i++ {
-			data := fmt.Sprintf("rawnode data %d", i)
-			rawnode := RawNode_create("test002", data)
-			Send_raw(rawnode)
-			if i == 59 {
-				i = 0
+	for _, id := range []string{"test001", "test002", "test003"} {
+		if got := harness.Recorder.Recorder_raws(id); !reflect.DeepEqual(got, want) {
+			t.Errorf("the procenode %s received %d rawnodes %v, want %d in order", id, len(got), got, len(want))
+		}
+	}
+}
+
+func TestBrokerWakeup(t *testing.T) {
+	broker := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	broker.Broker_start(context.Background())
+	defer broker.Shutdown(context.Background())
+
+	received := make(chan interface{}, 10)
+	broker.ProceNode_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		received <- rawnode.Raw
+		return nil
+	}, "wakeup")
+	receive := func(want interface{}) {
+		select {
+		case raw := <-received:
+			if raw != want {
+				t.Errorf("the procenode received %v, want %v", raw, want)
 			}
+		case <-time.After(time.Second):
+			t.Fatalf("the rawnode %v is not dispatched", want)
+		}
+	}
+	quiet := func() {
+		select {
+		case raw := <-received:
+			t.Fatalf("the procenode received %v while the task is paused", raw)
+		case <-time.After(20 * time.Millisecond):
 		}
+	}
 
-	}()
+	// the first rawnode creates the task, and the scheduler is waked up to run it
+	broker.Send_raw(RawNode_create("wakeup", 0))
+	receive(0)
+
+	// the idle task is blocked on its buffer by one go routine, which is waked up by the next rawnode
+	time.Sleep(20 * time.Millisecond)
+	tasknode := broker.TaskNode_find("wakeup")
+	if workers := atomic.LoadInt64(&tasknode.Stat_workers); workers != 1 {
+		t.Errorf("the idle task has %d go routines, want 1", workers)
+	}
+	broker.Send_raw(RawNode_create("wakeup", 1))
+	receive(1)
+
+	// the go routine blocked on the buffer replaced by the resizing receives from the new one
+	if err := tasknode.TaskNode_resize(10); err != nil {
+		t.Fatalf("the task unable to resize: %s", err)
+	}
+	broker.Send_raw(RawNode_create("wakeup", 2))
+	receive(2)
+
+	// the paused task keeps the rawnode, until it is waked up by the resuming
+	tasknode.TaskNode_pause()
+	broker.Send_raw(RawNode_create("wakeup", 3))
+	quiet()
+	tasknode.TaskNode_resume()
+	receive(3)
+}
+
+func TestWorkerPool(t *testing.T) {
+	broker := Broker_create(MAX_RAWNODE_NUMBER, 0)
+	broker.Broker_start(context.Background())
+	defer broker.Shutdown(context.Background())
+
+	// the callings of a key never run beside each other, and the callings of different keys run in parallel
+	var lock sync.Mutex
+	active := make(map[string]int)
+	got := make(map[string][]interface{})
+	max_parallel := 0
+	done := make(chan struct{}, 200)
+	procenode := broker.ProceNode_register_pool(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		lock.Lock()
+		active[rawnode.Key]++
+		if active[rawnode.Key] > 1 {
+			t.Errorf("the key %s is processed by %d callings at the same time", rawnode.Key, active[rawnode.Key])
+		}
+		if len(active) > max_parallel {
+			max_parallel = len(active)
+		}
+		lock.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		lock.Lock()
+		got[rawnode.Key] = append(got[rawnode.Key], rawnode.Raw)
+		if active[rawnode.Key]--; active[rawnode.Key] == 0 {
+			delete(active, rawnode.Key)
+		}
+		lock.Unlock()
+		done <- struct{}{}
+		return nil
+	}, "pool", 4, nil)
+	procenode.ProceNode_set_overflow(DEFAULT_OVERFLOW_POLICY, 200)
+
+	keys := []string{"dev0", "dev1", "dev2", "dev3", "dev4", "dev5", "dev6", "dev7"}
+	for i := 0; i < 20; i++ {
+		for _, key := range keys {
+			broker.Send_raw(RawNode_create_key("pool", key, i))
+		}
+	}
+	for i := 0; i < 20*len(keys); i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d rawnodes are processed", i)
+		}
+	}
+
+	var want []interface{}
+	for i := 0; i < 20; i++ {
+		want = append(want, i)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	for _, key := range keys {
+		if !reflect.DeepEqual(got[key], want) {
+			t.Errorf("the key %s is processed in %v, want in order", key, got[key])
+		}
+	}
+	if max_parallel < 2 {
+		t.Errorf("at most %d keys are processed at the same time, want parallel", max_parallel)
+	}
+	if workers := atomic.LoadInt64(&broker.TaskNode_find("pool").Stat_workers); workers != 4 {
+		t.Errorf("the task has %d worker go routines, want 4", workers)
+	}
+}
+
+func TestRegistryLifecycle(t *testing.T) {
+	broker := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	broker.Broker_start(context.Background())
+	defer broker.Shutdown(context.Background())
+
+	received := make(chan string, 10)
+	register := func() *ProceNode {
+		return broker.ProceNode_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+			received <- tasknode.Id
+			return nil
+		}, "life")
+	}
+	process := func() *TaskNode {
+		broker.Send_raw(RawNode_create("life", nil))
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("the rawnode is not processed")
+		}
+		return broker.TaskNode_find("life")
+	}
+	stopped := func(tasknode *TaskNode) {
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt64(&tasknode.Stat_workers) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("the go routine of the unregistered task %s is not stopped", tasknode.Id)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// the go routine of the task is stopped while it is unregistered, and the next rawnode creates a new task
+	procenode := register()
+	first := process()
+	if !first.TaskNode_unregister() {
+		t.Fatalf("the task unable to unregister")
+	}
+	stopped(first)
+	second := process()
+	if second == nil || second == first {
+		t.Fatalf("the task is not created again after unregistering")
+	}
+	// the stale task never removes the new one of the same id
+	if first.TaskNode_unregister() || broker.TaskNode_find("life") != second {
+		t.Errorf("the stale task removes the new one")
+	}
+
+	// the tasks of the procenode are unregistered with it, and the id can be registered again
+	if !procenode.ProceNode_unregister(context.Background()) || broker.ProceNode_find("life") != nil {
+		t.Fatalf("the procenode unable to unregister")
+	}
+	stopped(second)
+	if broker.TaskNode_find("life") != nil {
+		t.Errorf("the task of the unregistered procenode is still registered")
+	}
+	if register() == nil || process() == nil {
+		t.Fatalf("the procenode is not registered again")
+	}
+
+	// the registry is limited by the max, the registered ones are kept while the max is decreased
+	broker.ProceNode_set_max(1)
+	if broker.ProceNode_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error { return nil }, "full") != nil {
+		t.Errorf("the procenode is registered over the max")
+	}
+	broker.ProceNode_set_max(0)
+
+	// the procenodes are registered, found and unregistered concurrently while the broker is running
+	var group sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		group.Add(1)
+		go func(id string) {
+			defer group.Done()
+			procenode := broker.ProceNode_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+				return nil
+			}, id)
+			if procenode == nil || broker.ProceNode_find(id) != procenode {
+				t.Errorf("the procenode %s is not registered", id)
+				return
+			}
+			broker.Send_raw(RawNode_create(id, nil))
+			if !procenode.ProceNode_unregister(context.Background()) {
+				t.Errorf("the procenode %s unable to unregister", id)
+			}
+		}(fmt.Sprintf("concurrent%d", i))
+	}
+	group.Wait()
+	if procenodes := len(broker.procenode_registry.list()); procenodes != 1 {
+		t.Errorf("the registry holds %d procenodes, want 1", procenodes)
+	}
+}
+
+func TestHarnessRetry(t *testing.T) {
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+
+	failures := 2
+	procenode := harness.Harness_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		if failures > 0 {
+			failures--
+			return errors.New("temporary")
+		}
+		return nil
+	}, "flaky")
+	procenode.ProceNode_set_retry(RetryPolicy{Max_attempts: 3, Backoff: time.Second, Multiplier: 2, Max_backoff: time.Minute})
+
+	harness.Harness_send(RawNode_create("flaky", "data"))
+	harness.Harness_drain()
+
+	records := harness.Recorder.Recorder_records()
+	if len(records) != 3 || records[2].Err != nil || records[2].Attempt != 3 {
+		t.Fatalf("the records are %+v, want 2 failures and a success", records)
+	}
+	// the backoff is 1s and 2s in the virtual clock
+	if elapsed := records[2].Time.Sub(records[0].Time); elapsed != 3*time.Second {
+		t.Errorf("the retries take %s, want 3s", elapsed)
+	}
+}
+
+func TestVirtualClock(t *testing.T) {
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	start := harness.Clock.Now()
+
+	// the timer created but not waited never moves the clock
+	harness.harness_run(func() {
+		harness.Clock.Timer(time.Minute)
+	})
+	if now := harness.Clock.Now(); !now.Equal(start) || harness.Clock.Pending() != 1 {
+		t.Errorf("the clock is moved to %s with %d timers pending, want %s and 1", now, harness.Clock.Pending(), start)
+	}
+
+	// the clock is advanced to the earliest timer while the operation is blocked on it
+	harness.harness_run(func() {
+		timer, stop := harness.Clock.Timer(time.Second)
+		defer stop()
+		unblock := clock_block(harness.Clock)
+		defer unblock()
+		<-timer
+	})
+	if elapsed := harness.Clock.Now().Sub(start); elapsed != time.Second {
+		t.Errorf("the clock is advanced %s, want 1s", elapsed)
+	}
+	if blocked := harness.Clock.Blocked(); blocked != 0 {
+		t.Errorf("the clock has %d go routines blocked after the operation, want 0", blocked)
+	}
+}
+
+func TestHarnessOverflow(t *testing.T) {
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+
+	procenode := harness.Harness_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		return nil
+	}, "small")
+	procenode.ProceNode_set_overflow(OverflowPolicy{Mode: OVERFLOW_DROP_OLDEST}, 2)
+
+	// the task is not stepped before the raw channel is empty, so the older rawnodes are dropped
+	var admitted []error
+	for i := 0; i < 5; i++ {
+		rawnode := RawNode_create("small", i)
+		rawnode.Admit = func(rawnode *RawNode, err error) {
+			admitted = append(admitted, err)
+		}
+		harness.Harness_send(rawnode)
+	}
+	harness.Harness_drain()
+
+	// each rawnode is admitted once while it is pushed, the dropped ones are not admitted again
+	if !reflect.DeepEqual(admitted, []error{nil, nil, nil, nil, nil}) {
+		t.Errorf("the rawnodes are admitted with %v, want five nil", admitted)
+	}
+
+	if got := harness.Recorder.Recorder_raws("small"); !reflect.DeepEqual(got, []interface{}{3, 4}) {
+		t.Errorf("the procenode received %v, want [3 4]", got)
+	}
+	if dropped := harness.Broker.TaskNode_find("small").Stat_dropped; dropped != 3 {
+		t.Errorf("the task dropped %d rawnodes, want 3", dropped)
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	// the broker is not started, so the rawnodes are kept in the buffer until they are fetched
+	broker := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	procenode := broker.ProceNode_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		return nil
+	}, "block")
+	procenode.ProceNode_set_overflow(OverflowPolicy{Mode: OVERFLOW_BLOCK, Timeout: time.Minute}, 1)
+	tasknode := TaskNode_register("block", procenode, DEFAULT_TIMEPEICE)
+	if err := tasknode.TaskNode_offer(RawNode_create("block", 0)); err != nil {
+		t.Fatalf("the rawnode is not offered to the empty buffer: %s", err)
+	}
+
+	offered := make(chan error, 4)
+	offer := func(raw int) {
+		go func() {
+			offered <- tasknode.TaskNode_offer(RawNode_create("block", raw))
+		}()
+	}
+	expect := func(num int, want error) {
+		for i := 0; i < num; i++ {
+			select {
+			case err := <-offered:
+				if !errors.Is(err, want) {
+					t.Errorf("the blocked offering returns %v, want %v", err, want)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("the blocked offering is not waked up")
+			}
+		}
+	}
+	blocked := func() {
+		select {
+		case err := <-offered:
+			t.Fatalf("the offering returns %v while the buffer is full", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	// both of the offerings blocked are waked up by the resizing, though the signals are merged
+	offer(1)
+	offer(2)
+	blocked()
+	if err := tasknode.TaskNode_resize(3); err != nil {
+		t.Fatalf("the task unable to resize: %s", err)
+	}
+	expect(2, nil)
+
+	// the offering blocked is waked up by the rawnode fetched
+	offer(3)
+	blocked()
+	if tasknode.TaskNode_Fetch() == nil {
+		t.Fatalf("no rawnode is fetched from the full buffer")
+	}
+	expect(1, nil)
+
+	// the offering blocked is dropped after the timeout, or while the task is canceled
+	tasknode.TaskNode_set_overflow(OverflowPolicy{Mode: OVERFLOW_BLOCK, Timeout: 20 * time.Millisecond})
+	offer(4)
+	expect(1, ErrOverflowDropped)
+	tasknode.TaskNode_set_overflow(OverflowPolicy{Mode: OVERFLOW_BLOCK, Timeout: time.Minute})
+	offer(5)
+	blocked()
+	tasknode.TaskNode_unregister()
+	expect(1, ErrOverflowDropped)
+	if dropped := atomic.LoadInt64(&tasknode.Stat_dropped); dropped != 2 {
+		t.Errorf("the task dropped %d rawnodes, want 2", dropped)
+	}
+}
+
+func TestSpillRecord(t *testing.T) {
+	spill, err := spill_open(t.TempDir())
+	if err != nil {
+		t.Fatalf("the spill is not opened: %v", err)
+	}
+
+	// the copy fanned out keeps its task after reloading, so it is not routed to every subscriber again
+	rawnode := rawnode_copy(RawNode_create_key("aliyun.pk001.dev001.property", "dev001", 1), "rules")
+	rawnode.Attempts = 2
+	if err := spill.write(rawnode); err != nil {
+		t.Fatalf("the rawnode is not spilled: %v", err)
+	}
+	reloaded, err := spill.read(spill.files[0])
+	if err != nil {
+		t.Fatalf("the rawnode is not reloaded: %v", err)
+	}
+	if reloaded.Id != rawnode.Id || reloaded.Key != "dev001" || reloaded.Raw != 1 || reloaded.Attempts != 2 || reloaded.task != "rules" {
+		t.Errorf("the reloaded rawnode is %+v, want the task rules", reloaded)
+	}
+}
+
+func TestProcessorAdapt(t *testing.T) {
+	legacy := func(tasknode *TaskNode, rawnode *RawNode) bool {
+		return false
+	}
+	processor, err := processor_adapt(legacy)
+	if err != nil {
+		t.Fatalf("the legacy operation is rejected: %s", err)
+	}
+	if err := processor.Process(context.Background(), nil, RawNode_create("test", nil)); !errors.Is(err, ErrProcessFailed) {
+		t.Errorf("the legacy operation return %v, want ErrProcessFailed", err)
+	}
+
+	// the operation with wrong signature is rejected while registering
+	if _, err := processor_adapt(func(rawnode *RawNode) {}); err == nil {
+		t.Errorf("the operation with wrong signature is accepted")
+	}
+
+	typed := TypedProcessor(func(ctx context.Context, tasknode *TaskNode, payload string) error {
+		if payload != "data" {
+			return fmt.Errorf("the payload is %s", payload)
+		}
+		return nil
+	})
+	if err := typed.Process(context.Background(), nil, RawNode_create("test", "data")); err != nil {
+		t.Errorf("the typed processor return %v", err)
+	}
+	if err := typed.Process(context.Background(), nil, RawNode_create("test", 1)); !errors.Is(err, ErrPayloadType) {
+		t.Errorf("the typed processor return %v, want ErrPayloadType", err)
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	broker := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	product := ProceNode{Id: "product"}
+	device := ProceNode{Id: "device"}
+	property := ProceNode{Id: "property"}
+	all := ProceNode{Id: "all"}
+	broker.Subscribe("aliyun.#", &all)
+	broker.Subscribe("aliyun.pk001.#", &product)
+	broker.Subscribe("aliyun.pk001.dev001.#", &device)
+	broker.Subscribe("aliyun.*.*.property", &property)
+
+	// the most specific pattern wins, the literal word is more specific than the wildcards
+	routes := map[string]*ProceNode{
+		"aliyun":                         &all,
+		"aliyun.pk002.dev001.status":     &all,
+		"aliyun.pk002.dev001.property":   &property,
+		"aliyun.pk001.dev002.property":   &product,
+		"aliyun.pk001.dev001.property":   &device,
+		"aliyun.pk001.dev001.status.ext": &device,
+	}
+	for route, want := range routes {
+		subscribers := broker.route_subscribers(route)
+		if len(subscribers) != 1 || subscribers[0] != want {
+			t.Errorf("the route %s is subscribed by %v, want %s", route, subscribers, want.Id)
+		}
+	}
+	if subscribers := broker.route_subscribers("http.voltage"); len(subscribers) != 0 {
+		t.Errorf("the route http.voltage is subscribed by %v", subscribers)
+	}
+
+	// the subscriptions are changed, the cached routes are matched again
+	broker.Unsubscribe("aliyun.pk001.dev001.#", &device)
+	if subscribers := broker.route_subscribers("aliyun.pk001.dev001.property"); len(subscribers) != 1 || subscribers[0] != &product {
+		t.Errorf("the unsubscribed pattern still matches %v", subscribers)
+	}
+}
+
+func TestRouteFanout(t *testing.T) {
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	operation := func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		return nil
+	}
+	storage := harness.Harness_register(operation, "storage")
+	rules := harness.Harness_register(operation, "rules")
+	rules.ProceNode_set_overflow(OverflowPolicy{Mode: OVERFLOW_REJECT}, 1)
+	harness.Broker.Subscribe("aliyun.#", storage)
+	harness.Broker.Subscribe("aliyun.pk001.#", storage)
+	harness.Broker.Subscribe("aliyun.pk001.#", rules)
+
+	var admitted []error
+	send := func(route string, raw interface{}) {
+		rawnode := RawNode_create(route, raw)
+		rawnode.Admit = func(rawnode *RawNode, err error) {
+			admitted = append(admitted, err)
+		}
+		harness.Harness_send(rawnode)
+	}
+
+	// both subscribers of the most specific pattern receive the rawnodes of pk001, only the storage receives pk002
+	send("aliyun.pk001.dev001.property", 1)
+	send("aliyun.pk001.dev001.property", 2)
+	send("aliyun.pk002.dev001.property", 3)
+	harness.Harness_drain()
+	if got := harness.Recorder.Recorder_raws("storage"); !reflect.DeepEqual(got, []interface{}{1, 2, 3}) {
+		t.Errorf("the storage received %v, want [1 2 3]", got)
+	}
+	// the copy rejected by the full buffer of the rules is parked, and the source is admitted without duplicating the storage
+	if got := harness.Recorder.Recorder_raws("rules"); !reflect.DeepEqual(got, []interface{}{1}) {
+		t.Errorf("the rules received %v, want [1]", got)
+	}
+	if !reflect.DeepEqual(admitted, []error{nil, nil, nil}) {
+		t.Errorf("the sources are admitted with %v, want all nil", admitted)
+	}
+	letters := harness.Broker.DeadLetter_store().DeadLetterStore_list()
+	if len(letters) != 1 || letters[0].Task != "rules" || !strings.Contains(letters[0].Reason, ErrOverflowRejected.Error()) {
+		t.Fatalf("the dead letters are %+v, want the copy of the rules", letters)
+	}
+
+	// the copy parked is re-driven to the rules only
+	if redriven := harness.Broker.DeadLetter_redrive(nil); redriven != 1 {
+		t.Fatalf("the dead letter re-drives %d rawnodes, want 1", redriven)
+	}
+	harness.Harness_drain()
+	if got := harness.Recorder.Recorder_raws("rules"); !reflect.DeepEqual(got, []interface{}{1, 2}) {
+		t.Errorf("the rules received %v after re-driving, want [1 2]", got)
+	}
+	if got := harness.Recorder.Recorder_raws("storage"); !reflect.DeepEqual(got, []interface{}{1, 2, 3}) {
+		t.Errorf("the storage received %v after re-driving, want [1 2 3]", got)
+	}
+
+	// the source is rejected, while every copy is rejected
+	storage.ProceNode_set_overflow(OverflowPolicy{Mode: OVERFLOW_REJECT}, 1)
+	harness.Broker.TaskNode_find("storage").TaskNode_unregister()
+	admitted = nil
+	send("aliyun.pk001.dev001.property", 4)
+	send("aliyun.pk001.dev001.property", 5)
+	harness.Harness_drain()
+	if len(admitted) != 2 || admitted[0] != nil || !errors.Is(admitted[1], ErrOverflowRejected) {
+		t.Errorf("the sources are admitted with %v, want nil and ErrOverflowRejected", admitted)
+	}
+	if parked := len(harness.Broker.DeadLetter_list()); parked != 0 {
+		t.Errorf("the dead letter holds %d rawnodes, want none", parked)
+	}
+}
+
+func TestBrokerIsolated(t *testing.T) {
+	ingestion := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	query := Broker_create(MAX_RAWNODE_NUMBER, 1)
+	ingestion.Broker_start(context.Background())
+	query.Broker_start(context.Background())
+
+	// the procenodes of the same id are registered in both brokers, each of them only receives its own rawnodes
+	received := make(map[*Broker]chan string)
+	for _, broker := range []*Broker{ingestion, query} {
+		channel := make(chan string, 10)
+		received[broker] = channel
+		if broker.ProceNode_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+			channel <- rawnode.Raw.(string)
+			return nil
+		}, "test") == nil {
+			t.Fatalf("the procenode unable to register")
+		}
+	}
+	ingestion.Send_raw(RawNode_create("test", "ingestion"))
+	query.Send_raw(RawNode_create("test", "query"))
+
+	for broker, want := range map[*Broker]string{ingestion: "ingestion", query: "query"} {
+		if _, err := broker.Shutdown(context.Background()); err != nil {
+			t.Fatalf("the broker unable to shut down: %s", err)
+		}
+		close(received[broker])
+		var got []string
+		for raw := range received[broker] {
+			got = append(got, raw)
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("the broker received %v, want [%s]", got, want)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	broker := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	broker.DataClass_set_max(2)
+
+	// the least recently used dataclass is unregistered to make room for the new one
+	broker.Cache_put("a", 1, nil)
+	broker.Cache_put("b", 2, nil)
+	broker.Cache_recent("a", 1)
+	if broker.Cache_put("c", 3, nil) == nil {
+		t.Fatalf("the value is not cached while the registry is full")
+	}
+	if broker.DataClass_find("b") != nil || broker.DataClass_find("a") == nil || broker.DataClass_find("c") == nil {
+		t.Errorf("the dataclass b is not evicted as the least recently used one")
+	}
+
+	broker.DataClass_set_max(0)
+
+	// the datanodes are bounded by the max of the dataclass
+	broker.DataClass_find("a").DataClass_set_bound(2, 0)
+	broker.Cache_put("a", 5, nil)
+	broker.Cache_put("a", 6, nil)
+	if _, ok := broker.Cache_recent("a", 3); ok {
+		t.Errorf("the dataclass holds more datanodes than the max")
+	}
+	if recent, ok := broker.Cache_recent("a", 2); !ok || recent[0].Message != 6 || recent[1].Message != 5 {
+		t.Errorf("the recent datanodes are %v, want 6 and 5", recent)
+	}
+
+	// the cache is served within the ttl, and a gap of the sequences is kept
+	for _, seq := range []int64{1, 2, 4} {
+		broker.Cache_put_seq("seq", seq, seq, nil)
+	}
+	if recent, ok := broker.Cache_fresh("seq", 3, time.Minute); !ok || recent[0].Seq != 4 || recent[1].Seq != 2 || recent[2].Seq != 1 {
+		t.Errorf("the fresh datanodes are %v, want the sequences 4, 2 and 1", recent)
+	}
+	broker.DataClass_find("seq").DataClass_latest().Timestamp = time.Now().Add(-2 * time.Minute)
+	if _, ok := broker.Cache_fresh("seq", 1, time.Minute); ok {
+		t.Errorf("the cache is served after the ttl")
+	}
+	if _, ok := broker.Cache_recent("seq", 1); ok {
+		t.Errorf("the stale dataclass is not cleared")
+	}
+
+	// the sequence not greater than the highest one cached clears the dataclass, e.g. the source is recreated
+	broker.Cache_put_seq("seq", 5, 5, nil)
+	broker.Cache_put_seq("seq", 6, 6, nil)
+	broker.Cache_put_seq("seq", 1, 1, nil)
+	if recent, ok := broker.Cache_fresh("seq", 1, time.Minute); !ok || recent[0].Seq != 1 {
+		t.Errorf("the fresh datanodes are %v, want the sequence 1", recent)
+	}
+	if _, ok := broker.Cache_recent("seq", 2); ok {
+		t.Errorf("the datanodes of the old source are not cleared")
+	}
+
+	// the dataclass registered by the user is never evicted by the cache
+	broker.DataClass_register("user")
+	broker.DataClass_set_max(1)
+	if broker.Cache_put("d", 4, nil) != nil || broker.DataClass_find("user") == nil {
+		t.Errorf("the cache evicts the dataclass of the user")
+	}
+	if broker.DataClass_find("a") != nil || broker.DataClass_find("seq") != nil {
+		t.Errorf("the dataclasses of the cache are not evicted to make room")
+	}
+}
+
+func TestShutdownReport(t *testing.T) {
+	broker := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	if err := broker.WAL_open(t.TempDir(), false, "logged"); err != nil {
+		t.Fatalf("the wal unable to open: %s", err)
+	}
+	defer broker.WAL_close()
+	broker.Broker_start(context.Background())
+
+	release := make(chan struct{})
+	for _, id := range []string{"logged", "plain", "call"} {
+		broker.ProceNode_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+			<-release
+			return nil
+		}, id)
+	}
+	defer close(release)
+	admitted := make(chan error, 6)
+	for _, id := range []string{"logged", "plain"} {
+		for i := 0; i < 3; i++ {
+			rawnode := RawNode_create(id, i)
+			rawnode.Admit = func(rawnode *RawNode, err error) {
+				admitted <- err
+			}
+			broker.Send_raw(rawnode)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		if err := <-admitted; err != nil {
+			t.Fatalf("the rawnode is admitted with %s", err)
+		}
+	}
+	calls := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := broker.Call(context.Background(), "call", 1)
+			calls <- err
+		}()
+	}
+	for broker.TaskNode_find("call") == nil || atomic.LoadInt64(&broker.TaskNode_find("call").Stat_pending) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the rawnode parked before the shutdown is not counted in the report
+	broker.DeadLetter_park(RawNode_create("parked", 0))
+
+	// the first rawnode of each task is in processing, the others are left in the buffers
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report, err := broker.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("the shutdown returns %v, want DeadlineExceeded", err)
+	}
+	if report.Total() != 8 || report.Logged != 2 || report.Parked != 0 {
+		t.Errorf("the report holds %d undelivered, %d logged and %d parked, want 8, 2 and 0", report.Total(), report.Logged, report.Parked)
+	}
+	// only the rawnodes admitted but not logged are returned to be persisted by the caller
+	var raws []interface{}
+	for _, rawnode := range report.Rawnodes {
+		if rawnode.Id != "plain" || !errors.Is(rawnode.Failure, ErrBrokerClosed) {
+			t.Errorf("the report returns the rawnode %s failed with %v", rawnode.Id, rawnode.Failure)
+		}
+		raws = append(raws, rawnode.Raw)
+	}
+	if !reflect.DeepEqual(raws, []interface{}{1, 2}) {
+		t.Errorf("the report returns %v, want [1 2]", raws)
+	}
+	if err := <-calls; !errors.Is(err, ErrBrokerClosed) {
+		t.Errorf("the call left in the buffer returns %v, want ErrBrokerClosed", err)
+	}
+}
+
+func TestBrokerSnapshot(t *testing.T) {
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	procenode := harness.Harness_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		if rawnode.Raw == "bad" {
+			return errors.New("the bad rawnode")
+		}
+		return nil
+	}, "snap")
+	procenode.ProceNode_set_priority(PRIORITY_INTERACTIVE, 2)
+	procenode.ProceNode_set_overflow(OverflowPolicy{Mode: OVERFLOW_REJECT}, 5)
+	harness.Broker.Subscribe("snap.#", procenode)
+
+	for _, raw := range []string{"good", "bad", "good"} {
+		harness.Harness_send(RawNode_create("snap.device", raw))
+	}
+	harness.Harness_drain()
+	harness.Harness_send(RawNode_create("snap.device", "left"))
+
+	snapshot := harness.Broker.Broker_snapshot()
+	if snapshot.Closed || snapshot.Raw_length != 1 || snapshot.Raw_capacity != MAX_RAWNODE_NUMBER {
+		t.Errorf("the raw channel is %d/%d closed %t, want 1/%d open", snapshot.Raw_length, snapshot.Raw_capacity, snapshot.Closed, MAX_RAWNODE_NUMBER)
+	}
+	if snapshot.Tasks_created != 1 || snapshot.Running_max != DEFAULT_MAX_RUNNING || snapshot.Running != 0 {
+		t.Errorf("the snapshot counts %d tasks and %d/%d running, want 1 and 0/%d", snapshot.Tasks_created, snapshot.Running, snapshot.Running_max, DEFAULT_MAX_RUNNING)
+	}
+
+	want_procenode := ProceNodeSnapshot{Id: "snap", Concurrency: 1, Version: 1, Priority: PRIORITY_INTERACTIVE, Weight: 2,
+		Overflow: OVERFLOW_REJECT, Buffer_size: 5, Subscriptions: []string{"snap.#"}, Tasknodes: []string{"snap"}}
+	if len(snapshot.Procenodes) != 1 || !reflect.DeepEqual(snapshot.Procenodes[0], want_procenode) {
+		t.Errorf("the procenodes are %+v, want %+v", snapshot.Procenodes, want_procenode)
+	}
+
+	if len(snapshot.Tasknodes) != 1 {
+		t.Fatalf("the snapshot has %d tasknodes, want 1", len(snapshot.Tasknodes))
+	}
+	tasknode := snapshot.Tasknodes[0]
+	if tasknode.Id != "snap" || tasknode.Procenode != "snap" || tasknode.State != TASK_STATE_UNSCHEDULED {
+		t.Errorf("the tasknode is %s of %s in %s, want snap of snap unscheduled", tasknode.Id, tasknode.Procenode, tasknode.State)
+	}
+	if tasknode.Processed != 2 || tasknode.Failed != 1 || tasknode.Callings != 3 || tasknode.Buffer_capacity != 5 || tasknode.Pending != 0 {
+		t.Errorf("the tasknode is %+v, want 2 processed, 1 failed, 3 callings and the buffer of 5", tasknode)
+	}
+	if tasknode.Last_error != "the bad rawnode" || !tasknode.Last_error_time.Equal(harness.Clock.Now()) {
+		t.Errorf("the last error is %q at %s, want the bad rawnode", tasknode.Last_error, tasknode.Last_error_time)
+	}
+
+	var text strings.Builder
+	if err := snapshot.BrokerSnapshot_write(&text); err != nil {
+		t.Fatalf("the snapshot unable to write: %s", err)
+	}
+	for _, want := range []string{fmt.Sprintf("raw channel: 1/%d", MAX_RAWNODE_NUMBER), "snap.#", "the bad rawnode"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("the text of the snapshot has no %q:\n%s", want, text.String())
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	broker := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	broker.Broker_start(context.Background())
+	defer broker.Shutdown(context.Background())
+
+	broker.ProceNode_register(TypedReply(func(ctx context.Context, tasknode *TaskNode, payload int) (int, error) {
+		return payload * 2, nil
+	}), "double")
+	broker.ProceNode_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, "stall")
+
+	reply, err := broker.Call(context.Background(), "double", 21)
+	if err != nil || reply != 42 {
+		t.Errorf("the call returns %v, %v, want 42", reply, err)
+	}
+	if _, err := broker.Call(context.Background(), "missing", 1); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("the call of missing route returns %v, want ErrNoRoute", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := broker.Call(ctx, "stall", 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("the call of stalled route returns %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestCallBlocked(t *testing.T) {
+	// the router is not started, so the raw channel of one rawnode is full after the first sending
+	broker := Broker_create(1, DEFAULT_MAX_RUNNING)
+	if err := broker.Send(RawNode_create("full", 1)); err != nil {
+		t.Fatalf("the first rawnode is not sent: %v", err)
+	}
+
+	// the call waiting for the full raw channel returns while the ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := broker.Call(ctx, "blocked", 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("the blocked call returns %v, want DeadlineExceeded", err)
+	}
+
+	// the blocked sender returns while the broker is shut down, and the snapshot is not blocked by it
+	sent := make(chan error)
 	go func() {
-		for i := 0; i < 60; i++ {
-			data := fmt.Sprintf("rawnode data %d", i)
-			rawnode := RawNode_create("test003", data)
-			Send_raw(rawnode)
-			if i == 59 {
-				i = 0
+		sent <- broker.Send(RawNode_create("blocked", 2))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	broker.Broker_snapshot()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	broker.Shutdown(ctx)
+	if err := <-sent; !errors.Is(err, ErrBrokerClosed) {
+		t.Errorf("the blocked sending returns %v, want ErrBrokerClosed", err)
+	}
+}
+
+func TestRunningSlots(t *testing.T) {
+	broker := Broker_create(MAX_RAWNODE_NUMBER, 1)
+	task := func(id string, priority int, weight int) *TaskNode {
+		return &TaskNode{Id: id, Priority: priority, Weight: weight, Cancel: make(chan bool)}
+	}
+	holder := task("holder", PRIORITY_BACKGROUND, 1)
+	light := task("light", PRIORITY_BACKGROUND, 1)
+	heavy := task("heavy", PRIORITY_BACKGROUND, 2)
+	query := task("query", PRIORITY_INTERACTIVE, 1)
+	canceled := task("canceled", PRIORITY_INTERACTIVE, 1)
+	if !broker.running_acquire(holder) {
+		t.Fatalf("the free slot is not acquired")
+	}
+
+	// the waiters are queued one by one, so the virtual start times of them are decided by the order
+	granted := make(chan string, 10)
+	waiting := 0
+	wait := func(tasknode *TaskNode) {
+		go func() {
+			if broker.running_acquire(tasknode) {
+				granted <- tasknode.Id
+			} else {
+				granted <- "!" + tasknode.Id
 			}
+		}()
+		waiting++
+		for {
+			broker.running_lock.Lock()
+			queued := broker.running_waiting()
+			broker.running_lock.Unlock()
+			if queued == waiting {
+				return
+			}
+			time.Sleep(time.Millisecond)
 		}
+	}
+	for _, tasknode := range []*TaskNode{light, light, light, heavy, heavy, heavy, canceled, query} {
+		wait(tasknode)
+	}
+
+	// the canceled waiter leaves the queue without taking the slot
+	close(canceled.Cancel)
+	if got := <-granted; got != "!canceled" {
+		t.Fatalf("the canceled waiter returns %s", got)
+	}
+
+	// the interactive task is granted at first, and the heavy task gets two slots for each of the light task
+	var order []string
+	for i := 0; i < 7; i++ {
+		broker.running_release()
+		order = append(order, <-granted)
+	}
+	want := []string{"query", "light", "heavy", "heavy", "light", "heavy", "light"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("the slots are granted in %v, want %v", order, want)
+	}
+
+	// the waiters are granted at once while the max is increased
+	waiting = 0
+	wait(holder)
+	wait(holder)
+	broker.Running_set_max(3)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-granted:
+		case <-time.After(time.Second):
+			t.Fatalf("the waiter is not granted after increasing the max")
+		}
+	}
+	broker.running_lock.Lock()
+	running := broker.running_num
+	broker.running_lock.Unlock()
+	if running != 3 {
+		t.Errorf("the running slots are %d, want 3", running)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	harness.Harness_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		return nil
+	}, "device")
+	harness.Harness_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		return nil
+	}, "delay")
+	harness.Broker.RateLimit_set_device(RATE_ANY_DEVICE, RateLimit{Rate: 1, Burst: 2})
+	harness.Broker.RateLimit_set_route("delay", RateLimit{Rate: 10, Mode: RATE_DELAY, Max_delay: time.Second})
+
+	// each device has its own bucket, the rawnodes over the burst are dropped
+	for i := 0; i < 5; i++ {
+		harness.Harness_send(RawNode_create_key("device", "noisy", i))
+	}
+	harness.Harness_send(RawNode_create_key("device", "quiet", 5))
+	harness.Harness_drain()
+	harness.Clock.Advance(time.Second)
+	harness.Harness_send(RawNode_create_key("device", "noisy", 6))
+	harness.Harness_drain()
+	if got := harness.Recorder.Recorder_raws("device"); !reflect.DeepEqual(got, []interface{}{0, 1, 5, 6}) {
+		t.Errorf("the procenode received %v, want [0 1 5 6]", got)
+	}
+
+	// the rawnodes over the limit wait for the tokens in the virtual clock in order, and the router keeps routing the others
+	start := harness.Clock.Now()
+	for i := 0; i < 3; i++ {
+		harness.Harness_send(RawNode_create("delay", i))
+	}
+	harness.Harness_send(RawNode_create_key("device", "other", 7))
+	harness.Harness_drain()
+	if got := harness.Recorder.Recorder_raws("delay"); !reflect.DeepEqual(got, []interface{}{0, 1, 2}) {
+		t.Errorf("the procenode received %v, want [0 1 2]", got)
+	}
+	if elapsed := harness.Clock.Now().Sub(start); elapsed != 200*time.Millisecond {
+		t.Errorf("the rawnodes are delayed %s, want 200ms", elapsed)
+	}
+	for _, record := range harness.Recorder.Recorder_records() {
+		if record.Raw == 7 && !record.Time.Equal(start) {
+			t.Errorf("the rawnode of the other route is routed at %s, want %s", record.Time, start)
+		}
+	}
+
+	snapshots := harness.Broker.RateLimit_snapshot()
+	if len(snapshots) != 2 || snapshots[0].Delayed != 2 || snapshots[1].Dropped != 3 {
+		t.Errorf("the snapshots are %+v, want 2 delayed by the route and 3 dropped by the device", snapshots)
+	}
+}
+
+func TestRateLimitMatch(t *testing.T) {
+	broker := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	match := func(route string) string {
+		broker.ratelimit_lock.Lock()
+		defer broker.ratelimit_lock.Unlock()
+		return broker.ratelimit_match(route)
+	}
+	broker.RateLimit_set_route("aliyun.#", RateLimit{Rate: 1})
+	if pattern := match("aliyun.pk001.dev001.property"); pattern != "aliyun.#" {
+		t.Errorf("the route is limited by %q, want aliyun.#", pattern)
+	}
+	if pattern := match("http.voltage"); pattern != "" {
+		t.Errorf("the route http.voltage is limited by %q", pattern)
+	}
+
+	// the limits are changed, the cached routes are matched again
+	broker.RateLimit_set_route("aliyun.pk001.#", RateLimit{Rate: 1})
+	if pattern := match("aliyun.pk001.dev001.property"); pattern != "aliyun.pk001.#" {
+		t.Errorf("the route is limited by %q after setting, want aliyun.pk001.#", pattern)
+	}
+	broker.RateLimit_set_route("aliyun.pk001.#", RateLimit{})
+	if pattern := match("aliyun.pk001.dev001.property"); pattern != "aliyun.#" {
+		t.Errorf("the route is limited by %q after removing, want aliyun.#", pattern)
+	}
+}
+
+func TestRateLimitEvict(t *testing.T) {
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	harness.Harness_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		return nil
+	}, "device")
+	harness.Broker.RateLimit_set_device(RATE_ANY_DEVICE, RateLimit{Rate: 1, Burst: 1})
+	harness.Broker.device_limits[RATE_ANY_DEVICE].max = 2
+
+	// the bucket of the noisy device is used recently, so the bucket of the quiet one is evicted for the new one
+	for i, key := range []string{"noisy", "quiet", "noisy", "new", "noisy"} {
+		harness.Harness_send(RawNode_create_key("device", key, i))
+		harness.Harness_drain()
+	}
+	if got := harness.Recorder.Recorder_raws("device"); !reflect.DeepEqual(got, []interface{}{0, 1, 3}) {
+		t.Errorf("the procenode received %v, want [0 1 3]", got)
+	}
+	if buckets := harness.Broker.RateLimit_snapshot()[0].Buckets; buckets != 2 {
+		t.Errorf("the limit has %d buckets, want 2", buckets)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	start := time.Date(2024, time.March, 1, 10, 7, 30, 0, time.UTC) // a Friday
+	tests := []struct {
+		expression string
+		want       time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, time.March, 1, 10, 15, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, time.March, 1, 11, 0, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", time.Date(2024, time.March, 4, 9, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC).AddDate(4, 0, 0)},
+		{"0 12 15 * 0", time.Date(2024, time.March, 3, 12, 0, 0, 0, time.UTC)},
+		{"0 12 */2 * 1", time.Date(2024, time.March, 11, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		cron, err := cron_parse(test.expression)
+		if err != nil {
+			t.Errorf("the expression %q unable to parse: %s", test.expression, err)
+			continue
+		}
+		if got := cron.next(start); !got.Equal(test.want) {
+			t.Errorf("the next of %q is %s, want %s", test.expression, got, test.want)
+		}
+	}
+	for _, expression := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := cron_parse(expression); err == nil {
+			t.Errorf("the invalid expression %q is parsed", expression)
+		}
+	}
+}
+
+func TestJob(t *testing.T) {
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	harness.Harness_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		return nil
+	}, "tick")
+	runs := 0
+	job, err := harness.Broker.Job_register("ticker", "tick", "@every 1m", func() interface{} {
+		runs++
+		return runs
+	})
+	if err != nil {
+		t.Fatalf("the job unable to register: %s", err)
+	}
+
+	// the second run is skipped, because the first one is not processed yet
+	harness.Clock.Advance(time.Minute)
+	harness.Harness_step()
+	harness.Clock.Advance(time.Minute)
+	harness.Harness_drain()
+	harness.Clock.Advance(time.Minute)
+	harness.Harness_drain()
+
+	if got := harness.Recorder.Recorder_raws("tick"); !reflect.DeepEqual(got, []interface{}{1, 2}) {
+		t.Errorf("the procenode received %v, want [1 2]", got)
+	}
+	history := job.Job_history()
+	if len(history) != 3 || !history[0].Skipped || history[1].Skipped || history[1].Error != "" || history[2].Skipped {
+		t.Errorf("the history is %+v, want a skipped run and two finished runs", history)
+	}
+	if next := job.Job_next(); !next.Equal(HARNESS_START.Add(4 * time.Minute)) {
+		t.Errorf("the next run is %s, want %s", next, HARNESS_START.Add(4*time.Minute))
+	}
+}
+
+func TestJobTimeout(t *testing.T) {
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	harness.Harness_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		return nil
+	}, "stuck")
+	job, err := harness.Broker.Job_register("stuck", "stuck", "@every 1m", nil)
+	if err != nil {
+		t.Fatalf("the job unable to register: %s", err)
+	}
+	job.Job_set_timeout(20 * time.Millisecond)
+
+	// the rawnode of the first run is never processed, the run is finished by the timeout
+	harness.Clock.Advance(time.Minute)
+	harness.Harness_step()
+	for deadline := time.Now().Add(5 * time.Second); len(job.Job_history()) == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the run is not finished after the timeout")
+		}
+	}
+	if history := job.Job_history(); !strings.Contains(history[0].Error, context.DeadlineExceeded.Error()) || job.Stat_failed != 1 {
+		t.Errorf("the history is %+v, want a run failed by the timeout", history)
+	}
+
+	// the next run is not skipped
+	harness.Clock.Advance(time.Minute)
+	harness.Harness_step()
+	if job.Stat_skipped != 0 || job.Stat_runs != 2 {
+		t.Errorf("the job runs %d times and skips %d times, want 2 runs", job.Stat_runs, job.Stat_skipped)
+	}
+	harness.Harness_drain()
+}
+
+func TestTaskReap(t *testing.T) {
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	var events []string
+	harness.Broker.Lifecycle_set(func(event TaskEvent) {
+		events = append(events, event.Kind+":"+event.Tasknode)
+	})
+	procenode := harness.Harness_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		return nil
+	}, "device")
+	procenode.ProceNode_set_idle(10 * time.Minute)
+
+	harness.Harness_send(RawNode_create("device", 1))
+	harness.Harness_drain()
+	stale := harness.Broker.TaskNode_find("device")
+	harness.Clock.Advance(6 * time.Minute)
+	harness.Harness_drain()
+	harness.Clock.Advance(5 * time.Minute)
+	harness.Harness_drain()
+	if harness.Broker.TaskNode_find("device") != nil {
+		t.Errorf("the task quiet for 11m is not reaped")
+	}
+
+	// the task is created again, while the route is active again
+	harness.Harness_send(RawNode_create("device", 2))
+	harness.Harness_drain()
+	if got := harness.Recorder.Recorder_raws("device"); !reflect.DeepEqual(got, []interface{}{1, 2}) {
+		t.Errorf("the procenode received %v, want [1 2]", got)
+	}
+	// the pointer to the reaped task never unregisters the new one
+	if stale.TaskNode_unregister() || stale.TaskNode_unregister() {
+		t.Errorf("the reaped task is unregistered again")
+	}
+	if fresh := harness.Broker.TaskNode_find("device"); fresh == nil || fresh == stale {
+		t.Errorf("the new task is %p, want it registered beside the reaped %p", fresh, stale)
+	}
+	want := []string{"created:device", "idle:device", "reaped:device", "created:device"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("the events are %v, want %v", events, want)
+	}
+	if snapshot := harness.Broker.Broker_snapshot(); snapshot.Tasks_created != 2 || snapshot.Tasks_reaped != 1 {
+		t.Errorf("the snapshot counts %d created and %d reaped, want 2 and 1", snapshot.Tasks_created, snapshot.Tasks_reaped)
+	}
+}
+
+func TestControler(t *testing.T) {
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	harness.Harness_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		return nil
+	}, "ctl")
+	harness.Harness_send(RawNode_create("ctl", 0))
+	harness.Harness_drain()
+	tasknode := harness.Broker.TaskNode_find("ctl")
+	control := func(operation int, information interface{}) error {
+		monitor := Monitor_Create(tasknode, information, operation)
+		harness.Broker.Send_mon(monitor)
+		harness.Harness_drain()
+		return monitor.Monitor_wait(time.Second)
+	}
+
+	// the rawnodes are kept in the buffer of the task paused and resized
+	if err := control(Pause, nil); err != nil {
+		t.Fatalf("the pause returns %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		harness.Harness_send(RawNode_create("ctl", i))
+	}
+	harness.Harness_drain()
+	if err := control(Resize, 8); err != nil || cap(tasknode.TaskNode_buffer()) != 8 || len(tasknode.TaskNode_buffer()) != 3 {
+		t.Fatalf("the resize returns %v, the buffer holds %d of %d, want 3 of 8", err, len(tasknode.TaskNode_buffer()), cap(tasknode.TaskNode_buffer()))
+	}
+	if err := control(Resize, "8"); !errors.Is(err, ErrMonitorInformation) {
+		t.Errorf("the resize by a string returns %v, want ErrMonitorInformation", err)
+	}
+	if err := control(99, nil); !errors.Is(err, ErrMonitorOperation) {
+		t.Errorf("the unknown operation returns %v, want ErrMonitorOperation", err)
+	}
+
+	// the rawnodes left in the task unregistered are parked in the dead letter, and the route gets a new task
+	if err := control(Unregister, nil); err != nil {
+		t.Fatalf("the unregister returns %v", err)
+	}
+	parked := harness.Broker.DeadLetter_list()
+	if len(parked) != 3 || !errors.Is(parked[0].Failure, ErrTaskUnregistered) {
+		t.Fatalf("the dead letter holds %+v, want the 3 rawnodes failed by ErrTaskUnregistered", parked)
+	}
+	if err := control(Unregister, nil); err == nil {
+		t.Errorf("the task is unregistered twice")
+	}
+	harness.Harness_send(RawNode_create("ctl", 4))
+	harness.Harness_drain()
+	if got := harness.Recorder.Recorder_raws("ctl"); !reflect.DeepEqual(got, []interface{}{0, 4}) {
+		t.Errorf("the procenode received %v, want [0 4]", got)
+	}
+	if harness.Broker.DeadLetter_redrive(nil) != 3 {
+		t.Fatalf("the parked rawnodes are not re-driven")
+	}
+	harness.Harness_drain()
+	if got := harness.Recorder.Recorder_raws("ctl"); !reflect.DeepEqual(got, []interface{}{0, 4, 1, 2, 3}) {
+		t.Errorf("the procenode received %v after re-driving, want [0 4 1 2 3]", got)
+	}
+}
+
+func TestMonitorSend(t *testing.T) {
+	broker := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	broker.Broker_start(context.Background())
+	procenode := broker.ProceNode_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		return nil
+	}, "monitor")
+	tasknode := TaskNode_register("monitor", procenode, DEFAULT_TIMEPEICE)
+
+	ctx := context.Background()
+	if err := broker.Monitor_send(ctx, "missing", Pause, nil); !errors.Is(err, ErrMonitorInformation) {
+		t.Errorf("the monitor of the missing task returns %v, want ErrMonitorInformation", err)
+	}
+	if err := broker.Monitor_send(ctx, "monitor", Pause, nil); err != nil || !tasknode.TaskNode_is_paused() {
+		t.Errorf("the pause returns %v, want the task paused", err)
+	}
+	if err := broker.Monitor_send(ctx, "monitor", Pause, nil); err == nil {
+		t.Errorf("the task is paused twice")
+	}
+	broker.Shutdown(ctx)
+	if err := broker.Monitor_send(ctx, "monitor", Resume, nil); !errors.Is(err, ErrBrokerClosed) {
+		t.Errorf("the monitor after the shutdown returns %v, want ErrBrokerClosed", err)
+	}
+}
+
+func TestProceNodeSwap(t *testing.T) {
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+
+	var procenode *ProceNode
+	var swapped []interface{}
+	second := func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		swapped = append(swapped, rawnode.Raw)
+		return nil
+	}
+	// the first version swaps in the second one while it handles "a", and fails once
+	procenode = harness.Harness_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		if rawnode.Attempts == 1 && rawnode.Raw == "a" {
+			if version, err := procenode.ProceNode_swap(second); err != nil || version != 2 {
+				t.Errorf("the swap returns %d, %v, want the version 2", version, err)
+			}
+			return errors.New("temporary")
+		}
+		return nil
+	}, "swap")
+	procenode.ProceNode_set_retry(RetryPolicy{Max_attempts: 2, Backoff: time.Second})
+
+	harness.Harness_send(RawNode_create("swap", "a"))
+	harness.Harness_send(RawNode_create("swap", "b"))
+	harness.Harness_drain()
+
+	// the retry of "a" is in flight while swapping, so it finishes on the first version
+	if got := harness.Recorder.Recorder_raws("swap"); !reflect.DeepEqual(got, []interface{}{"a"}) {
+		t.Errorf("the first version processed %v, want [a]", got)
+	}
+	if !reflect.DeepEqual(swapped, []interface{}{"b"}) {
+		t.Errorf("the second version processed %v, want [b]", swapped)
+	}
+	versions := procenode.ProceNode_versions()
+	if len(versions) != 2 || !versions[1].Current || versions[0].Inflight != 0 || versions[1].Inflight != 0 {
+		t.Errorf("the versions are %+v, want 2 versions and none in flight", versions)
+	}
+
+	version, err := procenode.ProceNode_rollback()
+	if err != nil || version != 1 || procenode.ProceNode_version() != 1 {
+		t.Fatalf("the rollback returns %d, %v, want the version 1", version, err)
+	}
+	harness.Harness_send(RawNode_create("swap", "c"))
+	harness.Harness_drain()
+	if got := harness.Recorder.Recorder_raws("swap"); !reflect.DeepEqual(got, []interface{}{"a", "c"}) {
+		t.Errorf("the first version processed %v after the rollback, want [a c]", got)
+	}
+	if _, err := procenode.ProceNode_rollback(); !errors.Is(err, ErrNoPreviousVersion) {
+		t.Errorf("the rollback of the first version returns %v, want ErrNoPreviousVersion", err)
+	}
+	if procenode.ProceNode_update_method("invalid") || procenode.ProceNode_version() != 1 {
+		t.Errorf("the invalid operation is installed")
+	}
+}
+
+// the secret shared by the coordinator and the workers of the tests
+const remoteSecret = "secret"
+
+/*
+the function registers a worker speaking the protocol by hand, which handles nothing. The frames received are
+passed to the handle, and the worker is silent if the handle is nil.
+*/
+func remoteFake(addr string, id string, secret string, handle func(worker *remote_worker, frame *remote_frame)) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	worker := &remote_worker{id: id, conn: conn}
+	reader := bufio.NewReader(conn)
+	if err := remote_register(worker, reader, id, secret, []string{"remote.#"}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if handle != nil {
+		go func() {
+			for {
+				conn.SetReadDeadline(time.Time{})
+				frame := new(remote_frame)
+				if remote_read(reader, frame) != nil {
+					return
+				}
+				handle(worker, frame)
+			}
+		}()
+	}
+	return conn, nil
+}
+
+// the function returns a key of the device forwarded to the worker named id
+func remoteKey(coordinator *Broker, id string) string {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("device%d", i)
+		if coordinator.remote.remote_pick(RawNode_create_key("remote.echo", key, nil)).id == id {
+			return key
+		}
+	}
+}
+
+func TestRemoteAuth(t *testing.T) {
+	coordinator := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	coordinator.Broker_start(context.Background())
+	defer coordinator.Shutdown(context.Background())
+	if _, err := coordinator.Remote_listen("127.0.0.1:0", "", "remote.#"); err == nil {
+		t.Fatalf("the coordinator listens without the secret")
+	}
+	addr, err := coordinator.Remote_listen("127.0.0.1:0", remoteSecret, "remote.#")
+	if err != nil {
+		t.Fatalf("the coordinator unable to listen: %s", err)
+	}
+
+	if conn, err := remoteFake(addr, "intruder", "wrong", nil); err == nil {
+		conn.Close()
+		t.Fatalf("the worker having the wrong secret is registered")
+	}
+	if workers := coordinator.Remote_workers(); len(workers) != 0 {
+		t.Fatalf("the workers are %+v, want none", workers)
+	}
+	conn, err := remoteFake(addr, "w1", remoteSecret, nil)
+	if err != nil {
+		t.Fatalf("the worker having the secret unable to register: %s", err)
+	}
+	defer conn.Close()
+	if workers := coordinator.Remote_workers(); len(workers) != 1 || workers[0].Id != "w1" {
+		t.Errorf("the workers are %+v, want w1", workers)
+	}
+
+	// the worker refuses the coordinator unable to prove the secret
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("the fake coordinator unable to listen: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		remote_write(conn, &remote_frame{Kind: REMOTE_CHALLENGE, Nonce: []byte("nonce")})
+		remote_read(bufio.NewReader(conn), new(remote_frame))
+		remote_write(conn, &remote_frame{Kind: REMOTE_REGISTER, Worker: "w2", Proof: []byte("forged")})
 	}()
+	if _, err := remoteFake(listener.Addr().String(), "w2", remoteSecret, nil); !errors.Is(err, ErrRemoteAuth) {
+		t.Errorf("the worker registers to the forged coordinator with %v, want ErrRemoteAuth", err)
+	}
+}
 
-	for {
-		fmt.Printf("")
+func TestRemoteHeartbeat(t *testing.T) {
+	coordinator := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	coordinator.Broker_start(context.Background())
+	defer coordinator.Shutdown(context.Background())
+	addr, err := coordinator.Remote_listen("127.0.0.1:0", remoteSecret, "remote.#")
+	if err != nil {
+		t.Fatalf("the coordinator unable to listen: %s", err)
 	}
+	worker := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	worker.Broker_start(context.Background())
+	defer worker.Shutdown(context.Background())
+	worker.ProceNode_register(TypedReply(func(ctx context.Context, tasknode *TaskNode, payload string) (string, error) {
+		return "w2:" + payload, nil
+	}), "remote.echo")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go worker.Remote_serve(ctx, addr, "w2", remoteSecret, "remote.#")
 
+	// the w1 is connected but silent, e.g. its process is stopped, so it never answers the pings
+	conn, err := remoteFake(addr, "w1", remoteSecret, nil)
+	if err != nil {
+		t.Fatalf("the w1 unable to register: %s", err)
+	}
+	defer conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); len(coordinator.Remote_workers()) != 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the workers are %+v, want w1 and w2", coordinator.Remote_workers())
+		}
+	}
 
+	// the rawnode forwarded to the w1 is moved to the w2, after the w1 is dropped by the health check
+	key := remoteKey(coordinator, "w1")
+	start := time.Now()
+	ctx, cancel = context.WithTimeout(context.Background(), 4*DEFAULT_REMOTE_TIMEOUT)
+	defer cancel()
+	reply, err := coordinator.call(ctx, RawNode_create_key("remote.echo", key, key))
+	if err != nil || reply != "w2:"+key {
+		t.Fatalf("the call returns %v, %v, want the reply of w2", reply, err)
+	}
+	if elapsed := time.Since(start); elapsed < DEFAULT_REMOTE_TIMEOUT-DEFAULT_REMOTE_HEARTBEAT {
+		t.Errorf("the w1 is dropped after %s, want the DEFAULT_REMOTE_TIMEOUT", elapsed)
+	}
+	if workers := coordinator.Remote_workers(); len(workers) != 1 || workers[0].Id != "w2" {
+		t.Errorf("the workers are %+v after w1 is silent, want w2 only", workers)
+	}
+}
+
+func TestRemoteHung(t *testing.T) {
+	coordinator := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	coordinator.Broker_start(context.Background())
+	defer coordinator.Shutdown(context.Background())
+	addr, err := coordinator.Remote_listen("127.0.0.1:0", remoteSecret, "remote.#")
+	if err != nil {
+		t.Fatalf("the coordinator unable to listen: %s", err)
+	}
+
+	// the w1 answers the pings but never returns a result, e.g. its processor is blocked
+	conn, err := remoteFake(addr, "w1", remoteSecret, func(worker *remote_worker, frame *remote_frame) {
+		if frame.Kind == REMOTE_PING {
+			worker.worker_write(&remote_frame{Kind: REMOTE_PONG})
+		}
+	})
+	if err != nil {
+		t.Fatalf("the w1 unable to register: %s", err)
+	}
+	defer conn.Close()
+
+	// the call outlasting the DEFAULT_REMOTE_TIMEOUT is given up by its deadline, and the w1 is kept by the pings
+	timeout := DEFAULT_REMOTE_TIMEOUT + 2*DEFAULT_REMOTE_HEARTBEAT
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	if _, err := coordinator.call(ctx, RawNode_create_key("remote.echo", "device", "device")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("the call returns %v, want the context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > timeout+time.Second {
+		t.Errorf("the call returns after %s, want %s", elapsed, timeout)
+	}
+	// the forwarding is given up by the same deadline, while the call returns
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		workers := coordinator.Remote_workers()
+		if len(workers) == 1 && workers[0].Id == "w1" && workers[0].Inflight == 0 && workers[0].Forwarded == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the workers are %+v, want w1 without the rawnode in flight", workers)
+		}
+	}
+}
+
+// the test runs as a worker process started by the TestRemote, it is skipped while the tests run normally
+func TestRemoteWorker(t *testing.T) {
+	addr, id := os.Getenv("DATABASIC_REMOTE_ADDR"), os.Getenv("DATABASIC_REMOTE_WORKER")
+	if addr == "" {
+		t.Skip("the test runs as a worker process of the TestRemote only")
+	}
+	broker := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	broker.Broker_start(context.Background())
+	broker.ProceNode_register(TypedReply(func(ctx context.Context, tasknode *TaskNode, payload string) (string, error) {
+		return id + ":" + payload, nil
+	}), "remote.echo")
+	broker.Remote_serve(context.Background(), addr, id, remoteSecret, "remote.#")
+}
+
+func TestRemote(t *testing.T) {
+	coordinator := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	coordinator.Broker_start(context.Background())
+	defer coordinator.Shutdown(context.Background())
+	addr, err := coordinator.Remote_listen("127.0.0.1:0", remoteSecret, "remote.#")
+	if err != nil {
+		t.Fatalf("the coordinator unable to listen: %s", err)
+	}
+
+	workers := make(map[string]*exec.Cmd)
+	for _, id := range []string{"w1", "w2"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestRemoteWorker$")
+		cmd.Env = append(os.Environ(), "DATABASIC_REMOTE_ADDR="+addr, "DATABASIC_REMOTE_WORKER="+id)
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("the worker %s unable to start: %s", id, err)
+		}
+		defer cmd.Process.Kill()
+		workers[id] = cmd
+	}
+	for deadline := time.Now().Add(10 * time.Second); len(coordinator.Remote_workers()) != 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the workers are %+v, want w1 and w2", coordinator.Remote_workers())
+		}
+	}
+
+	// the rawnodes of a device are forwarded to the same worker, and the devices are spread over the workers
+	serve := func() map[string]string {
+		served := make(map[string]string)
+		for i := 0; i < 20; i++ {
+			device := fmt.Sprintf("device%d", i)
+			reply, err := coordinator.call(context.Background(), RawNode_create_key("remote.echo", device, device))
+			if err != nil {
+				t.Fatalf("the call of %s returns %v", device, err)
+			}
+			worker, payload, _ := strings.Cut(reply.(string), ":")
+			if payload != device {
+				t.Fatalf("the reply of %s is %v", device, reply)
+			}
+			served[device] = worker
+		}
+		return served
+	}
+	served := serve()
+	if again := serve(); !reflect.DeepEqual(again, served) {
+		t.Errorf("the devices are moved between the workers: %v, then %v", served, again)
+	}
+	moved := 0
+	for _, worker := range served {
+		if worker == "w1" {
+			moved++
+		}
+	}
+	if moved == 0 || moved == len(served) {
+		t.Fatalf("the devices are served by %v, want both workers", served)
+	}
+
+	// the devices of the worker leaving are moved to the other one
+	workers["w1"].Process.Kill()
+	workers["w1"].Wait()
+	for device, worker := range serve() {
+		if worker != "w2" {
+			t.Errorf("the device %s is served by %s after w1 leaves, want w2", device, worker)
+		}
+	}
+	if snapshots := coordinator.Remote_workers(); len(snapshots) != 1 || snapshots[0].Id != "w2" {
+		t.Errorf("the workers are %+v after w1 leaves, want w2 only", snapshots)
+	}
+}
+
+func TestTaskOverrun(t *testing.T) {
+	broker := Broker_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	broker.Slow_report_set(func(tasknode *TaskNode, rawnode *RawNode, elapsed time.Duration, overrun bool) {})
+	broker.Broker_start(context.Background())
+	defer broker.Shutdown(context.Background())
+
+	// the processor ignores the context like a blocking query, and fails the first calling of each rawnode
+	var running, overlapped, calls int64
+	procenode := broker.ProceNode_register_pool(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		if atomic.AddInt64(&running, 1) > 1 {
+			atomic.AddInt64(&overlapped, 1)
+		}
+		defer atomic.AddInt64(&running, -1)
+		atomic.AddInt64(&calls, 1)
+		time.Sleep(30 * time.Millisecond)
+		if rawnode.Attempts == 1 {
+			return errors.New("temporary")
+		}
+		return nil
+	}, "overrun", 4, nil)
+	procenode.ProceNode_set_retry(RetryPolicy{Max_attempts: 3})
+	tasknode := TaskNode_register("overrun", procenode, 5*time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		broker.Send_raw(RawNode_create_key("overrun", "device", i))
+	}
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&calls) < 10; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the processor is called %d times, want 10", atomic.LoadInt64(&calls))
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// the retry and the next rawnode of the key wait for the overrun calling to return
+	if n := atomic.LoadInt64(&overlapped); n != 0 {
+		t.Errorf("the callings of the key overlap %d times, want 0", n)
+	}
+	if n := atomic.LoadInt64(&calls); n != 10 {
+		t.Errorf("the processor is called %d times, want 10", n)
+	}
+	if n := atomic.LoadInt64(&tasknode.Stat_overrun); n != 10 {
+		t.Errorf("the task overruns %d times, want 10", n)
+	}
+	if n := atomic.LoadInt64(&tasknode.Stat_pending); n != 0 {
+		t.Errorf("the task has %d rawnodes pending, want 0", n)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	harness.Harness_register(func(tasknode *TaskNode, rawnode *RawNode) bool { return true }, "wal")
+	if err := harness.Broker.WAL_open(dir, false); err != nil {
+		t.Fatalf("the wal unable to open: %s", err)
+	}
+	defer harness.Broker.WAL_close()
+
+	// the three rawnodes are routed and only the first one is processed before the crash
+	for i := 0; i < 3; i++ {
+		harness.Harness_send(RawNode_create_key("wal", "device", i))
+	}
+	for i := 0; i < 4; i++ {
+		harness.Harness_step()
+	}
+	if got := harness.Recorder.Recorder_raws("wal"); !reflect.DeepEqual(got, []interface{}{0}) {
+		t.Fatalf("the procenode received %v before the crash, want [0]", got)
+	}
+
+	// the record torn by the crash is ignored
+	file, err := os.OpenFile(filepath.Join(dir, WAL_FILE_NAME), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("the wal file unable to open: %s", err)
+	}
+	file.Write([]byte{0, 0, 0, 64, 1, 2, 3, 4, 5})
+	file.Close()
+
+	restarted := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	restarted.Harness_register(func(tasknode *TaskNode, rawnode *RawNode) bool { return true }, "wal")
+	if err := restarted.Broker.WAL_open(dir, false); err != nil {
+		t.Fatalf("the wal unable to reopen: %s", err)
+	}
+	defer restarted.Broker.WAL_close()
+	if replayed := restarted.Broker.WAL_replay(); replayed != 2 {
+		t.Errorf("the wal replays %d rawnodes, want 2", replayed)
+	}
+	restarted.Harness_drain()
+	if got := restarted.Recorder.Recorder_raws("wal"); !reflect.DeepEqual(got, []interface{}{1, 2}) {
+		t.Errorf("the procenode received %v after restarting, want [1 2]", got)
+	}
+	if records, _ := wal_read(filepath.Join(dir, WAL_FILE_NAME)); len(records) != 0 {
+		t.Errorf("the wal holds %d records not done after replaying, want 0", len(records))
+	}
+}
+
+func TestDeadLetterStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := DeadLetterStore_open(dir, 2)
+	if err != nil {
+		t.Fatalf("the store unable to open: %s", err)
+	}
+	properties := map[string]interface{}{"topic": "/pk001/dev001/user/update", "generateTime": int64(1)}
+	put := func(payload string) string {
+		id, err := store.DeadLetterStore_put(DeadLetter{Topic: "topic", Properties: properties, Payload: []byte(payload), Reason: payload})
+		if err != nil {
+			t.Fatalf("the dead letter %s unable to put: %s", payload, err)
+		}
+		return id
+	}
+	first, second, third := put("first"), put("second"), put("third")
+	store.DeadLetterStore_replay(second, func(letter DeadLetter) error {
+		return errors.New("replayed")
+	})
+	store.DeadLetterStore_close()
+
+	// the dead letters kept and the failed replay survive the reopening, the dropped one is not restored
+	store, err = DeadLetterStore_open(dir, 2)
+	if err != nil {
+		t.Fatalf("the store unable to reopen: %s", err)
+	}
+	letters := store.DeadLetterStore_list()
+	if len(letters) != 2 || letters[0].Id != second || letters[1].Id != third {
+		t.Fatalf("the reopened store holding %v, want %s and %s", letters, second, third)
+	}
+	if _, ok := store.DeadLetterStore_get(first); ok {
+		t.Errorf("the dropped dead letter %s is restored", first)
+	}
+	if letters[0].Reason != "replayed" || letters[0].Replays != 1 || string(letters[0].Payload) != "second" || letters[0].Properties["generateTime"] != int64(1) {
+		t.Errorf("the reopened dead letter is %+v", letters[0])
+	}
+	store.DeadLetterStore_discard(second)
+	fourth := put("fourth")
+	if fourth == first || fourth == second || fourth == third {
+		t.Errorf("the id %s of the new dead letter is reused", fourth)
+	}
+	store.DeadLetterStore_close()
+
+	// the record broken by a crash is ignored
+	file, err := os.OpenFile(filepath.Join(dir, DEADLETTER_FILE_NAME), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("the journal unable to open: %s", err)
+	}
+	file.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	file.Close()
+	store, err = DeadLetterStore_open(dir, 2)
+	if err != nil {
+		t.Fatalf("the store with the broken record unable to reopen: %s", err)
+	}
+	defer store.DeadLetterStore_close()
+	letters = store.DeadLetterStore_list()
+	if len(letters) != 2 || letters[0].Id != third || letters[1].Id != fourth {
+		t.Errorf("the store with the broken record holding %v, want %s and %s", letters, third, fourth)
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	harness.Harness_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		return nil
+	}, "replay")
+
+	// the parked rawnode was admitted already, the fresh copy of it is sent without the Admit and the attempts
+	admitted := 0
+	rawnode := RawNode_create("replay", 1)
+	rawnode.Admit = func(rawnode *RawNode, err error) {
+		admitted++
+	}
+	rawnode.Attempts = 3
+	rawnode.Failure = errors.New("failed")
+	harness.Broker.DeadLetter_park(rawnode)
+	if redriven := harness.Broker.DeadLetter_redrive(nil); redriven != 1 {
+		t.Fatalf("the dead letter re-drives %d rawnodes, want 1", redriven)
+	}
+	harness.Harness_drain()
+
+	records := harness.Recorder.Recorder_records()
+	if len(records) != 1 || records[0].Raw != 1 || records[0].Attempt != 1 {
+		t.Errorf("the replayed records are %+v, want one first attempt", records)
+	}
+	if admitted != 0 || rawnode.Attempts != 3 || rawnode.Failure == nil {
+		t.Errorf("the parked rawnode is admitted %d times and changed to %+v", admitted, rawnode)
+	}
+}
+
+func TestDeadLetterPersist(t *testing.T) {
+	wal_dir, deadletter_dir := t.TempDir(), t.TempDir()
+	failing := true
+	operation := func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		if failing {
+			return errors.New("temporary")
+		}
+		return nil
+	}
+	open := func() *Harness {
+		harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+		// the route named like the dead letter is a normal task
+		harness.Harness_register(operation, "deadletter")
+		if err := harness.Broker.WAL_open(wal_dir, false); err != nil {
+			t.Fatalf("the wal unable to open: %s", err)
+		}
+		if err := harness.Broker.DeadLetter_open(deadletter_dir); err != nil {
+			t.Fatalf("the dead letter store unable to open: %s", err)
+		}
+		return harness
+	}
+
+	harness := open()
+	harness.Harness_send(RawNode_create_key("deadletter", "device", 1))
+	harness.Harness_drain()
+	harness.Broker.DeadLetter_store().DeadLetterStore_put(DeadLetter{Topic: "topic", Payload: []byte("malformed"), Reason: "malformed"})
+	parked := harness.Broker.DeadLetter_list()
+	if len(parked) != 1 || parked[0].Id != "deadletter" || parked[0].Raw != 1 || parked[0].Failure.Error() != "temporary" {
+		t.Fatalf("the rawnodes parked are %+v, want the one failed", parked)
+	}
+	// the rawnode journaled by the dead letter store is done in the wal, so it is not replayed twice
+	if records, _ := wal_read(filepath.Join(wal_dir, WAL_FILE_NAME)); len(records) != 0 {
+		t.Errorf("the wal holds %d records not done after parking, want 0", len(records))
+	}
+	harness.Broker.WAL_close()
+	harness.Broker.DeadLetter_close()
+
+	// the rawnode parked survives the restart, and it is re-driven to its route
+	failing = false
+	restarted := open()
+	defer restarted.Broker.WAL_close()
+	defer restarted.Broker.DeadLetter_close()
+	if replayed := restarted.Broker.WAL_replay(); replayed != 0 {
+		t.Errorf("the wal replays %d rawnodes, want 0", replayed)
+	}
+	parked = restarted.Broker.DeadLetter_list()
+	if len(parked) != 1 || parked[0].Id != "deadletter" || parked[0].Key != "device" || parked[0].Failure.Error() != "temporary" {
+		t.Fatalf("the rawnodes parked after restarting are %+v, want the one failed", parked)
+	}
+	if redriven := restarted.Broker.DeadLetter_redrive(nil); redriven != 1 {
+		t.Fatalf("the dead letter re-drives %d rawnodes, want 1", redriven)
+	}
+	restarted.Harness_drain()
+	if got := restarted.Recorder.Recorder_raws("deadletter"); !reflect.DeepEqual(got, []interface{}{1}) {
+		t.Errorf("the procenode received %v after re-driving, want [1]", got)
+	}
+	letters := restarted.Broker.DeadLetter_store().DeadLetterStore_list()
+	if len(letters) != 1 || letters[0].Topic != "topic" || letters[0].Route != "" {
+		t.Errorf("the dead letters are %+v, want the message quarantined only", letters)
+	}
+}
+
+func TestWALFanout(t *testing.T) {
+	dir := t.TempDir()
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	for _, id := range []string{"a", "b"} {
+		harness.Broker.Subscribe("fan.#", harness.Harness_register(func(tasknode *TaskNode, rawnode *RawNode) bool { return true }, id))
+	}
+	if err := harness.Broker.WAL_open(dir, false); err != nil {
+		t.Fatalf("the wal unable to open: %s", err)
+	}
+	defer harness.Broker.WAL_close()
+
+	// the record is done only after both copies are processed
+	harness.Harness_send(RawNode_create("fan.x", "data"))
+	harness.Harness_step()
+	harness.Harness_step()
+	if records, _ := wal_read(filepath.Join(dir, WAL_FILE_NAME)); len(records) != 1 {
+		t.Errorf("the wal holds %d records after a copy is processed, want 1", len(records))
+	}
+	harness.Harness_step()
+	if records, _ := wal_read(filepath.Join(dir, WAL_FILE_NAME)); len(records) != 0 {
+		t.Errorf("the wal holds %d records after both copies are processed, want 0", len(records))
+	}
+	if n := len(harness.Recorder.Recorder_records()); n != 2 {
+		t.Errorf("the copies are processed %d times, want 2", n)
+	}
+}
+
+func TestWALCompact(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, WAL_FILE_NAME)
+	harness := Harness_create(MAX_RAWNODE_NUMBER, DEFAULT_MAX_RUNNING)
+	harness.Harness_register(func(tasknode *TaskNode, rawnode *RawNode) bool { return true }, "wal")
+	poison := harness.Harness_register(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		return errors.New("poison")
+	}, "poison")
+	poison.ProceNode_set_retry(RetryPolicy{Max_attempts: 1})
+	if err := harness.Broker.WAL_open(dir, false); err != nil {
+		t.Fatalf("the wal unable to open: %s", err)
+	}
+	defer harness.Broker.WAL_close()
+	wal := harness.Broker.wal_get()
+	wal.lock.Lock()
+	wal.segment = 4096
+	wal.lock.Unlock()
+
+	// the parked rawnode is never done, the log is compacted to it in the background
+	harness.Harness_send(RawNode_create("poison", "poison"))
+	harness.Harness_drain()
+	for i := 0; i < 200; i++ {
+		harness.Harness_send(RawNode_create("wal", i))
+		harness.Harness_drain()
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		info, err := os.Stat(path)
+		if err == nil && info.Size() <= 4096 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the wal is not compacted")
+		}
+	}
+	records, err := wal_read(path)
+	if err != nil || len(records) != 1 || records[0].Raw != "poison" {
+		t.Fatalf("the compacted wal holds %v %v, want the parked rawnode", records, err)
+	}
+
+	// the rawnode unable to write the log is not routed
+	wal.lock.Lock()
+	wal.file.Close()
+	wal.lock.Unlock()
+	err = harness.Broker.Send(RawNode_create("wal", "lost"))
+	if !errors.Is(err, ErrWALWrite) || len(harness.Broker.raw_channel) != 0 {
+		t.Errorf("the rawnode unable to write the wal return %v, %d rawnodes are routed", err, len(harness.Broker.raw_channel))
+	}
+	if harness.Harness_send(RawNode_create("wal", "lost")) {
+		t.Errorf("the harness sends the rawnode unable to write the wal")
+	}
 }
@@ -0,0 +1,601 @@
+package databasic
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The dead letter store of the broker keeps the rawnodes that exhaust the retries, and the messages quarantined by
+the sources, e.g. the amqp message malformed. It is not a tasknode, so it never collides with a route. The
+rawnode parked keeps its RawNode.Id as the Route of the dead letter, which is used to re-drive it to the original
+task, and the copy fanned out keeps the task of its subscriber as the Task, which is re-driven to that task only,
+so the other subscribers never receive it twice. The message quarantined keeps its Topic, Properties and Payload
+to be replayed by the source.
+
+The store is in memory until the DeadLetter_open, and the rawnodes parked in it are kept in the write-ahead log.
+The store opened in a directory appends each change to the journal and syncs it before returning, so the dead
+letters survive the restart, and the rawnode parked is done in the write-ahead log after it is journaled. The
+types of the Raw and the Properties must be registered by the gob.Register.
+*/
+const (
+	DEFAULT_DEADLETTER_SIZE int    = 1000 /* the oldest dead letter is dropped, while the store is full */
+	DEADLETTER_FILE_NAME    string = "deadletter.journal"
+)
+
+/* the operations of the journal record */
+const (
+	deadletter_set    int = 1
+	deadletter_remove int = 2
+)
+
+/* the dead letter is a rawnode parked by the broker, whose Route is set, or a message quarantined by a source */
+type DeadLetter struct {
+	Id         string                 `json:"id"`
+	Route      string                 `json:"route,omitempty"` /* the RawNode.Id of the rawnode parked */
+	Task       string                 `json:"task,omitempty"`  /* the task of the subscriber, if the rawnode is a copy fanned out */
+	Key        string                 `json:"key,omitempty"`
+	Raw        interface{}            `json:"-"`
+	Attempts   int                    `json:"attempts,omitempty"`
+	Topic      string                 `json:"topic"`
+	Properties map[string]interface{} `json:"properties"`
+	Payload    []byte                 `json:"-"`
+	Reason     string                 `json:"reason"`
+	Time       time.Time              `json:"time"`
+	Replays    int                    `json:"replays"`
+
+	rawnode *RawNode /* the rawnode parked, it is nil after the store is reopened */
+}
+
+/* the record of the journal, the set adds or updates the dead letter and the remove drops it */
+type deadletter_record struct {
+	Op     int
+	Letter DeadLetter
+}
+
+type DeadLetterStore struct {
+	lock    sync.Mutex
+	letters *list.List
+	max     int
+	seq     int
+
+	/* the journal of the persistent store, it is nil while the store is in memory */
+	dir     string
+	file    *os.File
+	records int
+}
+
+/* the function creates a store in memory, the dead letters are lost while the process stops */
+func DeadLetterStore_create(max int) *DeadLetterStore {
+	return &DeadLetterStore{
+		letters: list.New(),
+		max:     max,
+	}
+}
+
+/*
+the function opens the persistent store in the dir. The journal is rewritten with the dead letters kept while
+it is opened and while it holds twice the max records, and the record broken by a crash is ignored while reading.
+*/
+func DeadLetterStore_open(dir string, max int) (*DeadLetterStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	ds := DeadLetterStore_create(max)
+	ds.dir = dir
+
+	records, err := deadletter_read(filepath.Join(dir, DEADLETTER_FILE_NAME))
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		ds.apply(record)
+		if seq, err := strconv.Atoi(record.Letter.Id); err == nil && seq > ds.seq {
+			ds.seq = seq
+		}
+	}
+	err = ds.compact()
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+/* the method closes the journal, the store is in memory after closing */
+func (ds *DeadLetterStore) DeadLetterStore_close() error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	if ds.file == nil {
+		return nil
+	}
+	err := ds.file.Close()
+	ds.file = nil
+	return err
+}
+
+/*
+the method puts the letter to the store, and returns the id of the dead letter. The Id of the letter is
+assigned, and the Time is now if it is zero. The letter is not stored and the error is returned, if the
+persistent store unable to write it.
+*/
+func (ds *DeadLetterStore) DeadLetterStore_put(letter DeadLetter) (string, error) {
+	letter.rawnode = nil
+	return ds.put(letter, false)
+}
+
+/* the method returns all the dead letters, the oldest is the first one */
+func (ds *DeadLetterStore) DeadLetterStore_list() []DeadLetter {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	letters := make([]DeadLetter, 0, ds.letters.Len())
+	for e := ds.letters.Front(); e != nil; e = e.Next() {
+		letters = append(letters, *e.Value.(*DeadLetter))
+	}
+	return letters
+}
+
+func (ds *DeadLetterStore) DeadLetterStore_get(id string) (DeadLetter, bool) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	e := ds.find(id)
+	if e == nil {
+		return DeadLetter{}, false
+	}
+	return *e.Value.(*DeadLetter), true
+}
+
+/* the method drops the dead letter, the rawnode parked is done in the write-ahead log */
+func (ds *DeadLetterStore) DeadLetterStore_discard(id string) bool {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	e := ds.find(id)
+	if e == nil {
+		return false
+	}
+	ds.letters.Remove(e)
+	if rawnode := e.Value.(*DeadLetter).rawnode; rawnode != nil {
+		wal_done(rawnode)
+	}
+	ds.journal_log(deadletter_record{Op: deadletter_remove, Letter: DeadLetter{Id: id}})
+	return true
+}
+
+/*
+the method handles the dead letter again by the handler. The dead letter is removed from the store, if the
+handler is successful. Otherwise the reason is updated and the dead letter is kept.
+*/
+func (ds *DeadLetterStore) DeadLetterStore_replay(id string, handler func(letter DeadLetter) error) error {
+	letter, ok := ds.DeadLetterStore_get(id)
+	if !ok {
+		return fmt.Errorf("the dead letter %s is not found", id)
+	}
+
+	err := handler(letter)
+
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	e := ds.find(id)
+	if e == nil {
+		/* the dead letter is discarded while replaying */
+		return err
+	}
+	if err != nil {
+		e.Value.(*DeadLetter).Reason = err.Error()
+		e.Value.(*DeadLetter).Replays++
+		ds.journal_log(deadletter_record{Op: deadletter_set, Letter: *e.Value.(*DeadLetter)})
+		return err
+	}
+	ds.letters.Remove(e)
+	ds.journal_log(deadletter_record{Op: deadletter_remove, Letter: DeadLetter{Id: id}})
+	return nil
+}
+
+/*
+the method puts the letter to the store. The letter unable to write the journal is kept in memory if the keep
+is true, and the error is still returned.
+*/
+func (ds *DeadLetterStore) put(letter DeadLetter, keep bool) (string, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	letter.Id = strconv.Itoa(ds.seq + 1)
+	if letter.Time.IsZero() {
+		letter.Time = time.Now()
+	}
+	err := ds.journal(deadletter_record{Op: deadletter_set, Letter: letter})
+	if err != nil && !keep {
+		return "", err
+	}
+	ds.seq++
+	ds.apply(deadletter_record{Op: deadletter_set, Letter: letter})
+	ds.journal_compact()
+
+	return letter.Id, err
+}
+
+/* the method returns true, if the dead letters are written to the journal */
+func (ds *DeadLetterStore) persistent() bool {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	return ds.file != nil
+}
+
+func (ds *DeadLetterStore) find(id string) *list.Element {
+	for e := ds.letters.Front(); e != nil; e = e.Next() {
+		if e.Value.(*DeadLetter).Id == id {
+			return e
+		}
+	}
+	return nil
+}
+
+/* the method applies the record to the letters, the oldest dead letter is dropped while the store is full */
+func (ds *DeadLetterStore) apply(record deadletter_record) {
+	e := ds.find(record.Letter.Id)
+	switch record.Op {
+	case deadletter_set:
+		letter := record.Letter
+		if e != nil {
+			e.Value = &letter
+			return
+		}
+		ds.letters.PushBack(&letter)
+		if ds.letters.Len() > ds.max {
+			dropped := ds.letters.Remove(ds.letters.Front()).(*DeadLetter)
+			log.Printf("The dead letter is full, the dead letter %s of %s%s is dropped!\n\r", dropped.Id, dropped.Route, dropped.Topic)
+			if dropped.rawnode != nil {
+				wal_done(dropped.rawnode)
+			}
+		}
+	case deadletter_remove:
+		if e != nil {
+			ds.letters.Remove(e)
+		}
+	}
+}
+
+/* the method appends the record to the journal, the lock must be held */
+func (ds *DeadLetterStore) journal(record deadletter_record) error {
+	if ds.file == nil {
+		return nil
+	}
+	err := deadletter_write(ds.file, record)
+	if err == nil {
+		err = ds.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	ds.records++
+	return nil
+}
+
+/* the method rewrites the journal while it holds twice the max records, the lock must be held */
+func (ds *DeadLetterStore) journal_compact() {
+	if ds.file == nil || ds.records < 2*ds.max {
+		return
+	}
+	err := ds.compact()
+	if err != nil {
+		log.Printf("The dead letter journal unable to compact: %s\n\r", err.Error())
+	}
+}
+
+/* the method is the same as the journal, but the error is logged, the change is kept in memory until the restart */
+func (ds *DeadLetterStore) journal_log(record deadletter_record) {
+	err := ds.journal(record)
+	if err != nil {
+		log.Printf("The dead letter %s unable to write the journal: %s\n\r", record.Letter.Id, err.Error())
+	}
+	ds.journal_compact()
+}
+
+/*
+the method rewrites the journal with the dead letters kept, the lock must be held. The journal opened is kept,
+if the rewriting is failed.
+*/
+func (ds *DeadLetterStore) compact() error {
+	path := filepath.Join(ds.dir, DEADLETTER_FILE_NAME)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for e := ds.letters.Front(); e != nil && err == nil; e = e.Next() {
+		err = deadletter_write(writer, deadletter_record{Op: deadletter_set, Letter: *e.Value.(*DeadLetter)})
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	/* the directory is synced, so the renaming survives the crash of the system */
+	err = wal_sync_dir(ds.dir)
+	if err != nil {
+		return err
+	}
+
+	file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if ds.file != nil {
+		ds.file.Close()
+	}
+	ds.file = file
+	ds.records = ds.letters.Len()
+
+	return nil
+}
+
+/* the function writes the record framed by the length and the crc32 of the gob encoded data */
+func deadletter_write(writer io.Writer, record deadletter_record) error {
+	var data bytes.Buffer
+	err := gob.NewEncoder(&data).Encode(record)
+	if err != nil {
+		return err
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(data.Len()))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(data.Bytes()))
+	_, err = writer.Write(append(header[:], data.Bytes()...))
+	return err
+}
+
+/* the function reads the records of the journal, the reading stops at the first broken record */
+func deadletter_read(path string) ([]deadletter_record, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []deadletter_record
+	reader := bufio.NewReader(file)
+	for {
+		var header [8]byte
+		_, err = io.ReadFull(reader, header[:])
+		if err != nil {
+			break
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		_, err = io.ReadFull(reader, data)
+		if err != nil || crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+			log.Printf("The dead letter journal %s is broken at the record %d, the following records are ignored.\n\r", path, len(records))
+			break
+		}
+		var record deadletter_record
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&record)
+		if err != nil {
+			log.Printf("The dead letter journal %s unable to decode the record %d: %s\n\r", path, len(records), err.Error())
+			break
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+/*
+the function opens the dead letter store of the broker in the dir, so the rawnodes parked and the messages
+quarantined survive the restart. It should be called before the Broker_start, the dead letters in memory are
+not moved to the store opened.
+*/
+func (b *Broker) DeadLetter_open(dir string) error {
+	store, err := DeadLetterStore_open(dir, DEFAULT_DEADLETTER_SIZE)
+	if err != nil {
+		return err
+	}
+	b.deadletter_lock.Lock()
+	b.deadletters = store
+	b.deadletter_lock.Unlock()
+	return nil
+}
+
+/* the function closes the journal of the dead letter store, the store is in memory after closing */
+func (b *Broker) DeadLetter_close() error {
+	return b.DeadLetter_store().DeadLetterStore_close()
+}
+
+/* the function returns the dead letter store of the broker, which the sources quarantine the messages to */
+func (b *Broker) DeadLetter_store() *DeadLetterStore {
+	b.deadletter_lock.Lock()
+	defer b.deadletter_lock.Unlock()
+
+	return b.deadletters
+}
+
+/*
+the function parks the rawnode in the dead letter store, the oldest dead letter is dropped if the store is full.
+The rawnode is done in the write-ahead log after it is journaled by the persistent store, otherwise it is kept
+in the log to be replayed after restarting.
+*/
+func (b *Broker) DeadLetter_park(rawnode *RawNode) {
+	rawnode.Parked = b.clock.Now()
+	letter := DeadLetter{
+		Route:    rawnode.Id,
+		Task:     rawnode.task,
+		Key:      rawnode.Key,
+		Raw:      rawnode.Raw,
+		Attempts: rawnode.Attempts,
+		Time:     rawnode.Parked,
+		rawnode:  rawnode,
+	}
+	if rawnode.Failure != nil {
+		letter.Reason = rawnode.Failure.Error()
+	}
+	store := b.DeadLetter_store()
+	_, err := store.put(letter, true)
+	if err != nil {
+		log.Printf("The rawnode named %s unable to write the dead letter journal, it is kept in memory: %s\n\r", rawnode.Id, err.Error())
+		return
+	}
+	atomic.AddInt64(&b.parked, 1)
+	if store.persistent() {
+		wal_done(rawnode)
+	}
+}
+
+/* the function returns the rawnodes parked in the dead letter store, the oldest is the first one */
+func (b *Broker) DeadLetter_list() []*RawNode {
+	var rawnodes []*RawNode
+	for _, letter := range b.DeadLetter_store().DeadLetterStore_list() {
+		if letter.Route != "" {
+			rawnodes = append(rawnodes, deadletter_rawnode(letter))
+		}
+	}
+	return rawnodes
+}
+
+/*
+the function sends a fresh copy of the rawnode parked as the dead letter named id to the router again, or offers
+it to the task of its subscriber if it is a copy fanned out, which has neither the Admit nor the attempts. The dead letter is kept with the error, if the
+rawnode unable to send.
+*/
+func (b *Broker) DeadLetter_replay(id string) error {
+	return b.DeadLetter_store().DeadLetterStore_replay(id, func(letter DeadLetter) error {
+		if letter.Route == "" {
+			return fmt.Errorf("the dead letter %s is not a rawnode", letter.Id)
+		}
+		/* a fresh copy is sent, the parked rawnode was admitted already and it is still listed until the replay is done */
+		rawnode := RawNode_create_key(letter.Route, letter.Key, letter.Raw)
+		rawnode.task = letter.Task
+		if rawnode.task != "" {
+			return b.deadletter_offer(rawnode)
+		}
+		return b.Send(rawnode)
+	})
+}
+
+/* the function offers the copy fanned out to the task of its subscriber directly, the rate limits are skipped */
+func (b *Broker) deadletter_offer(rawnode *RawNode) error {
+	procenode := b.ProceNode_find(rawnode.task)
+	if procenode == nil {
+		return fmt.Errorf("%w: the procenode %s is not found", ErrNoRoute, rawnode.task)
+	}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	err := b.wal_append(rawnode)
+	if err != nil {
+		return err
+	}
+	return b.router_offer(rawnode, rawnode.task, procenode)
+}
+
+/*
+the function sends the parked rawnodes matched by the filter to the router again, the attempts of them are reset.
+The filter nil matches all the rawnodes. It returns the number of the re-driven rawnodes.
+*/
+func (b *Broker) DeadLetter_redrive(filter func(*RawNode) bool) int {
+	redriven := 0
+	for _, letter := range b.deadletter_match(filter) {
+		if b.DeadLetter_replay(letter.Id) == nil {
+			redriven++
+		}
+	}
+	return redriven
+}
+
+/* the function drops the parked rawnodes matched by the filter. The filter nil matches all the rawnodes. */
+func (b *Broker) DeadLetter_discard(filter func(*RawNode) bool) int {
+	discarded := 0
+	for _, letter := range b.deadletter_match(filter) {
+		if b.DeadLetter_store().DeadLetterStore_discard(letter.Id) {
+			discarded++
+		}
+	}
+	return discarded
+}
+
+/* the function returns the dead letters of the rawnodes matched by the filter */
+func (b *Broker) deadletter_match(filter func(*RawNode) bool) []DeadLetter {
+	var matched []DeadLetter
+	for _, letter := range b.DeadLetter_store().DeadLetterStore_list() {
+		if letter.Route != "" && (filter == nil || filter(deadletter_rawnode(letter))) {
+			matched = append(matched, letter)
+		}
+	}
+	return matched
+}
+
+/* the function returns the rawnode parked as the letter, it is created again if the store is reopened */
+func deadletter_rawnode(letter DeadLetter) *RawNode {
+	if letter.rawnode != nil {
+		return letter.rawnode
+	}
+	rawnode := RawNode_create_key(letter.Route, letter.Key, letter.Raw)
+	rawnode.task = letter.Task
+	rawnode.Attempts = letter.Attempts
+	rawnode.Parked = letter.Time
+	if letter.Reason != "" {
+		rawnode.Failure = errors.New(letter.Reason)
+	}
+	return rawnode
+}
+
+func DeadLetter_open(dir string) error {
+	return global_broker.DeadLetter_open(dir)
+}
+
+func DeadLetter_close() error {
+	return global_broker.DeadLetter_close()
+}
+
+func DeadLetter_store() *DeadLetterStore {
+	return global_broker.DeadLetter_store()
+}
+
+func DeadLetter_park(rawnode *RawNode) {
+	global_broker.DeadLetter_park(rawnode)
+}
+
+func DeadLetter_list() []*RawNode {
+	return global_broker.DeadLetter_list()
+}
+
+func DeadLetter_replay(id string) error {
+	return global_broker.DeadLetter_replay(id)
+}
+
+func DeadLetter_redrive(filter func(*RawNode) bool) int {
+	return global_broker.DeadLetter_redrive(filter)
+}
+
+func DeadLetter_discard(filter func(*RawNode) bool) int {
+	return global_broker.DeadLetter_discard(filter)
+}
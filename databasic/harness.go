@@ -0,0 +1,236 @@
+package databasic
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+The Harness runs a broker in the test mode. The broker is not started, so no router, scheduler or task go routine
+is running, and the rawnodes are routed and processed one by one in the go routine calling the Harness_step or the
+Harness_drain. The broker uses a VirtualClock, which is advanced to the next timer while the processing is blocked
+on it, e.g. the backoff of a retry, so the tests never sleep. The procenodes registered by the Harness_register
+are recorded by the Recorder, which tells which procenode got which rawnodes in what order.
+
+The task of the highest priority is stepped at first, and the tasks having the same priority are stepped in turn.
+The rawnodes of a pool are processed one by one in the order of the buffer.
+*/
+var HARNESS_START = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC) /* the start time of the virtual clock */
+
+type Harness struct {
+	Broker   *Broker
+	Clock    *VirtualClock
+	Recorder *Recorder
+
+	next int /* the index of the task stepped next among the tasks having the same priority */
+}
+
+/* the record of a calling of the procenode registered by the Harness_register */
+type Record struct {
+	Procenode string
+	Tasknode  string
+	Rawnode   string
+	Raw       interface{}
+	Attempt   int
+	Err       error
+	Time      time.Time /* the time of the virtual clock while the calling returns */
+}
+
+/* the Recorder records the callings in order, it is safe to be used by several go routines */
+type Recorder struct {
+	lock    sync.Mutex
+	records []Record
+	clock   Clock
+}
+
+/* the function creates a harness running a broker, the raw_size and the running_max are the same as the Broker_create. */
+func Harness_create(raw_size int, running_max int) *Harness {
+	harness := new(Harness)
+	harness.Broker = Broker_create(raw_size, running_max)
+	harness.Clock = VirtualClock_create(HARNESS_START)
+	harness.Broker.Broker_set_clock(harness.Clock)
+	harness.Recorder = &Recorder{clock: harness.Clock}
+
+	return harness
+}
+
+/* the method registers a procenode recorded by the Recorder, the operation is the same as the ProceNode_register. */
+func (h *Harness) Harness_register(operation interface{}, id string) *ProceNode {
+	processor, err := processor_adapt(operation)
+	if err != nil {
+		return nil
+	}
+	return h.Broker.ProceNode_register(h.Recorder.Recorder_wrap(id, processor), id)
+}
+
+/* the method sends the rawnode to the broker, it returns false if the raw channel is full or the wal is failed. */
+func (h *Harness) Harness_send(rawnode *RawNode) bool {
+	if len(h.Broker.raw_channel) == cap(h.Broker.raw_channel) || h.Broker.wal_append(rawnode) != nil {
+		return false
+	}
+	h.Broker.raw_channel <- rawnode
+	return true
+}
+
+/*
+the method does one step of the broker, which reaps the idle tasks and injects the due jobs, releases the rawnodes delayed by the rate
+limit, handles a monitor, routes a rawnode of the raw channel, or processes a rawnode of a task in the order. The virtual clock is
+advanced to the next delayed rawnode, if nothing else is done. It returns false, if nothing is done.
+*/
+func (h *Harness) Harness_step() bool {
+	/* the tasks quiet at the time of the virtual clock are reaped, and the due jobs are injected at first */
+	h.Broker.task_reap_all(h.Clock.Now())
+	if injected, _ := h.Broker.job_inject(h.Clock.Now()); injected > 0 {
+		return true
+	}
+	/* the rawnodes delayed by the rate limit are released at the time of the virtual clock */
+	if next := h.Broker.ratelimit_next(); !next.IsZero() && !next.After(h.Clock.Now()) {
+		h.harness_run(func() { h.Broker.ratelimit_release(h.Clock.Now()) })
+		return true
+	}
+
+	select {
+	case monitor := <-h.Broker.monitor_channel:
+		monitor.monitor_ack(h.Broker.controler_handle(monitor))
+		return true
+	default:
+	}
+
+	select {
+	case rawnode := <-h.Broker.raw_channel:
+		h.harness_run(func() {
+			if h.Broker.router_limit(rawnode) {
+				h.Broker.router_route(rawnode)
+			}
+		})
+		return true
+	default:
+	}
+
+	tasknode, rawnode := h.harness_next()
+	if tasknode == nil {
+		/* the virtual clock is advanced to the next delayed rawnode, while nothing else is done */
+		if next := h.Broker.ratelimit_next(); !next.IsZero() {
+			h.Clock.Advance(next.Sub(h.Clock.Now()))
+			return true
+		}
+		return false
+	}
+	h.harness_run(func() { task_handle(tasknode, rawnode) })
+	return true
+}
+
+/* the method steps the broker until nothing is done, and returns the number of steps. */
+func (h *Harness) Harness_drain() int {
+	steps := 0
+	for h.Harness_step() {
+		steps++
+	}
+	return steps
+}
+
+/* the method returns the next task to be stepped and the rawnode received from its buffer */
+func (h *Harness) harness_next() (*TaskNode, *RawNode) {
+	tasknodes := h.Broker.tasknode_registry.list()
+	var candidates []*TaskNode
+	priority := 0
+	for _, tasknode := range tasknodes {
+		if tasknode.TaskNode_method() == nil || tasknode.TaskNode_is_paused() {
+			continue
+		}
+		tasknode.task_unspill()
+		if len(tasknode.TaskNode_buffer()) == 0 {
+			continue
+		}
+		task_priority, _ := tasknode.TaskNode_priority()
+		if len(candidates) == 0 || task_priority > priority {
+			candidates = candidates[:0]
+			priority = task_priority
+		} else if task_priority < priority {
+			continue
+		}
+		candidates = append(candidates, tasknode)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	tasknode := candidates[h.next%len(candidates)]
+	h.next++
+	select {
+	case rawnode, ok := <-tasknode.TaskNode_buffer():
+		if ok {
+			tasknode.task_signal_space()
+			return tasknode, rawnode
+		}
+	default:
+	}
+	return nil, nil
+}
+
+/*
+the method runs the operation and waits for it. The virtual clock is advanced to the next timer, while the
+operation is blocked on the clock, which is marked by the clock_block.
+*/
+func (h *Harness) harness_run(operation func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		operation()
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case <-h.Clock.waiting:
+			h.Clock.advance_next()
+		}
+	}
+}
+
+/* the method wraps the processor of the procenode named id, the callings of it are recorded. */
+func (r *Recorder) Recorder_wrap(id string, processor Processor) Processor {
+	return ProcessorFunc(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		err := processor.Process(ctx, tasknode, rawnode)
+		r.lock.Lock()
+		r.records = append(r.records, Record{
+			Procenode: id,
+			Tasknode:  tasknode.Id,
+			Rawnode:   rawnode.Id,
+			Raw:       rawnode.Raw,
+			Attempt:   rawnode.Attempts,
+			Err:       err,
+			Time:      r.clock.Now(),
+		})
+		r.lock.Unlock()
+		return err
+	})
+}
+
+/* the method returns the records of all the callings in order */
+func (r *Recorder) Recorder_records() []Record {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]Record(nil), r.records...)
+}
+
+/* the method returns the Raw of the rawnodes processed successfully by the procenode named id in order */
+func (r *Recorder) Recorder_raws(id string) []interface{} {
+	var raws []interface{}
+	for _, record := range r.Recorder_records() {
+		if record.Procenode == id && record.Err == nil {
+			raws = append(raws, record.Raw)
+		}
+	}
+	return raws
+}
+
+/* the method removes all the records */
+func (r *Recorder) Recorder_reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.records = nil
+}
@@ -0,0 +1,462 @@
+package databasic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A job injects a rawnode into a route on a timer instead of on arrival, e.g. polling the device states, refreshing
+the thing models or computing the hourly rollups. The schedule of a job is a cron expression of five fields
+"minute hour day-of-month month day-of-week", a descriptor such as "@hourly", or a fixed interval "@every 5m".
+Each run is delayed by a random jitter up to the one set by the Job_set_jitter, so the jobs of several services do not run
+at the same instant.
+
+A run is finished while its rawnode is processed, failed or dropped, and the result is kept in the history of
+the job. The run is skipped, if the previous run is not finished at the time, so a slow job never piles up. The
+rawnodes of the jobs are injected by the injector go routine of the broker, or by the Harness_step in the test
+mode. The rawnode of a job is handled like a call, so it is neither parked in the dead letter nor logged in the
+write-ahead log.
+*/
+const (
+	MAX_JOB_NUMBER      int           = 100
+	DEFAULT_JOB_HISTORY int           = 100
+	DEFAULT_JOB_TIMEOUT time.Duration = time.Hour /* the max time of a run, the run is canceled after it */
+	JOB_SEARCH_YEARS    int           = 5         /* the cron expression matching no time in the years is invalid */
+)
+
+var (
+	/* the error is recorded, if the rawnode of a run is unable to inject */
+	ErrJobInject = errors.New("the rawnode of the job unable to inject")
+)
+
+type Job struct {
+	Id       string
+	Route    string
+	Key      string
+	Schedule string
+
+	broker  *Broker
+	payload interface{} /* the Raw of the rawnodes, the func() interface{} is called for each run */
+	cron    *cron_schedule
+	every   time.Duration
+
+	lock    sync.Mutex
+	jitter  time.Duration
+	timeout time.Duration
+	random  *rand.Rand
+	next    time.Time /* the time of the next run including the jitter */
+	running bool
+	history []JobRun
+
+	Stat_runs    int64
+	Stat_skipped int64
+	Stat_failed  int64
+}
+
+/* the record of a run of the job */
+type JobRun struct {
+	Scheduled time.Time `json:"scheduled"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Skipped   bool      `json:"skipped"` /* the run is skipped, because the previous run is not finished */
+	Error     string    `json:"error,omitempty"`
+}
+
+/*
+the function registers a job injecting the payload into the route by the schedule. The payload can be a
+func() interface{}, which is called for each run. The first run is the next time matching the schedule.
+*/
+func (b *Broker) Job_register(id string, route string, schedule string, payload interface{}) (*Job, error) {
+	if id == "" || route == "" {
+		return nil, errors.New("argument error")
+	}
+	job := &Job{
+		Id:       id,
+		Route:    route,
+		Schedule: schedule,
+		broker:   b,
+		payload:  payload,
+		timeout:  DEFAULT_JOB_TIMEOUT,
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if strings.HasPrefix(schedule, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(schedule, "@every ")))
+		if err != nil || every <= 0 {
+			return nil, fmt.Errorf("the interval of the schedule %q is invalid", schedule)
+		}
+		job.every = every
+	} else {
+		cron, err := cron_parse(schedule)
+		if err != nil {
+			return nil, err
+		}
+		job.cron = cron
+	}
+	job.next = job.job_next(b.clock.Now())
+	if job.next.IsZero() {
+		return nil, fmt.Errorf("the schedule %q matches no time in %d years", schedule, JOB_SEARCH_YEARS)
+	}
+
+	if !b.job_registry.add(id, job) {
+		return nil, fmt.Errorf("the job %s exists or the jobs are too many", id)
+	}
+	b.job_wakeup()
+	return job, nil
+}
+
+func (b *Broker) Job_find(id string) *Job {
+	job, ok := b.job_registry.find(id)
+	if !ok {
+		return nil
+	}
+	return job
+}
+
+func Job_register(id string, route string, schedule string, payload interface{}) (*Job, error) {
+	return global_broker.Job_register(id, route, schedule, payload)
+}
+
+func Job_find(id string) *Job {
+	return global_broker.Job_find(id)
+}
+
+/* the method unregisters the job, the running run is not canceled. */
+func (job *Job) Job_unregister() bool {
+	ok := job.broker.job_registry.remove(job.Id, job)
+	if !ok {
+		return false
+	}
+	return true
+}
+
+/* the method sets the max random delay of each run, the next run is rescheduled. */
+func (job *Job) Job_set_jitter(jitter time.Duration) bool {
+	if jitter < 0 {
+		return false
+	}
+	job.lock.Lock()
+	job.jitter = jitter
+	job.next = job.job_next(job.broker.clock.Now())
+	job.lock.Unlock()
+	job.broker.job_wakeup()
+	return true
+}
+
+/* the method sets the max time of a run, the run is canceled and failed after it. */
+func (job *Job) Job_set_timeout(timeout time.Duration) bool {
+	if timeout <= 0 {
+		return false
+	}
+	job.lock.Lock()
+	job.timeout = timeout
+	job.lock.Unlock()
+	return true
+}
+
+/* the method sets the RawNode.Key of the rawnodes, e.g. the device name used by the rate limit and the pool */
+func (job *Job) Job_set_key(key string) {
+	job.lock.Lock()
+	job.Key = key
+	job.lock.Unlock()
+}
+
+/* the method returns the time of the next run */
+func (job *Job) Job_next() time.Time {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	return job.next
+}
+
+/* the method returns the history of the latest runs, the oldest one is the first. */
+func (job *Job) Job_history() []JobRun {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	return append([]JobRun(nil), job.history...)
+}
+
+/* the method returns the time of the run after the now including the jitter, it returns zero if no time matches. */
+func (job *Job) job_next(now time.Time) time.Time {
+	var next time.Time
+	if job.every > 0 {
+		next = now.Add(job.every)
+	} else {
+		next = job.cron.next(now)
+	}
+	if !next.IsZero() && job.jitter > 0 {
+		next = next.Add(time.Duration(job.random.Int63n(int64(job.jitter))))
+	}
+	return next
+}
+
+/* the method records the run in the history, the oldest run is dropped while the history is full. */
+func (job *Job) job_record(run JobRun) {
+	if len(job.history) >= DEFAULT_JOB_HISTORY {
+		job.history = job.history[1:]
+	}
+	job.history = append(job.history, run)
+}
+
+/* the function wakes up the injector, the schedule of the jobs is changed. */
+func (b *Broker) job_wakeup() {
+	select {
+	case b.job_wake <- struct{}{}:
+	default:
+	}
+}
+
+/*
+the injector injects the rawnodes of the due jobs, and waits for the next run of the jobs. It is woken up
+while a job is registered or rescheduled, and it returns after the broker is shut down.
+*/
+func (b *Broker) Injector() {
+	for {
+		now := b.clock.Now()
+		_, next := b.job_inject(now)
+
+		var timer <-chan time.Time
+		stop := func() bool { return false }
+		if !next.IsZero() {
+			timer, stop = b.clock.Timer(next.Sub(now))
+		}
+		select {
+		case <-timer:
+		case <-b.job_wake:
+		case <-b.done:
+			stop()
+			return
+		}
+		stop()
+	}
+}
+
+/* the function runs the jobs due at the now. It returns the number of injected rawnodes and the time of the earliest next run. */
+func (b *Broker) job_inject(now time.Time) (int, time.Time) {
+	injected := 0
+	var earliest time.Time
+	for _, job := range b.job_registry.list() {
+		job.lock.Lock()
+		if !job.next.After(now) {
+			scheduled := job.next
+			job.next = job.job_next(now)
+			if job.running {
+				job.Stat_skipped++
+				job.job_record(JobRun{Scheduled: scheduled, Skipped: true})
+				log.Printf("The job %s is skipped, because the previous run is not finished!\n\r", job.Id)
+			} else {
+				job.running = true
+				job.Stat_runs++
+				job.lock.Unlock()
+				if job.job_run(scheduled, now) {
+					injected++
+				}
+				job.lock.Lock()
+			}
+		}
+		if earliest.IsZero() || (!job.next.IsZero() && job.next.Before(earliest)) {
+			earliest = job.next
+		}
+		job.lock.Unlock()
+	}
+	return injected, earliest
+}
+
+/*
+the method injects the rawnode of a run into the raw channel without blocking, the run is finished by the reply
+future while the rawnode is processed, or while the timeout is over even if the processor ignoring the ctx is
+still running, so the following runs are not skipped for ever. It returns false, if the rawnode is unable to inject.
+*/
+func (job *Job) job_run(scheduled time.Time, now time.Time) bool {
+	b := job.broker
+	job.lock.Lock()
+	timeout, key := job.timeout, job.Key
+	job.lock.Unlock()
+
+	payload := job.payload
+	if produce, ok := payload.(func() interface{}); ok {
+		payload = produce()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	run := JobRun{Scheduled: scheduled, Started: now}
+	future := &reply_future{done: make(chan struct{}), ctx: ctx}
+	future.then = func(reply interface{}, err error) {
+		cancel()
+		run.Finished = b.clock.Now()
+		job.lock.Lock()
+		defer job.lock.Unlock()
+		/* the rawnode processed without reply is the success of a job */
+		if err != nil && !errors.Is(err, ErrNoReply) {
+			job.Stat_failed++
+			run.Error = err.Error()
+		}
+		job.running = false
+		job.job_record(run)
+	}
+	/* the future completed already ignores it, while the ctx is canceled by the then */
+	context.AfterFunc(ctx, func() {
+		future.complete(nil, fmt.Errorf("the run of the job %s is not finished: %w", job.Id, ctx.Err()))
+	})
+	rawnode := RawNode_create_key(job.Route, key, payload)
+	rawnode.reply = future
+	rawnode.Admit = func(rawnode *RawNode, err error) {
+		if err != nil {
+			future.complete(nil, err)
+		}
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.closed {
+		future.complete(nil, fmt.Errorf("%w: %s", ErrJobInject, ErrBrokerClosed))
+		return false
+	}
+	select {
+	case b.raw_channel <- rawnode:
+		return true
+	default:
+		future.complete(nil, fmt.Errorf("%w: the raw channel is full", ErrJobInject))
+		return false
+	}
+}
+
+/* the schedule of a cron expression, each field is the set of matching values */
+type cron_schedule struct {
+	minute [60]bool
+	hour   [24]bool
+	dom    [32]bool
+	month  [13]bool
+	dow    [7]bool
+	/* the day matches either the day-of-month or the day-of-week, if both of them are restricted */
+	dom_any bool
+	dow_any bool
+}
+
+var cron_descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+/* the function parses the cron expression, the field supports "*", "a", "a-b", "*\/n", "a-b/n" and the lists of them. */
+func cron_parse(expression string) (*cron_schedule, error) {
+	if descriptor, ok := cron_descriptors[strings.TrimSpace(expression)]; ok {
+		expression = descriptor
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("the cron expression %q has %d fields, want 5", expression, len(fields))
+	}
+	cron := new(cron_schedule)
+	var err error
+	if err = cron_field(fields[0], 0, 59, cron.minute[:]); err != nil {
+		return nil, err
+	}
+	if err = cron_field(fields[1], 0, 23, cron.hour[:]); err != nil {
+		return nil, err
+	}
+	if err = cron_field(fields[2], 1, 31, cron.dom[:]); err != nil {
+		return nil, err
+	}
+	if err = cron_field(fields[3], 1, 12, cron.month[:]); err != nil {
+		return nil, err
+	}
+	/* the 7 of the day-of-week is the Sunday as the 0 */
+	var dow [8]bool
+	if err = cron_field(fields[4], 0, 7, dow[:]); err != nil {
+		return nil, err
+	}
+	copy(cron.dow[:], dow[:7])
+	cron.dow[0] = cron.dow[0] || dow[7]
+	/* the field starting with "*", e.g. "*\/2", is unrestricted as the cron does */
+	cron.dom_any = strings.HasPrefix(fields[2], "*")
+	cron.dow_any = strings.HasPrefix(fields[4], "*")
+	return cron, nil
+}
+
+func cron_field(field string, min int, max int, values []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if index := strings.Index(part, "/"); index >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[index+1:])
+			if err != nil || step < 1 {
+				return fmt.Errorf("the step of the cron field %q is invalid", field)
+			}
+			part = part[:index]
+		}
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			low, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return fmt.Errorf("the cron field %q is invalid", field)
+			}
+			high = low
+			if len(bounds) == 2 {
+				high, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return fmt.Errorf("the cron field %q is invalid", field)
+				}
+			} else if step > 1 {
+				/* the "a/n" means from a to the max */
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return fmt.Errorf("the cron field %q is out of the range %d-%d", field, min, max)
+		}
+		for value := low; value <= high; value += step {
+			values[value] = true
+		}
+	}
+	return nil
+}
+
+func (cron *cron_schedule) day_match(t time.Time) bool {
+	dom := cron.dom[t.Day()]
+	dow := cron.dow[t.Weekday()]
+	if cron.dom_any || cron.dow_any {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+/* the method returns the first time matching the schedule after the t, or zero if no time matches in JOB_SEARCH_YEARS. */
+func (cron *cron_schedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(JOB_SEARCH_YEARS, 0, 0)
+	for t.Before(limit) {
+		if !cron.month[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.day_match(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
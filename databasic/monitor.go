@@ -1,17 +1,108 @@
 package databasic
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+The Monitor is a command of the control plane, which is sent by Send_mon and handled by the Controler. The
+Operation is one of the op codes declared in the broker.go, and the Information is the argument of the command.
+The Controler sends the result of the command to the Ack, the nil means the command is done.
+*/
 type Monitor struct {
 	Operation   int
 	Information interface{}
 	Tasknode    *TaskNode
+
+	Ack chan error /* the channel receives the acknowledgment of the command, it is buffered so the Controler never blocks */
 }
 
+var (
+	/* the error is acknowledged, if the op code of the monitor is not supported by the Controler */
+	ErrMonitorOperation = errors.New("the operation of monitor is not supported")
+	/* the error is acknowledged, if the information of the monitor is not the type required by the op code */
+	ErrMonitorInformation = errors.New("the information of monitor is invalid")
+	/* the error is returned by Monitor_wait, if the acknowledgment is not received before the timeout */
+	ErrMonitorTimeout = errors.New("the acknowledgment of monitor is timeout")
+	/* the error fails the rawnodes left in the task unregistered by the Unregister monitor */
+	ErrTaskUnregistered = errors.New("the task is unregistered")
+)
+
 func Monitor_Create(tasknode *TaskNode, information interface{}, operation int) *Monitor {
 	monitor := new(Monitor)
 
 	monitor.Tasknode = tasknode
 	monitor.Information = information
 	monitor.Operation = operation
+	monitor.Ack = make(chan error, 1)
 
 	return monitor
 }
+
+/*
+the function sends the monitor of the operation to the task named id, and waits for the acknowledgment until the
+ctx is done. It is the control plane used outside the package, e.g. by the http server, so it never blocks on the
+monitor channel full or the broker shut down.
+*/
+func (b *Broker) Monitor_send(ctx context.Context, id string, operation int, information interface{}) error {
+	select {
+	case <-b.done:
+		return ErrBrokerClosed
+	default:
+	}
+	tasknode := b.TaskNode_find(id)
+	if tasknode == nil {
+		return fmt.Errorf("%w: the task %s is not found", ErrMonitorInformation, id)
+	}
+	monitor := Monitor_Create(tasknode, information, operation)
+
+	select {
+	case b.monitor_channel <- monitor:
+	case <-b.done:
+		return ErrBrokerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-monitor.Ack:
+		return err
+	case <-b.done:
+		return ErrBrokerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func Monitor_send(ctx context.Context, id string, operation int, information interface{}) error {
+	return global_broker.Monitor_send(ctx, id, operation, information)
+}
+
+/* the method waits for the acknowledgment of the monitor. The timeout 0 means waiting forever. */
+func (mon *Monitor) Monitor_wait(timeout time.Duration) error {
+	if timeout <= 0 {
+		return <-mon.Ack
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-mon.Ack:
+		return err
+	case <-timer.C:
+		return ErrMonitorTimeout
+	}
+}
+
+/* the method acknowledges the monitor, the acknowledgment is dropped if nobody waits for it. */
+func (mon *Monitor) monitor_ack(err error) {
+	if mon.Ack == nil {
+		return
+	}
+	select {
+	case mon.Ack <- err:
+	default:
+	}
+}
@@ -0,0 +1,350 @@
+package databasic
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+the following const is the modes of overflow policy, which decides how the router handles the rawnode while
+the task buffer is full.
+OVERFLOW_DROP_NEWEST drops the arriving rawnode, it is the default mode.
+OVERFLOW_BLOCK blocks the router until the buffer has space or the Timeout, the rawnode is dropped after the Timeout.
+The rawnodes of all the other routes wait while the router is blocked, so the interactive routes, e.g. the calls
+of the http requests, should use the OVERFLOW_REJECT to fail fast instead.
+OVERFLOW_DROP_OLDEST drops the oldest rawnode in the buffer to make space for the arriving one.
+OVERFLOW_REJECT rejects the arriving rawnode back to the source by the RawNode.Admit, e.g. the amqp releases the message.
+OVERFLOW_SPILL writes the rawnode to the Spill_dir, the spilled rawnodes are reloaded in order while the buffer has space.
+*/
+const (
+	OVERFLOW_DROP_NEWEST int = 1
+	OVERFLOW_BLOCK       int = 2
+	OVERFLOW_DROP_OLDEST int = 3
+	OVERFLOW_REJECT      int = 4
+	OVERFLOW_SPILL       int = 5
+)
+
+/* the following const should be cared by user */
+const (
+	DEFAULT_OVERFLOW_TIMEOUT time.Duration = time.Second
+)
+
+type OverflowPolicy struct {
+	Mode      int
+	Timeout   time.Duration /* the max time of blocking in the OVERFLOW_BLOCK, 0 means the DEFAULT_OVERFLOW_TIMEOUT */
+	Spill_dir string        /* the directory of the OVERFLOW_SPILL, the rawnodes of a task are spilled to the sub directory named the task id */
+}
+
+var DEFAULT_OVERFLOW_POLICY = OverflowPolicy{
+	Mode: OVERFLOW_DROP_NEWEST,
+}
+
+var (
+	/* the error is passed to the RawNode.Admit, if the rawnode is dropped by the overflow policy */
+	ErrOverflowDropped = errors.New("the rawnode is dropped by the overflow policy")
+	/* the error is passed to the RawNode.Admit, if the rawnode is rejected back to the source */
+	ErrOverflowRejected = errors.New("the rawnode is rejected by the overflow policy")
+)
+
+/* the record is the form of spilled rawnode, the type of the Raw must be registered by the gob.Register */
+type spill_record struct {
+	Id       string
+	Key      string
+	Raw      interface{}
+	Attempts int
+	Task     string /* the task of the copy fanned out, so it is redelivered to the task rather than routed again */
+}
+
+/* the spill state of a task, the files are named by the sequence so the order of rawnodes is kept */
+type spill_state struct {
+	lock  sync.Mutex
+	dir   string
+	files []string
+	seq   uint64
+}
+
+func (policy OverflowPolicy) validate() error {
+	switch policy.Mode {
+	case OVERFLOW_DROP_NEWEST, OVERFLOW_BLOCK, OVERFLOW_DROP_OLDEST, OVERFLOW_REJECT:
+	case OVERFLOW_SPILL:
+		if policy.Spill_dir == "" {
+			return errors.New("the spill directory is empty")
+		}
+	default:
+		return fmt.Errorf("the overflow mode %d is unknown", policy.Mode)
+	}
+	if policy.Timeout < 0 {
+		return errors.New("the timeout is negative")
+	}
+	return nil
+}
+
+/*
+the method sets the overflow policy of the task. The rawnodes spilled before, e.g. before restarting, are
+reloaded to the buffer, if the mode is OVERFLOW_SPILL.
+*/
+func (tn *TaskNode) TaskNode_set_overflow(policy OverflowPolicy) error {
+	err := policy.validate()
+	if err != nil {
+		return err
+	}
+	var spill *spill_state
+	if policy.Mode == OVERFLOW_SPILL {
+		spill, err = spill_open(filepath.Join(policy.Spill_dir, tn.Id))
+		if err != nil {
+			return err
+		}
+	}
+	tn.lock.Lock()
+	tn.Overflow = policy
+	tn.spill = spill
+	tn.lock.Unlock()
+
+	tn.task_unspill()
+	return nil
+}
+
+func (tn *TaskNode) TaskNode_overflow() OverflowPolicy {
+	tn.lock.RLock()
+	defer tn.lock.RUnlock()
+
+	return tn.Overflow
+}
+
+/*
+the method offers the rawnode to the task buffer by the overflow policy, and the RawNode.Admit is called with
+the result. It returns nil, if the rawnode is pushed to the buffer or spilled to the disk, and the ErrTaskReaped
+without admitting, if the task is reaped.
+*/
+func (tn *TaskNode) TaskNode_offer(rawnode *RawNode) error {
+	/* the task reaped is never offered, and the rawnode is neither admitted nor done */
+	tn.offer_lock.RLock()
+	defer tn.offer_lock.RUnlock()
+	if tn.reaped {
+		return ErrTaskReaped
+	}
+	tn.task_touch()
+
+	tn.lock.RLock()
+	policy := tn.Overflow
+	spill := tn.spill
+	tn.lock.RUnlock()
+
+	var err error
+	switch policy.Mode {
+	case OVERFLOW_BLOCK:
+		err = tn.task_offer_block(rawnode, policy.Timeout)
+	case OVERFLOW_DROP_OLDEST:
+		for !tn.TaskNode_Push(rawnode) {
+			dropped := tn.TaskNode_Fetch()
+			if dropped != nil {
+				/* the dropped one was admitted while it was pushed, so only its call is failed */
+				atomic.AddInt64(&tn.Stat_dropped, 1)
+				wal_done(dropped)
+				dropped.rawnode_fail(ErrOverflowDropped)
+			}
+		}
+	case OVERFLOW_REJECT:
+		if !tn.TaskNode_Push(rawnode) {
+			atomic.AddInt64(&tn.Stat_rejected, 1)
+			err = ErrOverflowRejected
+		}
+	case OVERFLOW_SPILL:
+		err = tn.task_offer_spill(spill, rawnode)
+	default:
+		if !tn.TaskNode_Push(rawnode) {
+			atomic.AddInt64(&tn.Stat_dropped, 1)
+			err = ErrOverflowDropped
+		}
+	}
+	/* the rawnode refused by the task is done in the write-ahead log, the source owns it again */
+	if err != nil {
+		wal_done(rawnode)
+	}
+	rawnode.rawnode_admit(err)
+	return err
+}
+
+/*
+the function blocks the router until the rawnode is pushed or the timeout. It waits for the space signal, which
+is sent while a rawnode is taken from the buffer or the buffer is resized, and tries to push again after that.
+*/
+func (tn *TaskNode) task_offer_block(rawnode *RawNode, timeout time.Duration) error {
+	if tn.TaskNode_Push(rawnode) {
+		return nil
+	}
+	if timeout == 0 {
+		timeout = DEFAULT_OVERFLOW_TIMEOUT
+	}
+	timer, stop := tn.broker.clock.Timer(timeout)
+	defer stop()
+	unblock := clock_block(tn.broker.clock)
+	defer unblock()
+
+	for {
+		select {
+		case <-tn.space:
+			if tn.TaskNode_Push(rawnode) {
+				/* the signals are merged, so the next blocked offering is waked up to try the space left */
+				tn.task_signal_space()
+				return nil
+			}
+		case <-timer:
+			atomic.AddInt64(&tn.Stat_dropped, 1)
+			return fmt.Errorf("%w: blocked for %s", ErrOverflowDropped, timeout)
+		case <-tn.Cancel:
+			atomic.AddInt64(&tn.Stat_dropped, 1)
+			return ErrOverflowDropped
+		}
+	}
+}
+
+/* the method signals the offerings blocked by the full buffer, the signal is dropped if one is pending already */
+func (tn *TaskNode) task_signal_space() {
+	select {
+	case tn.space <- struct{}{}:
+	default:
+	}
+}
+
+/* the function spills the rawnode, if the buffer is full or some rawnodes are spilled before it */
+func (tn *TaskNode) task_offer_spill(spill *spill_state, rawnode *RawNode) error {
+	spill.lock.Lock()
+	defer spill.lock.Unlock()
+
+	if len(spill.files) == 0 && tn.TaskNode_Push(rawnode) {
+		return nil
+	}
+	/* the call is not spilled, because the reply is lost on the disk */
+	if rawnode.reply != nil {
+		if tn.TaskNode_Push(rawnode) {
+			return nil
+		}
+		atomic.AddInt64(&tn.Stat_dropped, 1)
+		return ErrOverflowDropped
+	}
+	err := spill.write(rawnode)
+	if err != nil {
+		atomic.AddInt64(&tn.Stat_dropped, 1)
+		return fmt.Errorf("%w: %s", ErrOverflowDropped, err.Error())
+	}
+	atomic.AddInt64(&tn.Stat_spilled, 1)
+	/* the spilled file keeps the rawnode, so it is done in the write-ahead log */
+	wal_done(rawnode)
+	return nil
+}
+
+/* the method reloads the spilled rawnodes to the buffer in order, until the buffer is full. */
+func (tn *TaskNode) task_unspill() {
+	tn.lock.RLock()
+	spill := tn.spill
+	tn.lock.RUnlock()
+	if spill == nil {
+		return
+	}
+	spill.lock.Lock()
+	defer spill.lock.Unlock()
+
+	for len(spill.files) != 0 {
+		name := spill.files[0]
+		rawnode, err := spill.read(name)
+		if err != nil {
+			/* the broken file is kept with the suffix for inspecting */
+			log.Printf("The spilled rawnode %s of the task %s is broken: %s\n\r", name, tn.Id, err.Error())
+			os.Rename(filepath.Join(spill.dir, name), filepath.Join(spill.dir, name+".broken"))
+		} else if !tn.TaskNode_Push(rawnode) {
+			return
+		} else if err := os.Remove(filepath.Join(spill.dir, name)); err != nil {
+			log.Printf("The spilled rawnode %s of the task %s unable to remove: %s\n\r", name, tn.Id, err.Error())
+		}
+		spill.files = spill.files[1:]
+	}
+}
+
+/* the method returns the number of rawnodes spilled to the disk */
+func (tn *TaskNode) TaskNode_spilled() int {
+	tn.lock.RLock()
+	spill := tn.spill
+	tn.lock.RUnlock()
+	if spill == nil {
+		return 0
+	}
+	spill.lock.Lock()
+	defer spill.lock.Unlock()
+
+	return len(spill.files)
+}
+
+func spill_open(dir string) (*spill_state, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	spill := &spill_state{dir: dir}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".spill") {
+			continue
+		}
+		spill.files = append(spill.files, entry.Name())
+	}
+	sort.Strings(spill.files)
+	if len(spill.files) != 0 {
+		fmt.Sscanf(spill.files[len(spill.files)-1], "%d.spill", &spill.seq)
+	}
+	return spill, nil
+}
+
+/* the method writes the rawnode to the file named by the next sequence, the spill lock must be held. */
+func (spill *spill_state) write(rawnode *RawNode) error {
+	name := fmt.Sprintf("%020d.spill", spill.seq+1)
+	file, err := os.Create(filepath.Join(spill.dir, name))
+	if err != nil {
+		return err
+	}
+	record := spill_record{rawnode.Id, rawnode.Key, rawnode.Raw, rawnode.Attempts, rawnode.task}
+	err = gob.NewEncoder(file).Encode(&record)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(filepath.Join(spill.dir, name))
+		return err
+	}
+	spill.seq++
+	spill.files = append(spill.files, name)
+
+	return nil
+}
+
+func (spill *spill_state) read(name string) (*RawNode, error) {
+	file, err := os.Open(filepath.Join(spill.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var record spill_record
+	err = gob.NewDecoder(file).Decode(&record)
+	if err != nil {
+		return nil, err
+	}
+	rawnode := RawNode_create_key(record.Id, record.Key, record.Raw)
+	rawnode.Attempts = record.Attempts
+	rawnode.task = record.Task
+
+	return rawnode, nil
+}
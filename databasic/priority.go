@@ -0,0 +1,171 @@
+package databasic
+
+import (
+	"errors"
+)
+
+/*
+The callings of all the tasks share the running slots, the max number of running callings is set by the
+Running_set_max. A calling waits for a slot while all the slots are used. The free slot is granted to the task
+of the highest priority at first, and the tasks having the same priority share the slots by their weights,
+which is the start-time fair queuing. So the interactive tasks are served ahead of the background tasks.
+*/
+const (
+	PRIORITY_BACKGROUND  int = 0
+	PRIORITY_INTERACTIVE int = 10
+	DEFAULT_PRIORITY     int = PRIORITY_BACKGROUND
+	DEFAULT_WEIGHT       int = 1
+	DEFAULT_MAX_RUNNING  int = 8
+)
+
+type running_waiter struct {
+	tasknode *TaskNode
+	priority int
+	tag      float64 /* the virtual start time of the calling, the smallest one of a priority is granted at first */
+	ready    chan struct{}
+}
+
+func (b *Broker) running_init() {
+	b.running_lock.Lock()
+	b.running_num = 0
+	b.running_queue = make(map[int][]*running_waiter)
+	b.running_vclock = make(map[int]float64)
+	b.running_lock.Unlock()
+}
+
+/* the function sets the max number of running callings of all the tasks, the 0 means unlimited. */
+func (b *Broker) Running_set_max(max int) {
+	b.running_lock.Lock()
+	b.running_max = max
+	b.running_lock.Unlock()
+
+	/* the waiters are granted, if the max is increased */
+	for b.running_grant() {
+	}
+}
+
+/* the method sets the priority and weight of the task, the higher priority is served at first. */
+func (tn *TaskNode) TaskNode_set_priority(priority int, weight int) error {
+	if weight < 1 {
+		return errors.New("argument error")
+	}
+	tn.lock.Lock()
+	tn.Priority = priority
+	tn.Weight = weight
+	tn.lock.Unlock()
+
+	return nil
+}
+
+func (tn *TaskNode) TaskNode_priority() (priority int, weight int) {
+	tn.lock.RLock()
+	defer tn.lock.RUnlock()
+
+	weight = tn.Weight
+	if weight < 1 {
+		weight = DEFAULT_WEIGHT
+	}
+	return tn.Priority, weight
+}
+
+/*
+the function waits for a running slot of the task. It returns false, if the task is canceled while waiting.
+The running_release must be called after the calling, if it returns true.
+*/
+func (b *Broker) running_acquire(tasknode *TaskNode) bool {
+	priority, weight := tasknode.TaskNode_priority()
+
+	b.running_lock.Lock()
+	tag := b.running_vclock[priority]
+	if tasknode.vfinish > tag {
+		tag = tasknode.vfinish
+	}
+	tasknode.vfinish = tag + 1/float64(weight)
+
+	if b.running_max <= 0 || (b.running_num < b.running_max && b.running_waiting() == 0) {
+		b.running_num++
+		b.running_lock.Unlock()
+		return true
+	}
+	waiter := &running_waiter{tasknode, priority, tag, make(chan struct{})}
+	b.running_queue[priority] = append(b.running_queue[priority], waiter)
+	b.running_lock.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return true
+	case <-tasknode.Cancel:
+		b.running_lock.Lock()
+		removed := b.running_remove(waiter)
+		b.running_lock.Unlock()
+		if !removed {
+			/* the slot is granted while canceling, it is released to the next waiter */
+			b.running_release()
+		}
+		return false
+	}
+}
+
+/* the function releases the running slot, which is handed over to the next waiter directly */
+func (b *Broker) running_release() {
+	b.running_lock.Lock()
+	b.running_num--
+	b.running_lock.Unlock()
+
+	b.running_grant()
+}
+
+/* the function grants a free slot to the next waiter. It returns false, if no slot or no waiter. */
+func (b *Broker) running_grant() bool {
+	b.running_lock.Lock()
+	defer b.running_lock.Unlock()
+
+	if b.running_max > 0 && b.running_num >= b.running_max {
+		return false
+	}
+	var next *running_waiter
+	for priority, waiters := range b.running_queue {
+		if len(waiters) == 0 || (next != nil && priority < next.priority) {
+			continue
+		}
+		for _, waiter := range waiters {
+			if next == nil || priority > next.priority || waiter.tag < next.tag {
+				next = waiter
+			}
+		}
+	}
+	if next == nil {
+		return false
+	}
+	b.running_remove(next)
+	b.running_vclock[next.priority] = next.tag
+	b.running_num++
+	close(next.ready)
+
+	return true
+}
+
+/* the function removes the waiter from the queue, the running_lock of the broker must be held. */
+func (b *Broker) running_remove(waiter *running_waiter) bool {
+	waiters := b.running_queue[waiter.priority]
+	for i := range waiters {
+		if waiters[i] == waiter {
+			b.running_queue[waiter.priority] = append(waiters[:i], waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/* the function returns the number of the waiters, the running_lock of the broker must be held. */
+func (b *Broker) running_waiting() int {
+	num := 0
+	for _, waiters := range b.running_queue {
+		num += len(waiters)
+	}
+	return num
+}
+
+func Running_set_max(max int) {
+	global_broker.Running_set_max(max)
+}
@@ -1,122 +1,234 @@
 package databasic
 
-import "context"
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type ProceNode struct {
-	List *ListNode /* it is a continer that is used to orgnize the parent type as a list */
-
 	Id string
 
-	Operation interface{} /* the Operation type is interface{}, which make the ProceNode holding all operation type method */
+	broker *Broker /* the broker registering the procenode */
+
+	versions []*processor_version /* the versions of the processor kept for the rollback, the current version is the last one */
+
+	Lock int32 /* it be used to prevent the competing, while the user to update the processor, it is changed atomically */
+
+	Concurrency int                   /* the number of go routines processing the rawnodes of a task concurrently */
+	Partition   func(*RawNode) string /* the function returns the key of a rawnode, the rawnodes having the same key are processed in order */
+
+	Retry RetryPolicy  /* the policy decides how a failed calling is retried, it is set by the ProceNode_set_retry */
+	lock  sync.RWMutex /* it protects the versions, Retry, Priority, Weight, Overflow, Buffer_size and Idle, which are read by the task go routines */
 
-	Lock int /* it be used to prevent the competing, while the user to update the Operation */
+	Priority int /* the priority of the tasks created for the procenode, it is set by the ProceNode_set_priority */
+	Weight   int /* the weight of the tasks created for the procenode */
+
+	Overflow    OverflowPolicy /* the overflow policy of the tasks created for the procenode, it is set by the ProceNode_set_overflow */
+	Buffer_size int            /* the buffer size of the tasks created for the procenode */
+
+	Idle time.Duration /* the tasks created for the procenode are reaped after they are quiet for the Idle, it is set by the ProceNode_set_idle */
 
 	Class_list *ListNode /* the list hold all DataClass data, which hold all DataNode */
 	Class_num  int       /* the member records the number of the Class_list length sub one */
 	Class_max  int       /* the memeber is unused */
 }
 
-func ProceNode_register(operation interface{}, id string) *ProceNode {
+func (b *Broker) ProceNode_register(operation interface{}, id string) *ProceNode {
+	return b.ProceNode_register_pool(operation, id, 1, nil)
+}
+
+/*
+The function registers a procenode, which the task process the rawnodes by the concurrency go routines.
+The rawnodes are partitioned by the partition function, the rawnodes having the same key are processed
+in order by one go routine. The RawNode.Key is used, if the partition is nil.
+The operation is validated by processor_adapt, the procenode is not registered if the operation is invalid.
+*/
+func (b *Broker) ProceNode_register_pool(operation interface{}, id string, concurrency int, partition func(*RawNode) string) *ProceNode {
 
-	if operation == nil || global_procenode_num == MAX_PROCENODE_NUMBER {
+	if id == "" || concurrency < 1 {
 		return nil
 	}
+	processor, err := processor_adapt(operation)
+	if err != nil {
+		log.Printf("The procenode named %s unable to register: %s\n\r", id, err.Error())
+		return nil
+	}
+	if partition == nil {
+		partition = RawNode_key
+	}
 
 	procenode := new(ProceNode)
 	procenode.Id = id
+	procenode.broker = b
 	procenode.Lock = 0
-	procenode.Operation = operation
-	procenode.List = ListNode_create(procenode)
+	procenode.version_init(processor)
+	procenode.Concurrency = concurrency
+	procenode.Partition = partition
+	procenode.Retry = DEFAULT_RETRY_POLICY
+	procenode.Priority = DEFAULT_PRIORITY
+	procenode.Weight = DEFAULT_WEIGHT
+	procenode.Overflow = DEFAULT_OVERFLOW_POLICY
+	procenode.Buffer_size = DEFAULT_BUFFER_SIZE
+	procenode.Idle = DEFAULT_TASK_IDLE
 	procenode.Class_list = ListNode_create(procenode)
 	procenode.Class_max = 100
 	procenode.Class_num = 0
 
-	/* add the procenode to the global list */
-	entry := global_procenode_entry
-	listnode := procenode.List
-
-	ok := ListNode_insert_next(entry, listnode)
+	/* add the procenode to the registry of the broker */
+	ok := b.procenode_registry.add(id, procenode)
 	if !ok {
-		procenode.List.Parent = nil
 		procenode.Class_list.Parent = nil
 		procenode.Class_list = nil
-		procenode.List = nil
 		return nil
 	}
-	global_procenode_num++
 
 	return procenode
 }
 
-func ProceNode_find(id string) (procenode *ProceNode) {
-	listnode := global_procenode_entry
-
-	if listnode.Next == listnode || listnode.Prev == listnode {
+func (b *Broker) ProceNode_find(id string) (procenode *ProceNode) {
+	procenode, ok := b.procenode_registry.find(id)
+	if !ok {
 		return nil
 	}
+	return procenode
+}
 
-	if id == "last" {
-		return listnode.Prev.Parent.(*ProceNode)
-	} else if id == "first" {
-		return listnode.Next.Parent.(*ProceNode)
-	}
+/* the function sets the max number of procenode, the 0 means unlimited. */
+func (b *Broker) ProceNode_set_max(max int) {
+	b.procenode_registry.set_max(max)
+}
 
-	for i := 0; i < global_procenode_num; i++ {
-		listnode = ListNode_index_node(listnode, 1)
-		parent := listnode.Parent.(*ProceNode)
-		if parent.Id == id {
-			return parent
-		}
-	}
-	return nil
+func ProceNode_register(operation interface{}, id string) *ProceNode {
+	return global_broker.ProceNode_register(operation, id)
+}
+
+func ProceNode_register_pool(operation interface{}, id string, concurrency int, partition func(*RawNode) string) *ProceNode {
+	return global_broker.ProceNode_register_pool(operation, id, concurrency, partition)
+}
+
+func ProceNode_find(id string) (procenode *ProceNode) {
+	return global_broker.ProceNode_find(id)
+}
+
+func ProceNode_set_max(max int) {
+	global_broker.ProceNode_set_max(max)
 }
 
+/*
+the method unregisters the procenode, and the tasknodes processed by the procenode are also unregistered.
+The router creates a new tasknode, if a procenode with the same id is registered again.
+*/
 func (pn *ProceNode) ProceNode_unregister(ctx context.Context) bool {
 
-	ok := ListNode_delete(pn.List)
+	ok := pn.broker.procenode_registry.remove(pn.Id, pn)
 	if !ok {
 		return false
 	}
-	global_procenode_num--
+	pn.broker.unsubscribe_all(pn)
+	for _, tasknode := range pn.broker.tasknode_registry.list() {
+		if tasknode.TaskNode_method() == pn {
+			tasknode.TaskNode_unregister()
+		}
+	}
 
 	return true
 }
 
+/* the method installs the operation as a new version of the processor, it is the same as the ProceNode_swap. */
 func (pn *ProceNode) ProceNode_update_method(operation interface{}) bool {
-	if operation == nil {
+	_, err := pn.ProceNode_swap(operation)
+	if err != nil {
+		log.Printf("The method of procenode named %s unable to update: %s\n\r", pn.Id, err.Error())
 		return false
 	} else {
-		pn.Operation = operation
 		return true
 	}
 }
 
+/* the method sets the retry policy of the procenode. The Max_attempts must be greater than 0. */
+func (pn *ProceNode) ProceNode_set_retry(policy RetryPolicy) bool {
+	if policy.Max_attempts < 1 || policy.Backoff < 0 {
+		return false
+	}
+	pn.lock.Lock()
+	pn.Retry = policy
+	pn.lock.Unlock()
+
+	return true
+}
+
+func (pn *ProceNode) ProceNode_retry() RetryPolicy {
+	pn.lock.RLock()
+	defer pn.lock.RUnlock()
+
+	return pn.Retry
+}
+
+/* the method sets the priority and weight of the tasks created for the procenode after the calling. */
+func (pn *ProceNode) ProceNode_set_priority(priority int, weight int) bool {
+	if weight < 1 {
+		return false
+	}
+	pn.lock.Lock()
+	pn.Priority = priority
+	pn.Weight = weight
+	pn.lock.Unlock()
+
+	return true
+}
+
+func (pn *ProceNode) ProceNode_priority() (priority int, weight int) {
+	pn.lock.RLock()
+	defer pn.lock.RUnlock()
+
+	return pn.Priority, pn.Weight
+}
+
+/*
+the method sets the overflow policy and the buffer size of the tasks created for the procenode after the calling.
+The existing tasks are changed by the TaskNode_set_overflow and TaskNode_resize.
+*/
+func (pn *ProceNode) ProceNode_set_overflow(policy OverflowPolicy, buffer_size int) bool {
+	if buffer_size < 1 || policy.validate() != nil {
+		return false
+	}
+	pn.lock.Lock()
+	pn.Overflow = policy
+	pn.Buffer_size = buffer_size
+	pn.lock.Unlock()
+
+	return true
+}
+
+func (pn *ProceNode) ProceNode_overflow() (policy OverflowPolicy, buffer_size int) {
+	pn.lock.RLock()
+	defer pn.lock.RUnlock()
+
+	return pn.Overflow, pn.Buffer_size
+}
+
 func (pn *ProceNode) ProceNode_update_id(id string) bool {
 	if id == "" {
 		return false
+	} else if !pn.broker.procenode_registry.rename(pn.Id, id, pn) {
+		return false
 	} else {
 		pn.Id = id
 		return true
 	}
 }
 
+/* the method returns false, if the procenode is locked by others already */
 func (pn *ProceNode) ProceNode_lock() bool {
-	if pn.Lock == 1 {
-		return false
-	} else {
-		pn.Lock = 1
-		return true
-	}
-
+	return atomic.CompareAndSwapInt32(&pn.Lock, 0, 1)
 }
 
 func (pn *ProceNode) ProceNode_unlock() (ok int) {
-	if pn.Lock == 0 {
-		ok = 1
-	} else {
-		pn.Lock = 0
-		ok = 1
-	}
+	atomic.StoreInt32(&pn.Lock, 0)
+	ok = 1
 	return ok
 }
 
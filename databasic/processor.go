@@ -0,0 +1,107 @@
+package databasic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+/*
+The Processor is the operation of procenode. The Process handles a rawnode of the tasknode and returns a error,
+which tell the broker why the rawnode is failed. The ctx is canceled, if the broker does not need the result.
+*/
+type Processor interface {
+	Process(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error
+}
+
+/* The ProcessorFunc type is an adapter to allow the use of ordinary functions as Processor. */
+type ProcessorFunc func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error
+
+func (pf ProcessorFunc) Process(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+	return pf(ctx, tasknode, rawnode)
+}
+
+var (
+	/* the error is returned, if the payload of rawnode is not the type required by the processor */
+	ErrPayloadType = errors.New("the payload type of rawnode is mismatched")
+	/* the error is returned by the legacy operation, which returns false without reason */
+	ErrProcessFailed = errors.New("the operation of procenode returns false")
+	/* the error is returned, if the calling is canceled by the deadline of the tasknode */
+	ErrOverrun = errors.New("the calling of procenode overruns the deadline")
+	/* the error is returned, if the task is canceled before the rawnode is processed */
+	ErrTaskCanceled = errors.New("the task is canceled before processing")
+)
+
+/*
+The function returns the payload of the rawnode as the type T. The ErrPayloadType is returned, if the
+payload is not the type T.
+*/
+func RawNode_payload[T any](rawnode *RawNode) (T, error) {
+	payload, ok := rawnode.Raw.(T)
+	if !ok {
+		return payload, fmt.Errorf("%w: the rawnode %s holds %T, want %T", ErrPayloadType, rawnode.Id, rawnode.Raw, payload)
+	}
+	return payload, nil
+}
+
+/*
+The function creates a Processor handling the payload typed T, which make the process never to force
+convert the RawNode.Raw. The rawnode holding other type is failed with the ErrPayloadType.
+*/
+func TypedProcessor[T any](process func(ctx context.Context, tasknode *TaskNode, payload T) error) Processor {
+	return ProcessorFunc(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		payload, err := RawNode_payload[T](rawnode)
+		if err != nil {
+			return err
+		}
+		return process(ctx, tasknode, payload)
+	})
+}
+
+/*
+The function creates a Processor as a stage of pipeline, the output of the stage is emitted to the next stage
+by the Emit. The output is not emitted, if the stage returns a error.
+*/
+func TypedStage[I any, O any](stage func(ctx context.Context, tasknode *TaskNode, payload I) (O, error)) Processor {
+	return ProcessorFunc(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+		payload, err := RawNode_payload[I](rawnode)
+		if err != nil {
+			return err
+		}
+		output, err := stage(ctx, tasknode, payload)
+		if err != nil {
+			return err
+		}
+		return Emit(tasknode, rawnode, output)
+	})
+}
+
+/*
+The function validates the operation while registering, and converts it to a Processor. The operation
+can be a Processor, a func(context.Context, *TaskNode, *RawNode) error or the legacy func(*TaskNode, *RawNode) bool.
+*/
+func processor_adapt(operation interface{}) (Processor, error) {
+	switch op := operation.(type) {
+	case nil:
+		return nil, errors.New("the operation is nil")
+	case Processor:
+		return op, nil
+	case func(context.Context, *TaskNode, *RawNode) error:
+		if op == nil {
+			return nil, errors.New("the operation is nil")
+		}
+		return ProcessorFunc(op), nil
+	case func(*TaskNode, *RawNode) bool:
+		if op == nil {
+			return nil, errors.New("the operation is nil")
+		}
+		return ProcessorFunc(func(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+			if !op(tasknode, rawnode) {
+				return ErrProcessFailed
+			}
+			return nil
+		}), nil
+	default:
+		return nil, fmt.Errorf("the operation typed %T is not a Processor", operation)
+	}
+}
@@ -0,0 +1,466 @@
+package databasic
+
+import (
+	"container/heap"
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The router limits the rate of rawnodes by the token buckets, so a misbehaving device sending too fast never
+starves the others. A limit is set for a route pattern by the RateLimit_set_route, which is shared by all the
+routes matching it, and the most specific pattern wins like the subscriptions. A limit is set for a device by the
+RateLimit_set_device with the RawNode.Key, and the limit of the RATE_ANY_DEVICE gives each device without its own
+limit a separate bucket. A rawnode passes the route limit at first, then the device limit.
+
+The following const is the modes of the limit, which decide how the router handles the rawnode over the limit.
+RATE_DROP drops the rawnode, it is the default mode.
+RATE_DELAY holds the rawnode until the token is available, the rawnode is dropped if it waits longer than the Max_delay.
+The delayed rawnodes are released by the delayer go routine at their due time, so the router never waits for them,
+and the rawnodes of a bucket are released in order.
+RATE_SAMPLE passes one of every Sample rawnodes over the limit, and drops the others.
+The dropped rawnode is admitted with the ErrRateLimited, e.g. the call returns it.
+*/
+const (
+	RATE_DROP   int = 1
+	RATE_DELAY  int = 2
+	RATE_SAMPLE int = 3
+)
+
+/* the following const should be cared by user */
+const (
+	RATE_ANY_DEVICE      string        = "*"
+	DEFAULT_RATE_DELAY   time.Duration = 100 * time.Millisecond
+	DEFAULT_RATE_SAMPLE  int           = 10
+	DEFAULT_RATE_BUCKETS int           = 10000 /* the max number of buckets of a limit, the least recently used one is evicted */
+)
+
+/* the following const is the limits checked for a rawnode in order */
+const (
+	rate_stage_route  int = 0
+	rate_stage_device int = 1
+	rate_stage_done   int = 2
+)
+
+/* the following const is the results of taking a token */
+const (
+	rate_pass  int = 1
+	rate_delay int = 2
+	rate_drop  int = 3
+)
+
+/* the error is passed to the RawNode.Admit, if the rawnode is dropped by the rate limit */
+var ErrRateLimited = errors.New("the rawnode is dropped by the rate limit")
+
+type RateLimit struct {
+	Rate      float64       /* the number of rawnodes passed per second, 0 means the limit is removed */
+	Burst     int           /* the capacity of the bucket, less than 1 means 1 */
+	Mode      int           /* 0 means the RATE_DROP */
+	Max_delay time.Duration /* the max waiting of the RATE_DELAY, 0 means the DEFAULT_RATE_DELAY */
+	Sample    int           /* the RATE_SAMPLE passes one of every Sample rawnodes over the limit, 0 means the DEFAULT_RATE_SAMPLE */
+}
+
+/* the limiter of a route pattern or a device, it counts the decisions */
+type rate_limiter struct {
+	limit   RateLimit
+	buckets map[string]*rate_bucket /* the bucket of each device for the RATE_ANY_DEVICE, or the only bucket named "" */
+	recent  *list.List              /* the names of the buckets, the most recently used one is the front */
+	max     int                     /* the max number of the buckets */
+
+	Stat_passed  int64
+	Stat_delayed int64
+	Stat_sampled int64
+	Stat_dropped int64
+}
+
+type rate_bucket struct {
+	tokens float64
+	last   time.Time
+	over   int /* the number of rawnodes over the limit, which is used by the RATE_SAMPLE */
+
+	delayed int           /* the number of rawnodes delayed by the bucket and not released */
+	due     time.Time     /* the due time of the rawnode delayed last */
+	element *list.Element /* the element of the bucket in the recent list */
+}
+
+/* a rawnode delayed by the RATE_DELAY, it is released to the following limits and the routing at the due time */
+type rate_delayed struct {
+	rawnode *RawNode
+	bucket  *rate_bucket
+	due     time.Time
+	seq     uint64
+	stage   int
+}
+
+/* the delayed rawnodes ordered by the due time, the rawnodes having the same due time are in order of delaying */
+type rate_queue []*rate_delayed
+
+func (q rate_queue) Len() int { return len(q) }
+func (q rate_queue) Less(i, j int) bool {
+	if !q[i].due.Equal(q[j].due) {
+		return q[i].due.Before(q[j].due)
+	}
+	return q[i].seq < q[j].seq
+}
+func (q rate_queue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *rate_queue) Push(x interface{}) { *q = append(*q, x.(*rate_delayed)) }
+func (q *rate_queue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+/* the statistics of a limit, which is included in the snapshot of the broker */
+type RateLimitSnapshot struct {
+	Kind    string  `json:"kind"` /* the "route" or the "device" */
+	Pattern string  `json:"pattern"`
+	Rate    float64 `json:"rate"`
+	Burst   int     `json:"burst"`
+	Mode    int     `json:"mode"`
+	Buckets int     `json:"buckets"`
+
+	Passed  int64 `json:"passed"`
+	Delayed int64 `json:"delayed"`
+	Sampled int64 `json:"sampled"`
+	Dropped int64 `json:"dropped"`
+}
+
+func (limit RateLimit) validate() error {
+	switch limit.Mode {
+	case 0, RATE_DROP, RATE_DELAY, RATE_SAMPLE:
+	default:
+		return fmt.Errorf("the rate limit mode %d is unknown", limit.Mode)
+	}
+	if limit.Rate < 0 {
+		return errors.New("the rate is negative")
+	}
+	if limit.Max_delay < 0 || limit.Sample < 0 {
+		return errors.New("the max delay or the sample is negative")
+	}
+	return nil
+}
+
+func (b *Broker) ratelimit_init() {
+	b.ratelimit_lock.Lock()
+	b.route_limits = make(map[string]*rate_limiter)
+	b.route_matched = make(map[string]string)
+	b.device_limits = make(map[string]*rate_limiter)
+	b.rate_wake = make(chan struct{}, 1)
+	b.ratelimit_lock.Unlock()
+}
+
+/* the function sets the limit of the route pattern, the limit of Rate 0 removes it. */
+func (b *Broker) RateLimit_set_route(route string, limit RateLimit) error {
+	if route == "" {
+		return errors.New("the route is empty")
+	}
+	return b.ratelimit_set(b.route_limits, route, limit)
+}
+
+/* the function sets the limit of the device key, the RATE_ANY_DEVICE sets the limit of each device. The limit of Rate 0 removes it. */
+func (b *Broker) RateLimit_set_device(key string, limit RateLimit) error {
+	if key == "" {
+		return errors.New("the device key is empty")
+	}
+	return b.ratelimit_set(b.device_limits, key, limit)
+}
+
+func (b *Broker) ratelimit_set(limiters map[string]*rate_limiter, name string, limit RateLimit) error {
+	err := limit.validate()
+	if err != nil {
+		return err
+	}
+	b.ratelimit_lock.Lock()
+	defer b.ratelimit_lock.Unlock()
+
+	/* the limits are changed, the cached routes are matched again */
+	b.route_matched = make(map[string]string)
+	if limit.Rate == 0 {
+		delete(limiters, name)
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	if limit.Mode == 0 {
+		limit.Mode = RATE_DROP
+	}
+	if limit.Max_delay == 0 {
+		limit.Max_delay = DEFAULT_RATE_DELAY
+	}
+	if limit.Sample == 0 {
+		limit.Sample = DEFAULT_RATE_SAMPLE
+	}
+	/* the buckets are reset, so the new limit takes effect at once */
+	limiters[name] = &rate_limiter{limit: limit, buckets: make(map[string]*rate_bucket), recent: list.New(), max: DEFAULT_RATE_BUCKETS}
+	return nil
+}
+
+/*
+the function decides whether the router routes the rawnode. The rawnode over the limit is dropped, delayed
+or sampled by the mode, and the dropped one is done in the write-ahead log and admitted with the ErrRateLimited.
+The delayed one is routed by the delayer later, so the router returns false for it at once.
+*/
+func (b *Broker) router_limit(rawnode *RawNode) bool {
+	return b.ratelimit_check(rawnode, rate_stage_route)
+}
+
+/*
+the function returns the most specific pattern of the route limits matching the route, or "" if none matches. The
+pattern is cached for the route as the route_subscribers, the ratelimit_lock of the broker must be held.
+*/
+func (b *Broker) ratelimit_match(route string) string {
+	pattern, ok := b.route_matched[route]
+	if ok {
+		return pattern
+	}
+	pattern = route_best(b.route_limits, route)
+	if len(b.route_matched) >= DEFAULT_ROUTE_CACHE_SIZE {
+		b.route_matched = make(map[string]string)
+	}
+	b.route_matched[route] = pattern
+
+	return pattern
+}
+
+/* the function checks the limits of the rawnode from the stage. It returns true, if the rawnode passes all of them. */
+func (b *Broker) ratelimit_check(rawnode *RawNode, stage int) bool {
+	if rawnode == nil {
+		return true
+	}
+	b.ratelimit_lock.Lock()
+	var route, device *rate_limiter
+	if pattern := b.ratelimit_match(rawnode.Id); pattern != "" {
+		route = b.route_limits[pattern]
+	}
+	/* the limit of the device itself has only one bucket, and the RATE_ANY_DEVICE has a bucket for each device */
+	bucket := ""
+	if rawnode.Key != "" {
+		if device = b.device_limits[rawnode.Key]; device == nil {
+			device = b.device_limits[RATE_ANY_DEVICE]
+			bucket = rawnode.Key
+		}
+	}
+	b.ratelimit_lock.Unlock()
+
+	if stage <= rate_stage_route && route != nil && b.ratelimit_take(route, "", rawnode, rate_stage_device) != rate_pass {
+		return false
+	}
+	if stage <= rate_stage_device && device != nil && b.ratelimit_take(device, bucket, rawnode, rate_stage_done) != rate_pass {
+		return false
+	}
+	return true
+}
+
+/*
+the function takes a token of the bucket for the rawnode, and returns the rate_pass, the rate_delay or the
+rate_drop. The delayed rawnode is checked from the next stage while it is released.
+*/
+func (b *Broker) ratelimit_take(limiter *rate_limiter, name string, rawnode *RawNode, next int) int {
+	limit := limiter.limit
+	now := b.clock.Now()
+
+	b.ratelimit_lock.Lock()
+	bucket := limiter.bucket(name, now)
+	/* the tokens are refilled by the time passed since the last taking */
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens += elapsed.Seconds() * limit.Rate
+		if bucket.tokens > float64(limit.Burst) {
+			bucket.tokens = float64(limit.Burst)
+		}
+		bucket.last = now
+	}
+	/* the rawnode never passes the rawnodes delayed by the bucket, so they are in order */
+	if bucket.tokens >= 1 && bucket.delayed == 0 {
+		bucket.tokens--
+		b.ratelimit_lock.Unlock()
+		atomic.AddInt64(&limiter.Stat_passed, 1)
+		return rate_pass
+	}
+
+	switch limit.Mode {
+	case RATE_DELAY:
+		/* the token is reserved, and the rawnode is released while it is refilled */
+		due := now
+		if bucket.tokens < 1 {
+			due = now.Add(time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second)))
+		}
+		if bucket.delayed > 0 && bucket.due.After(due) {
+			due = bucket.due
+		}
+		if due.Sub(now) <= limit.Max_delay {
+			bucket.tokens--
+			bucket.delayed++
+			bucket.due = due
+			b.rate_seq++
+			heap.Push(&b.rate_delayed, &rate_delayed{rawnode: rawnode, bucket: bucket, due: due, seq: b.rate_seq, stage: next})
+			b.ratelimit_lock.Unlock()
+			atomic.AddInt64(&limiter.Stat_delayed, 1)
+			select {
+			case b.rate_wake <- struct{}{}:
+			default:
+			}
+			return rate_delay
+		}
+	case RATE_SAMPLE:
+		bucket.over++
+		if bucket.over%limit.Sample == 0 {
+			b.ratelimit_lock.Unlock()
+			atomic.AddInt64(&limiter.Stat_sampled, 1)
+			return rate_pass
+		}
+	}
+	b.ratelimit_lock.Unlock()
+
+	atomic.AddInt64(&limiter.Stat_dropped, 1)
+	wal_done(rawnode)
+	rawnode.rawnode_admit(ErrRateLimited)
+	return rate_drop
+}
+
+/*
+the method returns the bucket named the name, which is the most recently used one after that. A new bucket is full,
+and the least recently used bucket is evicted while the limiter has the max buckets, the bucket delaying rawnodes
+is kept. The ratelimit lock must be held.
+*/
+func (limiter *rate_limiter) bucket(name string, now time.Time) *rate_bucket {
+	bucket := limiter.buckets[name]
+	if bucket != nil {
+		limiter.recent.MoveToFront(bucket.element)
+		return bucket
+	}
+	for e := limiter.recent.Back(); e != nil && len(limiter.buckets) >= limiter.max; {
+		prev := e.Prev()
+		if evicted := limiter.buckets[e.Value.(string)]; evicted.delayed == 0 {
+			delete(limiter.buckets, e.Value.(string))
+			limiter.recent.Remove(e)
+		}
+		e = prev
+	}
+	bucket = &rate_bucket{tokens: float64(limiter.limit.Burst), last: now}
+	bucket.element = limiter.recent.PushFront(name)
+	limiter.buckets[name] = bucket
+	return bucket
+}
+
+/*
+the function releases the rawnodes delayed until the now to the following limits and the routing in order. It
+returns the number of released rawnodes and the due time of the next one, which is zero if nothing is delayed.
+*/
+func (b *Broker) ratelimit_release(now time.Time) (int, time.Time) {
+	var released []*rate_delayed
+	b.ratelimit_lock.Lock()
+	for len(b.rate_delayed) > 0 && !b.rate_delayed[0].due.After(now) {
+		released = append(released, heap.Pop(&b.rate_delayed).(*rate_delayed))
+	}
+	b.ratelimit_lock.Unlock()
+
+	for _, item := range released {
+		if b.ratelimit_check(item.rawnode, item.stage) {
+			b.router_route(item.rawnode)
+		}
+		/* the bucket holds the following rawnodes until the rawnode is routed */
+		b.ratelimit_lock.Lock()
+		item.bucket.delayed--
+		b.ratelimit_lock.Unlock()
+	}
+	return len(released), b.ratelimit_next()
+}
+
+/* the function returns the due time of the next delayed rawnode, it is zero if nothing is delayed */
+func (b *Broker) ratelimit_next() time.Time {
+	b.ratelimit_lock.Lock()
+	defer b.ratelimit_lock.Unlock()
+
+	if len(b.rate_delayed) == 0 {
+		return time.Time{}
+	}
+	return b.rate_delayed[0].due
+}
+
+/* the function removes all the delayed rawnodes and returns them in order, e.g. while the broker is shut down */
+func (b *Broker) ratelimit_flush() []*RawNode {
+	b.ratelimit_lock.Lock()
+	defer b.ratelimit_lock.Unlock()
+
+	var rawnodes []*RawNode
+	for len(b.rate_delayed) > 0 {
+		item := heap.Pop(&b.rate_delayed).(*rate_delayed)
+		item.bucket.delayed--
+		rawnodes = append(rawnodes, item.rawnode)
+	}
+	return rawnodes
+}
+
+/*
+the delayer releases the rawnodes delayed by the RATE_DELAY at their due time, and waits for the next one. It is
+woken up while a rawnode is delayed, and it returns after the broker is shut down.
+*/
+func (b *Broker) Delayer() {
+	for {
+		now := b.clock.Now()
+		_, next := b.ratelimit_release(now)
+
+		var timer <-chan time.Time
+		stop := func() bool { return false }
+		if !next.IsZero() {
+			timer, stop = b.clock.Timer(next.Sub(now))
+		}
+		select {
+		case <-timer:
+		case <-b.rate_wake:
+		case <-b.done:
+			stop()
+			return
+		}
+		stop()
+	}
+}
+
+/* the function returns the statistics of the limits, which are sorted by the kind and the pattern */
+func (b *Broker) RateLimit_snapshot() []RateLimitSnapshot {
+	b.ratelimit_lock.Lock()
+	defer b.ratelimit_lock.Unlock()
+
+	var snapshots []RateLimitSnapshot
+	for kind, limiters := range map[string]map[string]*rate_limiter{"route": b.route_limits, "device": b.device_limits} {
+		for pattern, limiter := range limiters {
+			snapshots = append(snapshots, RateLimitSnapshot{
+				Kind:    kind,
+				Pattern: pattern,
+				Rate:    limiter.limit.Rate,
+				Burst:   limiter.limit.Burst,
+				Mode:    limiter.limit.Mode,
+				Buckets: len(limiter.buckets),
+				Passed:  atomic.LoadInt64(&limiter.Stat_passed),
+				Delayed: atomic.LoadInt64(&limiter.Stat_delayed),
+				Sampled: atomic.LoadInt64(&limiter.Stat_sampled),
+				Dropped: atomic.LoadInt64(&limiter.Stat_dropped),
+			})
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].Kind != snapshots[j].Kind {
+			return snapshots[i].Kind > snapshots[j].Kind
+		}
+		return snapshots[i].Pattern < snapshots[j].Pattern
+	})
+	return snapshots
+}
+
+func RateLimit_set_route(route string, limit RateLimit) error {
+	return global_broker.RateLimit_set_route(route, limit)
+}
+
+func RateLimit_set_device(key string, limit RateLimit) error {
+	return global_broker.RateLimit_set_device(key, limit)
+}
+
+func RateLimit_snapshot() []RateLimitSnapshot {
+	return global_broker.RateLimit_snapshot()
+}
@@ -1,10 +1,27 @@
 package databasic
 
+import "time"
+
 type RawNode struct {
 	Id     string
+	Key    string      /* the Key partitions the rawnodes of a task, the rawnodes having the same key are processed in order */
 	Raw    interface{} /* the Raw type is interface{}, which make RawNode can hold all data type */
 	List   *ListNode   /* it is a continer that is used to orgnize the parent type as a list */
 	handle bool
+
+	Attempts int       /* the number of callings of the procenode processing the rawnode */
+	Failure  error     /* the error returned by the last calling, it is nil if the rawnode is processed successfully */
+	Parked   time.Time /* the time instant which the rawnode is parked in the dead letter store */
+
+	/*
+		the function is called by the router with nil while the rawnode is admitted by the task, or with the error
+		while it is dropped or rejected by the overflow policy. e.g. the amqp client accepts or releases the message.
+	*/
+	Admit func(rawnode *RawNode, err error)
+
+	wal   *wal_entry    /* the entry of the write-ahead log, it is nil if the rawnode is not logged */
+	reply *reply_future /* the future of the Call waiting for the reply, it is nil if the rawnode is not a call */
+	task  string        /* the task of the subscriber receiving the copy fanned out, it is "" for the rawnode routed */
 }
 
 func RawNode_create(id string, raw interface{}) *RawNode {
@@ -17,3 +34,22 @@ func RawNode_create(id string, raw interface{}) *RawNode {
 
 	return rawnode
 }
+
+/* creating a rawnode with the partition key, e.g. the device name. */
+func RawNode_create_key(id string, key string, raw interface{}) *RawNode {
+	rawnode := RawNode_create(id, raw)
+	rawnode.Key = key
+
+	return rawnode
+}
+
+func (rawnode *RawNode) rawnode_admit(err error) {
+	if rawnode.Admit != nil {
+		rawnode.Admit(rawnode, err)
+	}
+}
+
+/* the default partition function of procenode, which returns the RawNode.Key */
+func RawNode_key(rawnode *RawNode) string {
+	return rawnode.Key
+}
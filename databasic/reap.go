@@ -0,0 +1,176 @@
+package databasic
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The router creates a task the first time it sees a route, so the tasks of the per-device routes pile up. The
+reaper tears down the task quiet for the Idle period, which has no rawnode pending, buffered or spilled and is
+not paused, and the task is created again by the router while its route is active again. The Idle of a task is
+copied from its procenode, which is set by the ProceNode_set_idle, and the 0 means the task is never reaped.
+
+The lifecycle of tasks is reported to the listener set by the Lifecycle_set: the TASK_EVENT_CREATED while a task
+is registered, the TASK_EVENT_IDLE while the reaper finds it quiet for half of the Idle, and the TASK_EVENT_REAPED
+while it is torn down.
+*/
+const (
+	TASK_EVENT_CREATED string = "created"
+	TASK_EVENT_IDLE    string = "idle"
+	TASK_EVENT_REAPED  string = "reaped"
+)
+
+/* the following const should be cared by user */
+const (
+	DEFAULT_TASK_IDLE     time.Duration = 10 * time.Minute
+	DEFAULT_REAP_INTERVAL time.Duration = 10 * time.Second
+)
+
+/* the error is returned by the TaskNode_offer, if the task is reaped, the router offers the rawnode to a new task */
+var ErrTaskReaped = errors.New("the task is reaped")
+
+type TaskEvent struct {
+	Kind      string        `json:"kind"`
+	Tasknode  string        `json:"tasknode"`
+	Procenode string        `json:"procenode"`
+	Time      time.Time     `json:"time"`
+	Quiet     time.Duration `json:"quiet"` /* the time since the task is active last, it is 0 for the TASK_EVENT_CREATED */
+}
+
+/* the function sets the listener of the lifecycle events, it should be called before the Broker_start. The nil means logging. */
+func (b *Broker) Lifecycle_set(listener func(event TaskEvent)) {
+	if listener == nil {
+		listener = lifecycle_log
+	}
+	b.lifecycle_listener = listener
+}
+
+func Lifecycle_set(listener func(event TaskEvent)) {
+	global_broker.Lifecycle_set(listener)
+}
+
+func lifecycle_log(event TaskEvent) {
+	if event.Kind == TASK_EVENT_CREATED {
+		log.Printf("The task %s of the procenode %s is created.\n\r", event.Tasknode, event.Procenode)
+	} else {
+		log.Printf("The task %s of the procenode %s is %s, it is quiet for %s.\n\r", event.Tasknode, event.Procenode, event.Kind, event.Quiet)
+	}
+}
+
+/* the function reports the event of the task to the listener */
+func (b *Broker) lifecycle_emit(kind string, tasknode *TaskNode, quiet time.Duration) {
+	event := TaskEvent{Kind: kind, Tasknode: tasknode.Id, Time: b.clock.Now(), Quiet: quiet}
+	if procenode := tasknode.TaskNode_method(); procenode != nil {
+		event.Procenode = procenode.Id
+	}
+	b.lifecycle_listener(event)
+}
+
+/* the method sets the Idle of the tasks created for the procenode after the calling, the 0 means they are never reaped. */
+func (pn *ProceNode) ProceNode_set_idle(idle time.Duration) bool {
+	if idle < 0 {
+		return false
+	}
+	pn.lock.Lock()
+	pn.Idle = idle
+	pn.lock.Unlock()
+
+	return true
+}
+
+func (pn *ProceNode) ProceNode_idle() time.Duration {
+	pn.lock.RLock()
+	defer pn.lock.RUnlock()
+
+	return pn.Idle
+}
+
+/* the method sets the Idle of the task, the 0 means the task is never reaped. */
+func (tn *TaskNode) TaskNode_set_idle(idle time.Duration) bool {
+	if idle < 0 {
+		return false
+	}
+	tn.lock.Lock()
+	tn.Idle = idle
+	tn.lock.Unlock()
+
+	return true
+}
+
+func (tn *TaskNode) TaskNode_idle() time.Duration {
+	tn.lock.RLock()
+	defer tn.lock.RUnlock()
+
+	return tn.Idle
+}
+
+/* the method records the time while the task is active, e.g. a rawnode is offered or processed */
+func (tn *TaskNode) task_touch() {
+	atomic.StoreInt64(&tn.last_active, tn.broker.clock.Now().UnixNano())
+	atomic.StoreInt32(&tn.idle_notified, 0)
+}
+
+/* the method returns the time since the task is active last */
+func (tn *TaskNode) task_quiet(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&tn.last_active)))
+}
+
+/* the method returns true, if the task has no rawnode pending, buffered or spilled and it is not paused */
+func (tn *TaskNode) task_empty() bool {
+	return atomic.LoadInt64(&tn.Stat_pending) == 0 && len(tn.TaskNode_buffer()) == 0 &&
+		tn.TaskNode_spilled() == 0 && !tn.TaskNode_is_paused()
+}
+
+/*
+the method tears down the task, if it is still empty and quiet for the idle. The offering is blocked while
+reaping, so no rawnode is pushed to the reaped task.
+*/
+func (tn *TaskNode) task_reap(now time.Time, idle time.Duration) bool {
+	tn.offer_lock.Lock()
+	defer tn.offer_lock.Unlock()
+
+	if tn.reaped || !tn.task_empty() || tn.task_quiet(now) < idle {
+		return false
+	}
+	tn.reaped = true
+	return tn.TaskNode_unregister()
+}
+
+/* the function reaps the tasks quiet for their Idle, and returns the number of reaped tasks. */
+func (b *Broker) task_reap_all(now time.Time) int {
+	reaped := 0
+	for _, tasknode := range b.tasknode_registry.list() {
+		idle := tasknode.TaskNode_idle()
+		if idle <= 0 || !tasknode.task_empty() {
+			continue
+		}
+		quiet := tasknode.task_quiet(now)
+		if quiet >= idle {
+			if tasknode.task_reap(now, idle) {
+				reaped++
+				atomic.AddInt64(&b.Stat_reaped, 1)
+				b.lifecycle_emit(TASK_EVENT_REAPED, tasknode, quiet)
+			}
+		} else if quiet >= idle/2 && atomic.CompareAndSwapInt32(&tasknode.idle_notified, 0, 1) {
+			b.lifecycle_emit(TASK_EVENT_IDLE, tasknode, quiet)
+		}
+	}
+	return reaped
+}
+
+/* the reaper reaps the idle tasks each DEFAULT_REAP_INTERVAL, and it returns after the broker is shut down. */
+func (b *Broker) Reaper() {
+	for {
+		timer, stop := b.clock.Timer(DEFAULT_REAP_INTERVAL)
+		select {
+		case <-timer:
+			b.task_reap_all(b.clock.Now())
+		case <-b.done:
+			stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package databasic
+
+import "sync"
+
+/*
+The registry type indexes the instances by the id. It is safe for concurrent use, so the router, the scheduler
+and the user can register and unregister the instances while the broker is running. The registry keeps the
+order of registering, which is used to find the "first" and "last" instance. The instance is removed only by
+itself, so a stale instance, e.g. a task reaped and created again, never removes the new one of the same id.
+*/
+type registry[T comparable] struct {
+	lock  sync.RWMutex
+	table map[string]T
+	order []string
+	max   int /* the max number of instances, the registry is unlimited if the max is 0 */
+}
+
+func registry_create[T comparable](max int) *registry[T] {
+	return &registry[T]{
+		table: make(map[string]T),
+		max:   max,
+	}
+}
+
+/* the method adds the value to the registry. It returns false, if the id exists or the registry is full. */
+func (rg *registry[T]) add(id string, value T) bool {
+	rg.lock.Lock()
+	defer rg.lock.Unlock()
+
+	if _, ok := rg.table[id]; ok {
+		return false
+	}
+	if rg.max > 0 && len(rg.table) >= rg.max {
+		return false
+	}
+	rg.table[id] = value
+	rg.order = append(rg.order, id)
+
+	return true
+}
+
+/* the method finds the value named id. The "first" and "last" return the earliest and latest registered one. */
+func (rg *registry[T]) find(id string) (T, bool) {
+	rg.lock.RLock()
+	defer rg.lock.RUnlock()
+
+	if len(rg.order) != 0 {
+		if id == "first" {
+			id = rg.order[0]
+		} else if id == "last" {
+			id = rg.order[len(rg.order)-1]
+		}
+	}
+	value, ok := rg.table[id]
+	return value, ok
+}
+
+/* the method removes the value named id. It returns false, if the id is not found or it names another value. */
+func (rg *registry[T]) remove(id string, value T) bool {
+	rg.lock.Lock()
+	defer rg.lock.Unlock()
+
+	if current, ok := rg.table[id]; !ok || current != value {
+		return false
+	}
+	delete(rg.table, id)
+	for i := range rg.order {
+		if rg.order[i] == id {
+			rg.order = append(rg.order[:i], rg.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+/* the method renames the value from id to new_id, the order of the value is kept. It returns false, if the id names another value. */
+func (rg *registry[T]) rename(id string, new_id string, value T) bool {
+	rg.lock.Lock()
+	defer rg.lock.Unlock()
+
+	if current, ok := rg.table[id]; !ok || current != value {
+		return false
+	}
+	if _, ok := rg.table[new_id]; ok {
+		return false
+	}
+	delete(rg.table, id)
+	rg.table[new_id] = value
+	for i := range rg.order {
+		if rg.order[i] == id {
+			rg.order[i] = new_id
+			break
+		}
+	}
+	return true
+}
+
+/* the method returns all the values in the order of registering */
+func (rg *registry[T]) list() []T {
+	rg.lock.RLock()
+	defer rg.lock.RUnlock()
+
+	values := make([]T, 0, len(rg.order))
+	for _, id := range rg.order {
+		values = append(values, rg.table[id])
+	}
+	return values
+}
+
+func (rg *registry[T]) num() int {
+	rg.lock.RLock()
+	defer rg.lock.RUnlock()
+
+	return len(rg.table)
+}
+
+/*
+the method sets the max number of instances, the 0 means unlimited. The registered instances are kept,
+even if the number of them is greater than the max.
+*/
+func (rg *registry[T]) set_max(max int) {
+	rg.lock.Lock()
+	rg.max = max
+	rg.lock.Unlock()
+}
@@ -0,0 +1,749 @@
+package databasic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The remote distribution forwards the rawnodes of the selected routes to the worker processes, so the load of one
+broker is shared by several processes. The coordinator is the broker calling the Remote_listen, it registers the
+procenode named REMOTE_ID subscribing the routes, whose processor forwards each rawnode to a worker and waits for
+the result. The worker is a broker calling the Remote_serve, it connects to the coordinator, registers itself with
+the route patterns it serves, and handles the forwarded rawnodes by its own procenodes like the Call.
+
+The rawnode is forwarded to the worker chosen by the rendezvous hashing of its Key (or its Id if the Key is empty)
+among the workers serving its route, so the rawnodes of a device go to the same worker and are processed in order,
+and only the devices of a worker leaving are moved to the others. The coordinator pings each worker each
+DEFAULT_REMOTE_HEARTBEAT, the worker silent longer than the DEFAULT_REMOTE_TIMEOUT is dropped, and the rawnodes
+in flight on it are failed with the ErrWorkerLost and retried on the others by the DEFAULT_REMOTE_RETRY. The rawnode
+is delivered at least once, e.g. it is processed twice if the worker is lost before the result is returned. The
+worker reconnects after the DEFAULT_REMOTE_RECONNECT while the connection is broken.
+
+The coordinator and the workers exchange the frames over the tcp, each frame is the gob encoded remote_frame
+prefixed by its length. The type of the Raw and the reply must be registered by the gob.Register.
+
+The coordinator and the workers share a secret, and they authenticate each other while registering: the
+coordinator challenges the worker with a random nonce, the worker proves the secret by the hmac of the nonce and
+challenges the coordinator with its own nonce, and the connection is closed if either proof is wrong. The frames
+are not encrypted, so the coordinator should listen on the loopback or a private network only, e.g. "127.0.0.1:7070"
+or the address of the private interface instead of ":7070".
+*/
+const (
+	REMOTE_ID string = "remote" /* the id of the procenode forwarding the rawnodes on the coordinator */
+)
+
+/* the following const is the kinds of the frames */
+const (
+	REMOTE_REGISTER  int = 1 /* the worker registers itself, and the coordinator acknowledges it with the same kind */
+	REMOTE_RAWNODE   int = 2 /* the coordinator forwards a rawnode */
+	REMOTE_RESULT    int = 3 /* the worker returns the result of a rawnode */
+	REMOTE_PING      int = 4
+	REMOTE_PONG      int = 5
+	REMOTE_CHALLENGE int = 6 /* the coordinator challenges the worker connected with a nonce */
+)
+
+/* the following const should be cared by user */
+const (
+	DEFAULT_REMOTE_CONCURRENCY int           = 16 /* the number of rawnodes forwarded by the coordinator concurrently */
+	DEFAULT_REMOTE_HEARTBEAT   time.Duration = time.Second
+	DEFAULT_REMOTE_TIMEOUT     time.Duration = 3 * time.Second
+	DEFAULT_REMOTE_RECONNECT   time.Duration = time.Second
+	DEFAULT_REMOTE_FRAME_MAX   int           = 16 << 20
+)
+
+var (
+	/* the error is returned, if no worker serves the route of the rawnode */
+	ErrNoWorker = errors.New("no worker serves the rawnode")
+	/* the error is returned, if the worker is lost before the result of the rawnode is returned */
+	ErrWorkerLost = errors.New("the worker is lost")
+	/* the error wraps the error returned by the procenode of the worker */
+	ErrRemoteFailed = errors.New("the rawnode is failed by the worker")
+	/* the error is returned, if the peer unable to prove the shared secret */
+	ErrRemoteAuth = errors.New("the peer is not authenticated by the secret")
+)
+
+/* the retry policy of the procenode forwarding the rawnodes, only the rawnodes unable to reach a worker are retried */
+var DEFAULT_REMOTE_RETRY = RetryPolicy{
+	Max_attempts: 5,
+	Backoff:      100 * time.Millisecond,
+	Max_backoff:  DEFAULT_REMOTE_TIMEOUT,
+	Retryable: func(err error) bool {
+		return errors.Is(err, ErrNoWorker) || errors.Is(err, ErrWorkerLost)
+	},
+}
+
+type remote_frame struct {
+	Kind    int
+	Seq     uint64
+	Worker  string   /* the id of the worker, it is set by the REMOTE_REGISTER */
+	Routes  []string /* the route patterns served by the worker, it is set by the REMOTE_REGISTER */
+	Nonce   []byte   /* the challenge of the REMOTE_CHALLENGE and the REMOTE_REGISTER of the worker */
+	Proof   []byte   /* the hmac of the nonce of the peer by the secret, it is set by the REMOTE_REGISTER */
+	Id      string
+	Key     string
+	Raw     interface{}
+	Timeout time.Duration /* the worker gives up the rawnode after the Timeout */
+	Reply   interface{}
+	Replied bool
+	Error   string
+}
+
+/* the coordinator of the broker, which is created by the Remote_listen */
+type remote_state struct {
+	broker    *Broker
+	listener  net.Listener
+	procenode *ProceNode
+	secret    string
+
+	lock    sync.Mutex /* it protects the workers and the closed */
+	workers map[string]*remote_worker
+	closed  bool
+	done    chan struct{}
+}
+
+/* the worker connected to the coordinator */
+type remote_worker struct {
+	id       string
+	addr     string
+	routes   []string
+	patterns [][]string
+	conn     net.Conn
+
+	write_lock sync.Mutex /* it serializes the writing of the frames */
+
+	lock    sync.Mutex /* it protects the seq and the pending */
+	seq     uint64
+	pending map[uint64]chan *remote_frame
+
+	gone      chan struct{} /* it is closed while the worker is lost */
+	gone_once sync.Once
+
+	last_seen      int64 /* the unix nano of the last frame received from the worker */
+	pinging        int32 /* it is 1 while the ping is writing, so a slow worker has at most one ping in flight */
+	Stat_inflight  int64
+	Stat_forwarded int64
+	Stat_failed    int64
+}
+
+/* the statistics of a worker, which is included in the snapshot of the broker */
+type WorkerSnapshot struct {
+	Id        string    `json:"id"`
+	Addr      string    `json:"addr"`
+	Routes    []string  `json:"routes"`
+	Inflight  int64     `json:"inflight"`
+	Forwarded int64     `json:"forwarded"`
+	Failed    int64     `json:"failed"`
+	Last_seen time.Time `json:"last_seen"`
+}
+
+/*
+the function makes the broker a coordinator, which listens on the addr and forwards the rawnodes whose route
+matches one of the patterns to the workers. Only the workers proving the secret are registered, and the addr
+should be on the loopback or a private network. It returns the address listened, e.g. the port chosen for the
+":0". The coordinator is closed by the Remote_close or while the broker is shut down.
+*/
+func (b *Broker) Remote_listen(addr string, secret string, patterns ...string) (string, error) {
+	if len(patterns) == 0 {
+		return "", errors.New("no route is forwarded")
+	}
+	if secret == "" {
+		return "", errors.New("the secret is empty")
+	}
+	b.remote_lock.Lock()
+	defer b.remote_lock.Unlock()
+	if b.remote != nil {
+		return "", errors.New("the broker is a coordinator already")
+	}
+
+	remote := &remote_state{broker: b, secret: secret, workers: make(map[string]*remote_worker), done: make(chan struct{})}
+	procenode := b.ProceNode_register_pool(ProcessorFunc(remote.remote_process), REMOTE_ID, DEFAULT_REMOTE_CONCURRENCY, nil)
+	if procenode == nil {
+		return "", fmt.Errorf("the procenode %s unable to register", REMOTE_ID)
+	}
+	procenode.ProceNode_set_retry(DEFAULT_REMOTE_RETRY)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		procenode.ProceNode_unregister(context.Background())
+		return "", err
+	}
+	for _, pattern := range patterns {
+		b.Subscribe(pattern, procenode)
+	}
+	remote.listener = listener
+	remote.procenode = procenode
+	b.remote = remote
+
+	go remote.remote_accept()
+	go remote.remote_health()
+	go func() {
+		select {
+		case <-b.done:
+			remote.remote_close()
+		case <-remote.done:
+		}
+	}()
+	log.Printf("The coordinator listens on %s, the routes %s are forwarded.\n\r", listener.Addr(), strings.Join(patterns, ","))
+
+	return listener.Addr().String(), nil
+}
+
+/* the function closes the coordinator, the workers are disconnected and the forwarding procenode is unregistered. */
+func (b *Broker) Remote_close() bool {
+	b.remote_lock.Lock()
+	remote := b.remote
+	b.remote = nil
+	b.remote_lock.Unlock()
+
+	if remote == nil {
+		return false
+	}
+	remote.remote_close()
+	remote.procenode.ProceNode_unregister(context.Background())
+	return true
+}
+
+/* the function returns the statistics of the workers connected to the coordinator, which are sorted by the id */
+func (b *Broker) Remote_workers() []WorkerSnapshot {
+	b.remote_lock.Lock()
+	remote := b.remote
+	b.remote_lock.Unlock()
+
+	if remote == nil {
+		return nil
+	}
+	var snapshots []WorkerSnapshot
+	for _, worker := range remote.remote_list() {
+		snapshots = append(snapshots, WorkerSnapshot{
+			Id:        worker.id,
+			Addr:      worker.addr,
+			Routes:    worker.routes,
+			Inflight:  atomic.LoadInt64(&worker.Stat_inflight),
+			Forwarded: atomic.LoadInt64(&worker.Stat_forwarded),
+			Failed:    atomic.LoadInt64(&worker.Stat_failed),
+			Last_seen: time.Unix(0, atomic.LoadInt64(&worker.last_seen)),
+		})
+	}
+	return snapshots
+}
+
+func (remote *remote_state) remote_close() {
+	remote.lock.Lock()
+	if remote.closed {
+		remote.lock.Unlock()
+		return
+	}
+	remote.closed = true
+	close(remote.done)
+	workers := remote.workers
+	remote.workers = make(map[string]*remote_worker)
+	remote.lock.Unlock()
+
+	remote.listener.Close()
+	for _, worker := range workers {
+		worker.worker_lost()
+	}
+}
+
+/* the method returns the workers sorted by the id */
+func (remote *remote_state) remote_list() []*remote_worker {
+	remote.lock.Lock()
+	defer remote.lock.Unlock()
+
+	workers := make([]*remote_worker, 0, len(remote.workers))
+	for _, worker := range remote.workers {
+		workers = append(workers, worker)
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].id < workers[j].id })
+	return workers
+}
+
+/* the coordinator accepts the connections of the workers until it is closed */
+func (remote *remote_state) remote_accept() {
+	for {
+		conn, err := remote.listener.Accept()
+		if err != nil {
+			select {
+			case <-remote.done:
+				return
+			default:
+			}
+			log.Printf("The coordinator unable to accept a worker: %s\n\r", err.Error())
+			time.Sleep(DEFAULT_REMOTE_RECONNECT)
+			continue
+		}
+		go remote.remote_session(conn)
+	}
+}
+
+/*
+the function registers the worker connected by the conn, and receives its frames until it is lost. The worker
+is challenged at first, and it is refused if it unable to prove the secret.
+*/
+func (remote *remote_state) remote_session(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	frame := new(remote_frame)
+	nonce, err := remote_nonce()
+	if err == nil {
+		conn.SetWriteDeadline(time.Now().Add(DEFAULT_REMOTE_TIMEOUT))
+		err = remote_write(conn, &remote_frame{Kind: REMOTE_CHALLENGE, Nonce: nonce})
+	}
+	if err == nil {
+		conn.SetReadDeadline(time.Now().Add(DEFAULT_REMOTE_TIMEOUT))
+		err = remote_read(reader, frame)
+	}
+	if err == nil && (frame.Kind != REMOTE_REGISTER || frame.Worker == "") {
+		err = errors.New("the first frame is not a registering")
+	}
+	if err == nil && !hmac.Equal(frame.Proof, remote_proof(remote.secret, "worker", nonce, frame.Worker)) {
+		err = ErrRemoteAuth
+	}
+	if err != nil {
+		log.Printf("The worker from %s unable to register: %s\n\r", conn.RemoteAddr(), err.Error())
+		conn.Close()
+		return
+	}
+
+	worker := &remote_worker{
+		id:      frame.Worker,
+		addr:    conn.RemoteAddr().String(),
+		routes:  frame.Routes,
+		conn:    conn,
+		pending: make(map[uint64]chan *remote_frame),
+		gone:    make(chan struct{}),
+	}
+	for _, route := range frame.Routes {
+		worker.patterns = append(worker.patterns, strings.Split(route, ROUTE_SEPARATOR))
+	}
+	atomic.StoreInt64(&worker.last_seen, time.Now().UnixNano())
+	ack := &remote_frame{Kind: REMOTE_REGISTER, Worker: worker.id, Proof: remote_proof(remote.secret, "coordinator", frame.Nonce, worker.id)}
+	if err := worker.worker_write(ack); err != nil {
+		worker.worker_lost()
+		return
+	}
+
+	/* the worker registering again replaces the old connection, e.g. after the network is broken */
+	remote.lock.Lock()
+	if remote.closed {
+		remote.lock.Unlock()
+		worker.worker_lost()
+		return
+	}
+	old := remote.workers[worker.id]
+	remote.workers[worker.id] = worker
+	remote.lock.Unlock()
+	if old != nil {
+		old.worker_lost()
+	}
+	log.Printf("The worker %s from %s is registered, it serves the routes %v.\n\r", worker.id, worker.addr, worker.routes)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(DEFAULT_REMOTE_TIMEOUT))
+		frame := new(remote_frame)
+		err := remote_read(reader, frame)
+		if err != nil {
+			remote.remote_drop(worker, err)
+			return
+		}
+		atomic.StoreInt64(&worker.last_seen, time.Now().UnixNano())
+		if frame.Kind == REMOTE_RESULT {
+			worker.lock.Lock()
+			result := worker.pending[frame.Seq]
+			delete(worker.pending, frame.Seq)
+			worker.lock.Unlock()
+			if result != nil {
+				result <- frame
+			}
+		}
+	}
+}
+
+/* the function removes the worker from the coordinator, the rawnodes in flight on it are rebalanced by the retries */
+func (remote *remote_state) remote_drop(worker *remote_worker, err error) {
+	remote.lock.Lock()
+	if remote.workers[worker.id] == worker {
+		delete(remote.workers, worker.id)
+	}
+	remote.lock.Unlock()
+
+	select {
+	case <-worker.gone:
+		return
+	default:
+	}
+	worker.worker_lost()
+	log.Printf("The worker %s is lost: %s, its rawnodes are moved to the others.\n\r", worker.id, err.Error())
+}
+
+/*
+the coordinator pings the workers each DEFAULT_REMOTE_HEARTBEAT, and drops the workers silent for the DEFAULT_REMOTE_TIMEOUT.
+The ping is written by its own go routine, so a worker slow to read never delays the others, and the worker is skipped
+while its previous ping is still writing.
+*/
+func (remote *remote_state) remote_health() {
+	ticker := time.NewTicker(DEFAULT_REMOTE_HEARTBEAT)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-remote.done:
+			return
+		case now := <-ticker.C:
+			for _, worker := range remote.remote_list() {
+				if now.Sub(time.Unix(0, atomic.LoadInt64(&worker.last_seen))) > DEFAULT_REMOTE_TIMEOUT {
+					remote.remote_drop(worker, errors.New("the health check is timeout"))
+					continue
+				}
+				if !atomic.CompareAndSwapInt32(&worker.pinging, 0, 1) {
+					continue
+				}
+				go func(worker *remote_worker) {
+					defer atomic.StoreInt32(&worker.pinging, 0)
+					if err := worker.worker_write(&remote_frame{Kind: REMOTE_PING}); err != nil {
+						remote.remote_drop(worker, err)
+					}
+				}(worker)
+			}
+		}
+	}
+}
+
+/* the function returns the worker chosen by the rendezvous hashing among the workers serving the rawnode */
+func (remote *remote_state) remote_pick(rawnode *RawNode) *remote_worker {
+	key := rawnode.Key
+	if key == "" {
+		key = rawnode.Id
+	}
+	words := strings.Split(rawnode.Id, ROUTE_SEPARATOR)
+
+	var chosen *remote_worker
+	var best uint64
+	for _, worker := range remote.remote_list() {
+		if !worker.worker_serve(words) {
+			continue
+		}
+		hash := fnv.New64a()
+		hash.Write([]byte(worker.id))
+		hash.Write([]byte{0})
+		hash.Write([]byte(key))
+		if score := hash.Sum64(); chosen == nil || score > best {
+			chosen, best = worker, score
+		}
+	}
+	return chosen
+}
+
+/* the processor of the REMOTE_ID procenode, which forwards the rawnode to a worker and waits for the result */
+func (remote *remote_state) remote_process(ctx context.Context, tasknode *TaskNode, rawnode *RawNode) error {
+	worker := remote.remote_pick(rawnode)
+	if worker == nil {
+		return fmt.Errorf("%w: %s", ErrNoWorker, rawnode.Id)
+	}
+	frame, err := worker.worker_forward(ctx, rawnode)
+	if err != nil {
+		if errors.Is(err, ErrWorkerLost) {
+			remote.remote_drop(worker, err)
+		}
+		return err
+	}
+	if frame.Error != "" {
+		atomic.AddInt64(&worker.Stat_failed, 1)
+		return fmt.Errorf("%w: the worker %s: %s", ErrRemoteFailed, worker.id, frame.Error)
+	}
+	if frame.Replied {
+		Reply(rawnode, frame.Reply)
+	}
+	return nil
+}
+
+/* the method returns true, if the worker serves the route, the worker without route serves all the routes */
+func (worker *remote_worker) worker_serve(words []string) bool {
+	if len(worker.patterns) == 0 {
+		return true
+	}
+	for _, pattern := range worker.patterns {
+		if route_words_match(pattern, words) {
+			return true
+		}
+	}
+	return false
+}
+
+/* the method sends the rawnode to the worker, and returns the result frame */
+func (worker *remote_worker) worker_forward(ctx context.Context, rawnode *RawNode) (*remote_frame, error) {
+	result := make(chan *remote_frame, 1)
+	worker.lock.Lock()
+	worker.seq++
+	seq := worker.seq
+	worker.pending[seq] = result
+	worker.lock.Unlock()
+	defer func() {
+		worker.lock.Lock()
+		delete(worker.pending, seq)
+		worker.lock.Unlock()
+	}()
+
+	atomic.AddInt64(&worker.Stat_inflight, 1)
+	defer atomic.AddInt64(&worker.Stat_inflight, -1)
+
+	frame := &remote_frame{Kind: REMOTE_RAWNODE, Seq: seq, Id: rawnode.Id, Key: rawnode.Key, Raw: rawnode.Raw}
+	if deadline, ok := ctx.Deadline(); ok {
+		frame.Timeout = time.Until(deadline)
+	}
+	err := worker.worker_write(frame)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrWorkerLost, err.Error())
+	}
+	atomic.AddInt64(&worker.Stat_forwarded, 1)
+
+	select {
+	case frame := <-result:
+		return frame, nil
+	case <-worker.gone:
+		return nil, fmt.Errorf("%w: %s", ErrWorkerLost, worker.id)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+/* the method writes the frame to the worker, the writing is given up after the DEFAULT_REMOTE_TIMEOUT */
+func (worker *remote_worker) worker_write(frame *remote_frame) error {
+	worker.write_lock.Lock()
+	defer worker.write_lock.Unlock()
+
+	worker.conn.SetWriteDeadline(time.Now().Add(DEFAULT_REMOTE_TIMEOUT))
+	return remote_write(worker.conn, frame)
+}
+
+/* the method closes the connection, the rawnodes waiting for the results are failed with the ErrWorkerLost */
+func (worker *remote_worker) worker_lost() {
+	worker.gone_once.Do(func() {
+		close(worker.gone)
+		worker.conn.Close()
+	})
+}
+
+/*
+the function makes the broker a worker named id, which connects to the coordinator listening on the addr and
+handles the rawnodes whose route matches one of the patterns, all the rawnodes forwarded are handled if no pattern
+is given. The worker and the coordinator authenticate each other by the secret. The rawnode is handled by the
+procenodes of the broker like the Call, so the reply is returned to the caller of the coordinator. It reconnects after the DEFAULT_REMOTE_RECONNECT while the connection is broken, and
+returns the ctx.Err() after the ctx is done.
+*/
+func (b *Broker) Remote_serve(ctx context.Context, addr string, id string, secret string, patterns ...string) error {
+	if id == "" {
+		return errors.New("the worker id is empty")
+	}
+	if secret == "" {
+		return errors.New("the secret is empty")
+	}
+	for {
+		err := b.remote_serve(ctx, addr, id, secret, patterns)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("The worker %s is disconnected from %s: %s, it reconnects after %s.\n\r", id, addr, err.Error(), DEFAULT_REMOTE_RECONNECT)
+		timer := time.NewTimer(DEFAULT_REMOTE_RECONNECT)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+/* the function serves the coordinator over a connection until it is broken */
+func (b *Broker) remote_serve(ctx context.Context, addr string, id string, secret string, patterns []string) error {
+	dialer := net.Dialer{Timeout: DEFAULT_REMOTE_TIMEOUT}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	/* the connection to the coordinator is written like the one to a worker */
+	coordinator := &remote_worker{id: addr, conn: conn}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	err = remote_register(coordinator, reader, id, secret, patterns)
+	if err != nil {
+		return err
+	}
+	log.Printf("The worker %s is registered to the coordinator %s.\n\r", id, addr)
+
+	for {
+		/* the coordinator pings each DEFAULT_REMOTE_HEARTBEAT, so the silent one is lost */
+		conn.SetReadDeadline(time.Now().Add(DEFAULT_REMOTE_TIMEOUT))
+		frame := new(remote_frame)
+		err := remote_read(reader, frame)
+		if err != nil {
+			return err
+		}
+		switch frame.Kind {
+		case REMOTE_PING:
+			go coordinator.worker_write(&remote_frame{Kind: REMOTE_PONG})
+		case REMOTE_RAWNODE:
+			go b.remote_handle(ctx, coordinator, frame)
+		}
+	}
+}
+
+/*
+the function answers the challenge of the coordinator by the secret, registers the worker and checks the proof of
+the coordinator. The ErrRemoteAuth is returned, if the coordinator unable to prove the secret.
+*/
+func remote_register(coordinator *remote_worker, reader *bufio.Reader, id string, secret string, patterns []string) error {
+	challenge := new(remote_frame)
+	coordinator.conn.SetReadDeadline(time.Now().Add(DEFAULT_REMOTE_TIMEOUT))
+	err := remote_read(reader, challenge)
+	if err != nil {
+		return err
+	}
+	if challenge.Kind != REMOTE_CHALLENGE {
+		return errors.New("the coordinator does not challenge the worker")
+	}
+	nonce, err := remote_nonce()
+	if err != nil {
+		return err
+	}
+	register := &remote_frame{Kind: REMOTE_REGISTER, Worker: id, Routes: patterns, Nonce: nonce}
+	register.Proof = remote_proof(secret, "worker", challenge.Nonce, id)
+	err = coordinator.worker_write(register)
+	if err != nil {
+		return err
+	}
+
+	ack := new(remote_frame)
+	err = remote_read(reader, ack)
+	if err != nil {
+		return err
+	}
+	if ack.Kind != REMOTE_REGISTER {
+		return errors.New("the registering is not acknowledged")
+	}
+	if !hmac.Equal(ack.Proof, remote_proof(secret, "coordinator", nonce, id)) {
+		return ErrRemoteAuth
+	}
+	return nil
+}
+
+/* the function returns a random nonce challenging the peer */
+func remote_nonce() ([]byte, error) {
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+/* the function returns the proof of the secret, the role keeps the proof of a side from being replayed by the other */
+func remote_proof(secret string, role string, nonce []byte, id string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(role))
+	mac.Write([]byte{0})
+	mac.Write(nonce)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
+
+/*
+the function handles the rawnode forwarded by the coordinator, and returns the result. The result is not returned
+while the worker is stopping, so the coordinator retries the rawnode on the others after the connection is closed.
+*/
+func (b *Broker) remote_handle(serve context.Context, coordinator *remote_worker, frame *remote_frame) {
+	timeout := frame.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_CALL_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(serve, timeout)
+	defer cancel()
+
+	reply, err := b.call(ctx, RawNode_create_key(frame.Id, frame.Key, frame.Raw))
+	if serve.Err() != nil {
+		return
+	}
+	result := &remote_frame{Kind: REMOTE_RESULT, Seq: frame.Seq}
+	if err == nil {
+		result.Reply, result.Replied = reply, true
+	} else if !errors.Is(err, ErrNoReply) {
+		result.Error = err.Error()
+	}
+	err = coordinator.worker_write(result)
+	if err != nil {
+		log.Printf("The result of the rawnode %s unable to return: %s\n\r", frame.Id, err.Error())
+	}
+}
+
+/* the function writes the frame prefixed by the length */
+func remote_write(writer io.Writer, frame *remote_frame) error {
+	var buffer bytes.Buffer
+	buffer.Write(make([]byte, 4))
+	err := gob.NewEncoder(&buffer).Encode(frame)
+	if err != nil {
+		return err
+	}
+	data := buffer.Bytes()
+	if len(data)-4 > DEFAULT_REMOTE_FRAME_MAX {
+		return fmt.Errorf("the frame of %d bytes is too large", len(data)-4)
+	}
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	_, err = writer.Write(data)
+	return err
+}
+
+/* the function reads a frame prefixed by the length */
+func remote_read(reader io.Reader, frame *remote_frame) error {
+	var header [4]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if int64(size) > int64(DEFAULT_REMOTE_FRAME_MAX) {
+		return fmt.Errorf("the frame of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(frame)
+}
+
+func Remote_listen(addr string, secret string, patterns ...string) (string, error) {
+	return global_broker.Remote_listen(addr, secret, patterns...)
+}
+
+func Remote_close() bool {
+	return global_broker.Remote_close()
+}
+
+func Remote_workers() []WorkerSnapshot {
+	return global_broker.Remote_workers()
+}
+
+func Remote_serve(ctx context.Context, addr string, id string, secret string, patterns ...string) error {
+	return global_broker.Remote_serve(ctx, addr, id, secret, patterns...)
+}
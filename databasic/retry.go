@@ -0,0 +1,132 @@
+package databasic
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The RetryPolicy type decides how a failed calling of procenode is retried. The rawnode is parked in the dead
+letter tasknode, if the callings are exhausted or the error is permanent.
+*/
+type RetryPolicy struct {
+	Max_attempts int                  /* the max number of callings including the first one, 1 means no retry */
+	Backoff      time.Duration        /* the delay before the first retry */
+	Max_backoff  time.Duration        /* the max delay between two callings, 0 means unlimited */
+	Multiplier   float64              /* the delay is multiplied by the Multiplier after each retry, less than 1 means 2 */
+	Retryable    func(err error) bool /* it returns false, if the error is permanent. nil means all the errors except the Permanent are retryable */
+}
+
+/* the default policy never retries, the failed rawnode is parked in the dead letter store directly */
+var DEFAULT_RETRY_POLICY = RetryPolicy{
+	Max_attempts: 1,
+}
+
+type permanentError struct {
+	err error
+}
+
+func (pe *permanentError) Error() string {
+	return pe.err.Error()
+}
+
+func (pe *permanentError) Unwrap() error {
+	return pe.err
+}
+
+/* the function marks the error as permanent, the rawnode failed with the error is never retried */
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+/* the function returns true, if the error is marked by the Permanent or is the ErrPayloadType */
+func Is_permanent(err error) bool {
+	var pe *permanentError
+	return errors.As(err, &pe) || errors.Is(err, ErrPayloadType)
+}
+
+/* the method returns true, if the rawnode failed with the err should be retried after the attempts callings */
+func (rp RetryPolicy) retry(err error, attempts int) bool {
+	if attempts >= rp.Max_attempts || Is_permanent(err) {
+		return false
+	}
+	if rp.Retryable != nil {
+		return rp.Retryable(err)
+	}
+	return true
+}
+
+/* the method returns the delay after the delay of last retry */
+func (rp RetryPolicy) next(delay time.Duration) time.Duration {
+	multiplier := rp.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	delay = time.Duration(float64(delay) * multiplier)
+	if rp.Max_backoff > 0 && delay > rp.Max_backoff {
+		delay = rp.Max_backoff
+	}
+	return delay
+}
+
+/*
+the function calls the method until the rawnode is processed successfully or the retry policy of procenode gives
+up. Each calling runs in a running slot. The rawnodes following it wait for the retries, which keep the order
+of rawnodes having the same key.
+*/
+func task_retry(tasknode *TaskNode, procenode *ProceNode, rawnode *RawNode) error {
+	/* the version current now handles the rawnode until it is finished, even if a new version is swapped in */
+	version := procenode.version_acquire()
+	defer version.version_release()
+	method := version.processor
+	policy := procenode.ProceNode_retry()
+	delay := policy.Backoff
+
+	ctx := rawnode.rawnode_context()
+	for {
+		/* the call is skipped, if the caller gives up before the calling */
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		/* the calling waits for a running slot, which is granted by the priority and weight of the task */
+		atomic.AddInt64(&tasknode.Stat_waiting, 1)
+		acquired := tasknode.broker.running_acquire(tasknode)
+		atomic.AddInt64(&tasknode.Stat_waiting, -1)
+		if !acquired {
+			return ErrTaskCanceled
+		}
+		rawnode.Attempts++
+		atomic.AddInt64(&tasknode.Stat_running, 1)
+		err := task_process(tasknode, method, rawnode)
+		atomic.AddInt64(&tasknode.Stat_running, -1)
+		tasknode.broker.running_release()
+		if err == nil {
+			rawnode.Failure = nil
+			return nil
+		}
+		rawnode.Failure = err
+		if !policy.retry(err, rawnode.Attempts) {
+			return err
+		}
+
+		timer, stop := tasknode.broker.clock.Timer(delay)
+		unblock := clock_block(tasknode.broker.clock)
+		select {
+		case <-timer:
+		case <-tasknode.Cancel:
+			stop()
+			unblock()
+			return err
+		case <-ctx.Done():
+			stop()
+			unblock()
+			return err
+		}
+		unblock()
+		delay = policy.next(delay)
+	}
+}
@@ -0,0 +1,277 @@
+package databasic
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+A procenode subscribes a route by the Subscribe, and the rawnodes whose id is the route are delivered to the
+task named the procenode id. A route can be subscribed by several procenodes, each of them receives a copy
+of the rawnode, e.g. the storage, the rules and the live streaming. The copies share the Raw, so the
+processors should not modify it.
+
+The route is a dot-separated hierarchical key, e.g. "aliyun.<productKey>.<deviceName>.property", and the
+procenode subscribes a pattern of it. In the pattern "*" matches exactly one word and "#" matches zero or more
+words, which is the same as the amqp topic exchange. While several patterns match a route, only the subscribers
+of the most specific pattern receive the rawnode. The patterns are compared word by word from the left, the
+literal word is more specific than "*", and "*" is more specific than "#".
+
+The pipeline chains the procenodes as stages. A stage emits its output to the route named the procenode id
+with the ROUTE_OUTPUT_SUFFIX, which is subscribed by the next stage, e.g. decode -> validate -> enrich -> store.
+*/
+const (
+	ROUTE_OUTPUT_SUFFIX      string = ".out"
+	ROUTE_SEPARATOR          string = "."
+	DEFAULT_ROUTE_CACHE_SIZE int    = 10000
+)
+
+/* the error is returned, if no task is able to process the rawnode */
+var ErrNoRoute = errors.New("the rawnode has no route")
+
+func (b *Broker) subscription_init() {
+	b.subscription_lock.Lock()
+	b.subscriptions = make(map[string][]*ProceNode)
+	b.route_cache = make(map[string]string)
+	b.subscription_lock.Unlock()
+}
+
+/*
+the function subscribes the route pattern for the procenode. It returns false, if the procenode subscribes it
+already. The route without wildcard is the most specific pattern of itself.
+*/
+func (b *Broker) Subscribe(route string, procenode *ProceNode) bool {
+	if route == "" || procenode == nil {
+		return false
+	}
+	b.subscription_lock.Lock()
+	defer b.subscription_lock.Unlock()
+
+	b.route_cache = make(map[string]string)
+
+	for _, subscriber := range b.subscriptions[route] {
+		if subscriber == procenode {
+			return false
+		}
+	}
+	b.subscriptions[route] = append(b.subscriptions[route], procenode)
+
+	return true
+}
+
+func (b *Broker) Unsubscribe(route string, procenode *ProceNode) bool {
+	b.subscription_lock.Lock()
+	defer b.subscription_lock.Unlock()
+
+	b.route_cache = make(map[string]string)
+	return b.subscription_remove(route, procenode)
+}
+
+/* the function removes all the subscriptions of the procenode, it is called while the procenode is unregistered */
+func (b *Broker) unsubscribe_all(procenode *ProceNode) {
+	b.subscription_lock.Lock()
+	defer b.subscription_lock.Unlock()
+
+	b.route_cache = make(map[string]string)
+	for route := range b.subscriptions {
+		b.subscription_remove(route, procenode)
+	}
+}
+
+/* the function removes the subscription, the subscription_lock of the broker must be held. */
+func (b *Broker) subscription_remove(route string, procenode *ProceNode) bool {
+	subscribers := b.subscriptions[route]
+	for i := range subscribers {
+		if subscribers[i] == procenode {
+			subscribers = append(subscribers[:i:i], subscribers[i+1:]...)
+			if len(subscribers) == 0 {
+				delete(b.subscriptions, route)
+			} else {
+				b.subscriptions[route] = subscribers
+			}
+			return true
+		}
+	}
+	return false
+}
+
+/* the function returns the subscribers of the most specific pattern matching the route, the cache holds the pattern */
+func (b *Broker) route_subscribers(route string) []*ProceNode {
+	b.subscription_lock.RLock()
+	pattern, ok := b.route_cache[route]
+	if ok {
+		subscribers := b.subscriptions[pattern]
+		b.subscription_lock.RUnlock()
+		return subscribers
+	}
+	b.subscription_lock.RUnlock()
+
+	b.subscription_lock.Lock()
+	defer b.subscription_lock.Unlock()
+
+	pattern = b.route_match(route)
+	if len(b.route_cache) >= DEFAULT_ROUTE_CACHE_SIZE {
+		b.route_cache = make(map[string]string)
+	}
+	b.route_cache[route] = pattern
+
+	return b.subscriptions[pattern]
+}
+
+/* the function returns the most specific pattern matching the route, the subscription_lock of the broker must be held. */
+func (b *Broker) route_match(route string) string {
+	return route_best(b.subscriptions, route)
+}
+
+/* the function returns the most specific pattern of the map matching the route, or "" if no pattern matches it. */
+func route_best[T any](patterns map[string]T, route string) string {
+	/* the route of the pattern literally is the most specific one */
+	if _, ok := patterns[route]; ok {
+		return route
+	}
+	words := strings.Split(route, ROUTE_SEPARATOR)
+	best := ""
+	var best_words []string
+	for pattern := range patterns {
+		pattern_words := strings.Split(pattern, ROUTE_SEPARATOR)
+		if !route_words_match(pattern_words, words) {
+			continue
+		}
+		if best == "" || route_compare(pattern_words, best_words) > 0 || (route_compare(pattern_words, best_words) == 0 && pattern < best) {
+			best = pattern
+			best_words = pattern_words
+		}
+	}
+	return best
+}
+
+/* the function returns true, if the pattern matches the words of route */
+func route_words_match(pattern []string, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		/* the "#" matches zero or more words */
+		for i := 0; i <= len(words); i++ {
+			if route_words_match(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) != 0 && route_words_match(pattern[1:], words[1:])
+	default:
+		return len(words) != 0 && pattern[0] == words[0] && route_words_match(pattern[1:], words[1:])
+	}
+}
+
+/*
+the function compares the specificity of two patterns matching the same route. It returns a positive number,
+if the a is more specific than the b.
+*/
+func route_compare(a []string, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if rank := route_word_rank(a[i]) - route_word_rank(b[i]); rank != 0 {
+			return rank
+		}
+	}
+	/* the longer pattern covers less words by the "#" */
+	return len(a) - len(b)
+}
+
+func route_word_rank(word string) int {
+	switch word {
+	case "#":
+		return 0
+	case "*":
+		return 1
+	default:
+		return 2
+	}
+}
+
+/*
+the function joins the words as a route, the separator in the words is replaced by "_", e.g. the device
+name containing ".", so each word is a level of the route.
+*/
+func Route_join(words ...string) string {
+	escaped := make([]string, len(words))
+	for i := range words {
+		escaped[i] = strings.ReplaceAll(words[i], ROUTE_SEPARATOR, "_")
+	}
+	return strings.Join(escaped, ROUTE_SEPARATOR)
+}
+
+/*
+the function chains the procenodes as a pipeline, the first stage subscribes the route and each of the
+following stages subscribes the output of the previous one.
+*/
+func (b *Broker) Pipeline(route string, stages ...*ProceNode) error {
+	if route == "" || len(stages) == 0 {
+		return errors.New("argument error")
+	}
+	for i, stage := range stages {
+		if stage == nil {
+			return fmt.Errorf("the stage %d of the pipeline is nil", i)
+		}
+		from := route
+		if i != 0 {
+			from = stages[i-1].ProceNode_output()
+		}
+		b.Subscribe(from, stage)
+	}
+	return nil
+}
+
+/* the method returns the route of the output emitted by the procenode */
+func (pn *ProceNode) ProceNode_output() string {
+	return pn.Id + ROUTE_OUTPUT_SUFFIX
+}
+
+/*
+the function emits the raw as the output of the stage processing the rawnode, which is routed to the
+subscribers of the output directly. The key of the rawnode is kept, so the order of a key is kept through
+the pipeline. The error is returned, if the output is not delivered, and the stage should fail with it.
+*/
+func Emit(tasknode *TaskNode, rawnode *RawNode, raw interface{}) error {
+	procenode := tasknode.TaskNode_method()
+	if procenode == nil {
+		return ErrNoRoute
+	}
+	broker := tasknode.broker
+	output := RawNode_create_key(procenode.ProceNode_output(), rawnode.Key, raw)
+	if len(broker.route_subscribers(output.Id)) == 0 {
+		return fmt.Errorf("%w: nobody subscribes %s", ErrNoRoute, output.Id)
+	}
+	err := broker.wal_append(output)
+	if err != nil {
+		return err
+	}
+	return broker.router_route(output)
+}
+
+/*
+the function copies the rawnode for the subscriber whose task is named task, the copy shares the Raw, the reply of
+the call and the entry of the write-ahead log, and it has no Admit.
+*/
+func rawnode_copy(rawnode *RawNode, task string) *RawNode {
+	copied := RawNode_create_key(rawnode.Id, rawnode.Key, rawnode.Raw)
+	copied.reply = rawnode.reply
+	copied.task = task
+	wal_share(rawnode, copied)
+	return copied
+}
+
+func Subscribe(route string, procenode *ProceNode) bool {
+	return global_broker.Subscribe(route, procenode)
+}
+
+func Unsubscribe(route string, procenode *ProceNode) bool {
+	return global_broker.Unsubscribe(route, procenode)
+}
+
+func Pipeline(route string, stages ...*ProceNode) error {
+	return global_broker.Pipeline(route, stages...)
+}
@@ -0,0 +1,177 @@
+package databasic
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+/* the following const should be cared by user */
+const (
+	DEFAULT_SHUTDOWN_TIMEOUT time.Duration = 10 * time.Second
+	DEFAULT_DRAIN_INTERVAL   time.Duration = 10 * time.Millisecond
+)
+
+/* the error is returned, if the broker is shut down already */
+var ErrBrokerClosed = errors.New("the broker is shut down")
+
+/*
+The ShutdownReport records the rawnodes left undelivered by the Shutdown. The rawnodes still in the task
+buffers were admitted already, e.g. the amqp message is accepted, so the ones not kept in the write-ahead log
+are returned in the Rawnodes, and they are lost unless the caller persists them, e.g. by the DeadLetter_park.
+The ones kept in the log are replayed after restarting, and the calls are failed with the ErrBrokerClosed.
+The rawnodes delayed by the rate limit are not admitted yet, they are admitted with nil if they are kept in
+the log, otherwise they are admitted with the ErrBrokerClosed to be redelivered by their source. The rawnodes
+dispatched to the worker go routines or in processing are only counted in the Undelivered.
+*/
+type ShutdownReport struct {
+	Undelivered map[string]int64 /* the number of undelivered rawnodes of each task, the drained tasks are not included */
+	Rawnodes    []*RawNode       /* the undelivered rawnodes admitted but not kept in the write-ahead log */
+	Logged      int              /* the number of undelivered rawnodes kept in the write-ahead log */
+	Parked      int              /* the number of rawnodes parked in the dead letter store during the shutdown */
+	Spilled     map[string]int   /* the number of rawnodes left on the disk of each task, they are reloaded after restarting */
+}
+
+/* the method returns the number of undelivered rawnodes of all the tasks */
+func (sr *ShutdownReport) Total() int64 {
+	var total int64
+	for _, num := range sr.Undelivered {
+		total += num
+	}
+	return total
+}
+
+/*
+the function shuts down the broker. It stops the intake at first, and the Send_raw returns false after that.
+Then the rawnodes in the raw channel and the task buffers are processed by their procenodes, until all
+of them are finished or the ctx is done. The paused tasks are resumed to be drained. At last the task go routines
+are stopped, and the undelivered rawnodes are reported. The error is the ctx.Err(), if the ctx is done before
+all the rawnodes are finished.
+*/
+func (b *Broker) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	/* stop the intake, the router returns after routing the rawnodes left in the raw channel */
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return nil, ErrBrokerClosed
+	}
+	b.closed = true
+	close(b.stopping)
+	/* the rawnodes parked before the shutdown are not counted in the report */
+	parked := atomic.LoadInt64(&b.parked)
+	b.lock.Unlock()
+	b.senders.Wait()
+	close(b.raw_channel)
+
+	err := b.shutdown_drain(ctx)
+
+	/* stop the scheduler and the controler, the scheduler is kept running while draining to run the new tasks */
+	b.schedule_lock.Lock()
+	b.schedule_stopped = true
+	b.schedule_lock.Unlock()
+	b.schedule_cond.Broadcast()
+	close(b.done)
+	b.group.Wait()
+
+	report := new(ShutdownReport)
+	report.Undelivered = make(map[string]int64)
+	report.Spilled = make(map[string]int)
+	for _, tasknode := range b.tasknode_registry.list() {
+		tasknode.TaskNode_unregister()
+		for rawnode := tasknode.TaskNode_Fetch(); rawnode != nil; rawnode = tasknode.TaskNode_Fetch() {
+			report.shutdown_undelivered(rawnode, true)
+			report.Undelivered[tasknode.Id]++
+		}
+		if spilled := tasknode.TaskNode_spilled(); spilled > 0 {
+			report.Spilled[tasknode.Id] = spilled
+		}
+		/* the rawnodes dispatched to the workers or in processing are abandoned */
+		if pending := atomic.LoadInt64(&tasknode.Stat_pending); pending > 0 {
+			report.Undelivered[tasknode.Id] += pending
+		}
+	}
+	/* the rawnodes delayed by the rate limit while the ctx is done are undelivered */
+	for _, rawnode := range b.ratelimit_flush() {
+		report.shutdown_undelivered(rawnode, false)
+		report.Undelivered[rawnode.Id]++
+	}
+	report.Parked = int(atomic.LoadInt64(&b.parked) - parked)
+
+	return report, err
+}
+
+/*
+the method records the undelivered rawnode in the report, the admitted is false for the rawnode not admitted
+yet. The rawnode without the Admit is returned in the Rawnodes, because nobody redelivers it.
+*/
+func (sr *ShutdownReport) shutdown_undelivered(rawnode *RawNode, admitted bool) {
+	rawnode.Failure = ErrBrokerClosed
+	switch {
+	case rawnode.reply != nil:
+		rawnode.rawnode_fail(ErrBrokerClosed)
+	case rawnode.wal != nil:
+		sr.Logged++
+		if !admitted {
+			rawnode.rawnode_admit(nil)
+		}
+	case admitted || rawnode.Admit == nil:
+		sr.Rawnodes = append(sr.Rawnodes, rawnode)
+	default:
+		rawnode.rawnode_admit(ErrBrokerClosed)
+	}
+}
+
+/* the function waits until the router returns and the rawnodes of all the tasks are finished */
+func (b *Broker) shutdown_drain(ctx context.Context) error {
+	select {
+	case <-b.router_done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	/* the rawnodes delayed by the rate limit are routed at once, so they are drained with the others */
+	for _, rawnode := range b.ratelimit_flush() {
+		b.router_route(rawnode)
+	}
+
+	ticker := time.NewTicker(DEFAULT_DRAIN_INTERVAL)
+	defer ticker.Stop()
+	for {
+		drained := true
+		for _, tasknode := range b.tasknode_registry.list() {
+			tasknode.TaskNode_resume()
+			if atomic.LoadInt64(&tasknode.Stat_pending) > 0 {
+				drained = false
+			}
+		}
+		if drained {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	return global_broker.Shutdown(ctx)
+}
+
+func shutdown_report_log(report *ShutdownReport, err error) {
+	if err != nil {
+		log.Printf("The broker is shut down before draining: %s\n\r", err.Error())
+	}
+	for id, num := range report.Undelivered {
+		log.Printf("The task %s is shut down with %d undelivered rawnodes!\n\r", id, num)
+	}
+	if report.Logged > 0 {
+		log.Printf("The broker is shut down with %d rawnodes kept in the write-ahead log!\n\r", report.Logged)
+	}
+	if report.Parked > 0 {
+		log.Printf("The broker is shut down with %d rawnodes parked in the dead letter!\n\r", report.Parked)
+	}
+}
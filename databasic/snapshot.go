@@ -0,0 +1,382 @@
+package databasic
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+The snapshot is a point-in-time view of the broker, which lists every procenode and tasknode with the buffer
+depth, the state of go routines, the number of processed and failed rawnodes, the processing time and the last
+error. It is read without stopping the broker, so the numbers of different tasks are not taken at the same instant.
+The processing time is recorded for each calling, the average is of all the callings and the p99 is of the latest
+DEFAULT_LATENCY_SAMPLES callings.
+*/
+const (
+	DEFAULT_LATENCY_SAMPLES int = 1000
+)
+
+/* the following const is the state of the go routines of a task */
+const (
+	TASK_STATE_UNSCHEDULED string = "unscheduled" /* no go routine is running the task, e.g. it waits for the scheduler */
+	TASK_STATE_PAUSED      string = "paused"
+	TASK_STATE_RUNNING     string = "running" /* some callings are running */
+	TASK_STATE_WAITING     string = "waiting" /* some callings wait for the running slots */
+	TASK_STATE_IDLE        string = "idle"
+)
+
+/* the statistics of the callings of a task, which is protected by the lock */
+type task_stats struct {
+	lock            sync.Mutex
+	samples         []time.Duration /* the ring of the latest processing time */
+	next            int
+	count           int64
+	total           time.Duration
+	last_error      error
+	last_error_time time.Time
+}
+
+type BrokerSnapshot struct {
+	Time   time.Time `json:"time"`
+	Closed bool      `json:"closed"`
+
+	Raw_length   int `json:"raw_length"`   /* the number of rawnodes in the raw channel */
+	Raw_capacity int `json:"raw_capacity"` /* the capacity of the raw channel */
+
+	Running         int `json:"running"`         /* the number of running callings */
+	Running_max     int `json:"running_max"`     /* the max number of running callings, the 0 means unlimited */
+	Running_waiting int `json:"running_waiting"` /* the number of callings waiting for the running slots */
+
+	Tasks_created int64 `json:"tasks_created"` /* the number of tasks created since the broker is created */
+	Tasks_reaped  int64 `json:"tasks_reaped"`  /* the number of tasks reaped by the reaper */
+
+	Procenodes []ProceNodeSnapshot `json:"procenodes"`
+	Tasknodes  []TaskNodeSnapshot  `json:"tasknodes"`
+	Ratelimits []RateLimitSnapshot `json:"ratelimits"`
+	Jobs       []JobSnapshot       `json:"jobs"`
+	Workers    []WorkerSnapshot    `json:"workers"` /* the workers connected, if the broker is a coordinator */
+}
+
+type JobSnapshot struct {
+	Id       string    `json:"id"`
+	Route    string    `json:"route"`
+	Schedule string    `json:"schedule"`
+	Next     time.Time `json:"next"`
+	Running  bool      `json:"running"`
+	Runs     int64     `json:"runs"`
+	Skipped  int64     `json:"skipped"`
+	Failed   int64     `json:"failed"`
+	Last_run *JobRun   `json:"last_run,omitempty"`
+}
+
+type ProceNodeSnapshot struct {
+	Id            string   `json:"id"`
+	Concurrency   int      `json:"concurrency"`
+	Version       int      `json:"version"` /* the current version of the processor */
+	Priority      int      `json:"priority"`
+	Weight        int      `json:"weight"`
+	Overflow      int      `json:"overflow"`
+	Buffer_size   int      `json:"buffer_size"`
+	Subscriptions []string `json:"subscriptions"` /* the route patterns subscribed by the procenode */
+	Tasknodes     []string `json:"tasknodes"`     /* the id of tasks processed by the procenode */
+}
+
+type TaskNodeSnapshot struct {
+	Id        string `json:"id"`
+	Procenode string `json:"procenode"`
+	State     string `json:"state"`
+	Workers   int64  `json:"workers"` /* the number of go routines processing the rawnodes */
+
+	Buffer_length   int   `json:"buffer_length"`
+	Buffer_capacity int   `json:"buffer_capacity"`
+	Pending         int64 `json:"pending"`
+	Spilled         int   `json:"spilled"` /* the number of rawnodes on the disk now */
+
+	Processed int64 `json:"processed"`
+	Failed    int64 `json:"failed"`
+	Dropped   int64 `json:"dropped"`
+	Rejected  int64 `json:"rejected"`
+	Slow      int64 `json:"slow"`
+	Overrun   int64 `json:"overrun"`
+	Running   int64 `json:"running"`
+	Waiting   int64 `json:"waiting"`
+
+	Callings int64         `json:"callings"`
+	Average  time.Duration `json:"average"`
+	P99      time.Duration `json:"p99"`
+
+	Last_error      string    `json:"last_error,omitempty"`
+	Last_error_time time.Time `json:"last_error_time"`
+}
+
+/* the function returns the snapshot of the broker, the procenodes and tasknodes are in the order of registering. */
+func (b *Broker) Broker_snapshot() *BrokerSnapshot {
+	snapshot := &BrokerSnapshot{Time: time.Now()}
+
+	b.lock.RLock()
+	snapshot.Closed = b.closed
+	snapshot.Raw_length = len(b.raw_channel)
+	snapshot.Raw_capacity = cap(b.raw_channel)
+	b.lock.RUnlock()
+
+	snapshot.Tasks_created = atomic.LoadInt64(&b.Stat_created)
+	snapshot.Tasks_reaped = atomic.LoadInt64(&b.Stat_reaped)
+
+	b.running_lock.Lock()
+	snapshot.Running = b.running_num
+	snapshot.Running_max = b.running_max
+	snapshot.Running_waiting = b.running_waiting()
+	b.running_lock.Unlock()
+
+	tasknodes := b.tasknode_registry.list()
+	for _, tasknode := range tasknodes {
+		snapshot.Tasknodes = append(snapshot.Tasknodes, tasknode.TaskNode_snapshot())
+	}
+
+	subscriptions := b.subscription_list()
+	for _, procenode := range b.procenode_registry.list() {
+		procenode_snapshot := ProceNodeSnapshot{
+			Id:            procenode.Id,
+			Concurrency:   procenode.Concurrency,
+			Version:       procenode.ProceNode_version(),
+			Subscriptions: subscriptions[procenode],
+		}
+		procenode_snapshot.Priority, procenode_snapshot.Weight = procenode.ProceNode_priority()
+		overflow, buffer_size := procenode.ProceNode_overflow()
+		procenode_snapshot.Overflow, procenode_snapshot.Buffer_size = overflow.Mode, buffer_size
+		for _, tasknode := range tasknodes {
+			if tasknode.TaskNode_method() == procenode {
+				procenode_snapshot.Tasknodes = append(procenode_snapshot.Tasknodes, tasknode.Id)
+			}
+		}
+		snapshot.Procenodes = append(snapshot.Procenodes, procenode_snapshot)
+	}
+
+	snapshot.Ratelimits = b.RateLimit_snapshot()
+	for _, job := range b.job_registry.list() {
+		snapshot.Jobs = append(snapshot.Jobs, job.Job_snapshot())
+	}
+	snapshot.Workers = b.Remote_workers()
+
+	return snapshot
+}
+
+func Broker_snapshot() *BrokerSnapshot {
+	return global_broker.Broker_snapshot()
+}
+
+/* the method returns the snapshot of the task */
+func (tn *TaskNode) TaskNode_snapshot() TaskNodeSnapshot {
+	snapshot := TaskNodeSnapshot{
+		Id:        tn.Id,
+		Workers:   atomic.LoadInt64(&tn.Stat_workers),
+		Pending:   atomic.LoadInt64(&tn.Stat_pending),
+		Spilled:   tn.TaskNode_spilled(),
+		Processed: atomic.LoadInt64(&tn.Stat_processed),
+		Failed:    atomic.LoadInt64(&tn.Stat_failed),
+		Dropped:   atomic.LoadInt64(&tn.Stat_dropped),
+		Rejected:  atomic.LoadInt64(&tn.Stat_rejected),
+		Slow:      atomic.LoadInt64(&tn.Stat_slow),
+		Overrun:   atomic.LoadInt64(&tn.Stat_overrun),
+		Running:   atomic.LoadInt64(&tn.Stat_running),
+		Waiting:   atomic.LoadInt64(&tn.Stat_waiting),
+	}
+	if procenode := tn.TaskNode_method(); procenode != nil {
+		snapshot.Procenode = procenode.Id
+	}
+	buffer := tn.TaskNode_buffer()
+	snapshot.Buffer_length, snapshot.Buffer_capacity = len(buffer), cap(buffer)
+
+	switch {
+	case snapshot.Workers == 0:
+		snapshot.State = TASK_STATE_UNSCHEDULED
+	case tn.TaskNode_is_paused():
+		snapshot.State = TASK_STATE_PAUSED
+	case snapshot.Running != 0:
+		snapshot.State = TASK_STATE_RUNNING
+	case snapshot.Waiting != 0:
+		snapshot.State = TASK_STATE_WAITING
+	default:
+		snapshot.State = TASK_STATE_IDLE
+	}
+
+	tn.stats.lock.Lock()
+	snapshot.Callings = tn.stats.count
+	if tn.stats.count != 0 {
+		snapshot.Average = tn.stats.total / time.Duration(tn.stats.count)
+	}
+	snapshot.P99 = latency_percentile(tn.stats.samples, 0.99)
+	if tn.stats.last_error != nil {
+		snapshot.Last_error = tn.stats.last_error.Error()
+		snapshot.Last_error_time = tn.stats.last_error_time
+	}
+	tn.stats.lock.Unlock()
+
+	return snapshot
+}
+
+/* the method returns the snapshot of the job */
+func (job *Job) Job_snapshot() JobSnapshot {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	snapshot := JobSnapshot{
+		Id:       job.Id,
+		Route:    job.Route,
+		Schedule: job.Schedule,
+		Next:     job.next,
+		Running:  job.running,
+		Runs:     job.Stat_runs,
+		Skipped:  job.Stat_skipped,
+		Failed:   job.Stat_failed,
+	}
+	if len(job.history) != 0 {
+		last_run := job.history[len(job.history)-1]
+		snapshot.Last_run = &last_run
+	}
+	return snapshot
+}
+
+/* the method records the processing time of a calling */
+func (tn *TaskNode) task_record_latency(elapsed time.Duration) {
+	tn.stats.lock.Lock()
+	defer tn.stats.lock.Unlock()
+
+	if len(tn.stats.samples) < DEFAULT_LATENCY_SAMPLES {
+		tn.stats.samples = append(tn.stats.samples, elapsed)
+	} else {
+		tn.stats.samples[tn.stats.next] = elapsed
+	}
+	tn.stats.next = (tn.stats.next + 1) % DEFAULT_LATENCY_SAMPLES
+	tn.stats.count++
+	tn.stats.total += elapsed
+}
+
+/* the method records the result of a rawnode, which is processed or failed after the retries */
+func (tn *TaskNode) task_record_result(err error) {
+	if err == nil {
+		atomic.AddInt64(&tn.Stat_processed, 1)
+		return
+	}
+	atomic.AddInt64(&tn.Stat_failed, 1)
+	tn.stats.lock.Lock()
+	tn.stats.last_error = err
+	tn.stats.last_error_time = tn.broker.clock.Now()
+	tn.stats.lock.Unlock()
+}
+
+func latency_percentile(samples []time.Duration, percentile float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := int(float64(len(sorted))*percentile+0.5) - 1
+	if index < 0 {
+		index = 0
+	} else if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
+
+/* the function returns the route patterns subscribed by each procenode, which are sorted */
+func (b *Broker) subscription_list() map[*ProceNode][]string {
+	b.subscription_lock.RLock()
+	defer b.subscription_lock.RUnlock()
+
+	subscriptions := make(map[*ProceNode][]string)
+	for route, subscribers := range b.subscriptions {
+		for _, subscriber := range subscribers {
+			subscriptions[subscriber] = append(subscriptions[subscriber], route)
+		}
+	}
+	for _, routes := range subscriptions {
+		sort.Strings(routes)
+	}
+	return subscriptions
+}
+
+/* the method writes the snapshot as the text tables, which is read by human during an incident */
+func (bs *BrokerSnapshot) BrokerSnapshot_write(writer io.Writer) error {
+	fmt.Fprintf(writer, "time: %s, closed: %t\n", bs.Time.Format(time.RFC3339), bs.Closed)
+	fmt.Fprintf(writer, "raw channel: %d/%d\n", bs.Raw_length, bs.Raw_capacity)
+	fmt.Fprintf(writer, "running: %d/%d, waiting: %d\n", bs.Running, bs.Running_max, bs.Running_waiting)
+	fmt.Fprintf(writer, "tasks created: %d, reaped: %d\n\n", bs.Tasks_created, bs.Tasks_reaped)
+
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "PROCENODE\tVERSION\tCONCURRENCY\tPRIORITY\tWEIGHT\tOVERFLOW\tBUFFER\tSUBSCRIPTIONS\tTASKNODES")
+	for _, pn := range bs.Procenodes {
+		fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\n", pn.Id, pn.Version, pn.Concurrency, pn.Priority, pn.Weight,
+			pn.Overflow, pn.Buffer_size, strings.Join(pn.Subscriptions, ","), strings.Join(pn.Tasknodes, ","))
+	}
+	err := table.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(writer)
+
+	table = tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TASKNODE\tPROCENODE\tSTATE\tWORKERS\tBUFFER\tPENDING\tPROCESSED\tFAILED\tDROPPED\tREJECTED\tSPILLED\tAVERAGE\tP99\tLAST ERROR")
+	for _, tn := range bs.Tasknodes {
+		last_error := tn.Last_error
+		if last_error != "" {
+			last_error = fmt.Sprintf("%s (%s)", last_error, tn.Last_error_time.Format(time.RFC3339))
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%d/%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n", tn.Id, tn.Procenode, tn.State,
+			tn.Workers, tn.Buffer_length, tn.Buffer_capacity, tn.Pending, tn.Processed, tn.Failed, tn.Dropped,
+			tn.Rejected, tn.Spilled, tn.Average, tn.P99, last_error)
+	}
+	err = table.Flush()
+	if err != nil {
+		return err
+	}
+	if len(bs.Jobs) != 0 {
+		fmt.Fprintln(writer)
+		table = tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "JOB\tROUTE\tSCHEDULE\tNEXT\tRUNNING\tRUNS\tSKIPPED\tFAILED\tLAST ERROR")
+		for _, job := range bs.Jobs {
+			last_error := ""
+			if job.Last_run != nil {
+				last_error = job.Last_run.Error
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%t\t%d\t%d\t%d\t%s\n", job.Id, job.Route, job.Schedule,
+				job.Next.Format(time.RFC3339), job.Running, job.Runs, job.Skipped, job.Failed, last_error)
+		}
+		err = table.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if len(bs.Workers) != 0 {
+		fmt.Fprintln(writer)
+		table = tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "WORKER\tADDR\tROUTES\tINFLIGHT\tFORWARDED\tFAILED\tLAST SEEN")
+		for _, worker := range bs.Workers {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%d\t%d\t%s\n", worker.Id, worker.Addr, strings.Join(worker.Routes, ","),
+				worker.Inflight, worker.Forwarded, worker.Failed, worker.Last_seen.Format(time.RFC3339))
+		}
+		err = table.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if len(bs.Ratelimits) == 0 {
+		return nil
+	}
+	fmt.Fprintln(writer)
+
+	table = tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "RATELIMIT\tPATTERN\tRATE\tBURST\tMODE\tBUCKETS\tPASSED\tDELAYED\tSAMPLED\tDROPPED")
+	for _, rl := range bs.Ratelimits {
+		fmt.Fprintf(table, "%s\t%s\t%g\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", rl.Kind, rl.Pattern, rl.Rate, rl.Burst, rl.Mode,
+			rl.Buckets, rl.Passed, rl.Delayed, rl.Sampled, rl.Dropped)
+	}
+	return table.Flush()
+}
@@ -3,13 +3,17 @@ package databasic
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type TaskNode struct {
 	Id string
 
-	List *ListNode /* it is a continer that is used to orgnize the parent type as a list */
+	broker *Broker /* the broker of the task, which is the broker of the procenode registering it */
 
 	Method *ProceNode /* it is a method to process the raw data */
 
@@ -18,83 +22,130 @@ type TaskNode struct {
 
 	Timepeice time.Duration /* Timepeice is the max value of running time each calling. */
 
-	Timeout        time.Time /* Timeout is a timepeice. The Timeout is set, while the Raw_list is empty */
+	Timeout        time.Time /* Timeout is the deadline of the task, no calling is running after the Timeout if it is set. */
 	Tiemout_is_set bool      /* the member is used to check wether the timeout is set or not. */
 
-	Cancel    chan bool
-	Goroutine bool
+	Cancel      chan bool
+	cancel_once sync.Once /* the Cancel is closed once, even if the task is unregistered by several callers */
+	Goroutine   bool
+
+	Stat_slow     int64 /* the number of callings running longer than half of the Timepeice */
+	Stat_overrun  int64 /* the number of callings overrunning the deadline */
+	Stat_pending  int64 /* the number of rawnodes pushed to the task but not finished */
+	Stat_dropped  int64 /* the number of rawnodes dropped by the overflow policy */
+	Stat_rejected int64 /* the number of rawnodes rejected back to the source by the overflow policy */
+	Stat_spilled  int64 /* the number of rawnodes spilled to the disk by the overflow policy */
+
+	Stat_processed int64 /* the number of rawnodes processed successfully */
+	Stat_failed    int64 /* the number of rawnodes failed after the retries */
+	Stat_running   int64 /* the number of callings running now */
+	Stat_waiting   int64 /* the number of callings waiting for the running slots now */
+	Stat_workers   int64 /* the number of go routines processing the rawnodes now */
+	stats          task_stats
+
+	Overflow OverflowPolicy /* the policy decides how the rawnode is handled while the buffer is full */
+	spill    *spill_state
+	space    chan struct{} /* it is signaled while the buffer has space, which wakes up the blocked offerings */
+
+	paused chan struct{} /* it is not nil while the task is paused, and it is closed by the TaskNode_resume */
+
+	Idle          time.Duration /* the task is reaped after it is quiet for the Idle, the 0 means it is never reaped */
+	last_active   int64         /* the unix nano of the clock while the task is active last */
+	idle_notified int32         /* it is 1 after the TASK_EVENT_IDLE is emitted, and reset while the task is active */
+	offer_lock    sync.RWMutex  /* it is held by the offerings, and the reaper holds it exclusively while reaping */
+	reaped        bool          /* it is protected by the offer_lock */
+
+	Priority int     /* the task of higher priority is granted the running slot at first */
+	Weight   int     /* the tasks having the same priority share the running slots by the weight */
+	vfinish  float64 /* the virtual finish time of the last calling, it is protected by the running_lock of the broker */
+
+	lock sync.RWMutex /* it protects the Method, Buffer, Timepeice, Timeout, paused, Priority and Weight, which are read by the task go routines */
 }
 
 const (
-	DEFAULT_BUFFER_SIZE int = 100
+	DEFAULT_BUFFER_SIZE        int = 100
+	DEFAULT_WORKER_BUFFER_SIZE int = 16
 )
 
+/* the function registers a tasknode processed by the method, the tasknode belongs to the broker of the method. */
 func TaskNode_register(id string, method *ProceNode, timepeice time.Duration) *TaskNode {
-	if id == "" || method == nil || timepeice <= 0 {
+	if id == "" || method == nil || method.broker == nil || timepeice <= 0 {
 		return nil
 	}
 
 	tasknode := new(TaskNode)
 	tasknode.Id = id
+	tasknode.broker = method.broker
 	tasknode.Method = method
 	tasknode.Timepeice = time.Duration(timepeice)
-	tasknode.List = ListNode_create(tasknode)
-	tasknode.Buffer = make(chan *RawNode, DEFAULT_BUFFER_SIZE)
+	overflow, size := method.ProceNode_overflow()
+	tasknode.Buffer = make(chan *RawNode, size)
 	tasknode.Cancel = make(chan bool)
+	tasknode.space = make(chan struct{}, 1)
 	tasknode.Goroutine = false
+	tasknode.Priority, tasknode.Weight = method.ProceNode_priority()
+	tasknode.Idle = method.ProceNode_idle()
+	tasknode.last_active = tasknode.broker.clock.Now().UnixNano()
+	tasknode.Overflow = DEFAULT_OVERFLOW_POLICY
+	if err := tasknode.TaskNode_set_overflow(overflow); err != nil {
+		log.Printf("The overflow policy of the task %s is invalid, the default is used: %s\n\r", id, err.Error())
+	}
 
-	/* add the dataclass to the global list */
-	ok := ListNode_insert_next(global_tasknode_entry, tasknode.List)
+	/* add the tasknode to the registry of the broker */
+	ok := tasknode.broker.tasknode_registry.add(id, tasknode)
 	if !ok {
-		tasknode.List.Parent = nil
-		tasknode.List = nil
 		return nil
 	}
-	global_tasknode_num++
 
-	return tasknode
+	atomic.AddInt64(&tasknode.broker.Stat_created, 1)
+	tasknode.broker.lifecycle_emit(TASK_EVENT_CREATED, tasknode, 0)
 
-}
+	/* wake up the scheduler to create a go routine for the tasknode */
+	tasknode.broker.schedule(tasknode)
 
-func TaskNode_find(id string) *TaskNode {
+	return tasknode
 
-	listnode := global_tasknode_entry
+}
 
-	if listnode.Next == listnode || listnode.Prev == listnode {
+func (b *Broker) TaskNode_find(id string) *TaskNode {
+	tasknode, ok := b.tasknode_registry.find(id)
+	if !ok {
 		return nil
 	}
+	return tasknode
+}
 
-	if id == "last" {
-		return listnode.Prev.Parent.(*TaskNode)
-	} else if id == "first" {
-		return listnode.Next.Parent.(*TaskNode)
-	}
+/* the function sets the max number of tasknode, the 0 means unlimited. */
+func (b *Broker) TaskNode_set_max(max int) {
+	b.tasknode_registry.set_max(max)
+}
 
-	for i := 0; i < global_tasknode_num; i++ {
-		listnode = ListNode_index_node(listnode, 1)
-		parent := listnode.Parent.(*TaskNode)
-		if parent.Id == id {
-			return parent
-		}
-	}
-	return nil
+func TaskNode_find(id string) *TaskNode {
+	return global_broker.TaskNode_find(id)
+}
+
+func TaskNode_set_max(max int) {
+	global_broker.TaskNode_set_max(max)
 }
 
+/* the method unregisters the tasknode and stops its go routine. It is safe to call while the broker is running. */
 func (tn *TaskNode) TaskNode_unregister() bool {
 
-	ok := ListNode_delete(tn.List)
-	if !ok {
+	if !tn.broker.tasknode_registry.remove(tn.Id, tn) {
 		return false
 	}
-	close(tn.Cancel)
-	global_tasknode_num--
+	tn.cancel_once.Do(func() { close(tn.Cancel) })
 
 	return true
 }
 
 func (tn *TaskNode) TaskNode_Push(rawnode *RawNode) bool {
+	tn.lock.RLock()
+	defer tn.lock.RUnlock()
+
 	select {
 	case tn.Buffer <- rawnode:
+		atomic.AddInt64(&tn.Stat_pending, 1)
 		return true
 	default:
 		return false
@@ -102,8 +153,13 @@ func (tn *TaskNode) TaskNode_Push(rawnode *RawNode) bool {
 }
 
 func (tn *TaskNode) TaskNode_Fetch() *RawNode {
+	tn.lock.RLock()
+	defer tn.lock.RUnlock()
+
 	select {
 	case rawnode := <-tn.Buffer:
+		atomic.AddInt64(&tn.Stat_pending, -1)
+		tn.task_signal_space()
 		return rawnode
 	default:
 		return nil
@@ -175,47 +231,184 @@ func (tn *TaskNode) TaskNode_update_mthod(method *ProceNode, ctx context.Context
 
 		return false
 	} else {
+		tn.lock.Lock()
 		tn.Method = method
+		tn.lock.Unlock()
 
 		return true
 	}
 }
 
+/* the method returns the procenode of the task, which can be swapped by the TaskNode_update_mthod while running */
+func (tn *TaskNode) TaskNode_method() *ProceNode {
+	tn.lock.RLock()
+	defer tn.lock.RUnlock()
+
+	return tn.Method
+}
+
+/* the method returns the current buffer of the task, the old buffer is closed after the TaskNode_resize */
+func (tn *TaskNode) TaskNode_buffer() chan *RawNode {
+	tn.lock.RLock()
+	defer tn.lock.RUnlock()
+
+	return tn.Buffer
+}
+
+/*
+the method replaces the buffer of the task by a new one of the size, and the pending rawnodes are moved to the
+new buffer in order. It returns a error and keeps the buffer, if the pending rawnodes are more than the size.
+*/
+func (tn *TaskNode) TaskNode_resize(size int) error {
+	if size < 1 {
+		return errors.New("argument error")
+	}
+	tn.lock.Lock()
+	defer tn.lock.Unlock()
+
+	if len(tn.Buffer) > size {
+		return fmt.Errorf("the task %s has %d pending rawnodes more than the size %d", tn.Id, len(tn.Buffer), size)
+	}
+	buffer := make(chan *RawNode, size)
+	for len(tn.Buffer) > 0 {
+		select {
+		case rawnode := <-tn.Buffer:
+			buffer <- rawnode
+		default:
+		}
+	}
+	/* the pushing is blocked by the lock, so nobody sends to the old buffer after closing */
+	close(tn.Buffer)
+	tn.Buffer = buffer
+	tn.task_signal_space()
+
+	return nil
+}
+
+/* the method pauses the task, the rawnodes are kept in the buffer until the task is resumed. */
+func (tn *TaskNode) TaskNode_pause() bool {
+	tn.lock.Lock()
+	defer tn.lock.Unlock()
+
+	if tn.paused != nil {
+		return false
+	}
+	tn.paused = make(chan struct{})
+	return true
+}
+
+func (tn *TaskNode) TaskNode_resume() bool {
+	tn.lock.Lock()
+	defer tn.lock.Unlock()
+
+	if tn.paused == nil {
+		return false
+	}
+	close(tn.paused)
+	tn.paused = nil
+	return true
+}
+
+func (tn *TaskNode) TaskNode_is_paused() bool {
+	tn.lock.RLock()
+	defer tn.lock.RUnlock()
+
+	return tn.paused != nil
+}
+
+/* the method blocks the task go routine while the task is paused. It returns false, if the task is canceled. */
+func (tn *TaskNode) task_wait_resume() bool {
+	tn.lock.RLock()
+	paused := tn.paused
+	tn.lock.RUnlock()
+
+	if paused == nil {
+		return true
+	}
+	select {
+	case <-paused:
+		return true
+	case <-tn.Cancel:
+		return false
+	}
+}
+
 func (tn *TaskNode) TaskNode_update_timepeice(timepeice int64) error {
 
 	if timepeice < 0 {
 		return errors.New("argument error")
 	} else {
+		tn.lock.Lock()
 		tn.Timepeice = time.Duration(timepeice)
+		tn.lock.Unlock()
 		return nil
 	}
 }
 
+/* the method sets the deadline of the task to the timeout later. */
 func (tn *TaskNode) TaskNode_set_timeout(timeout time.Duration) error {
 
 	if timeout < 0 {
 		return errors.New("argument error")
 	}
 
-	duration := timeout
-	tn.Timeout = <-time.After(duration)
+	tn.lock.Lock()
+	tn.Timeout = time.Now().Add(timeout)
 	tn.Tiemout_is_set = true
+	tn.lock.Unlock()
 
 	return nil
 }
 
 func (tn *TaskNode) TaskNode_unset_timeout() {
 
+	tn.lock.Lock()
 	tn.Tiemout_is_set = false
 	tn.Timeout = time.Now()
+	tn.lock.Unlock()
 
 }
 
+/* the method returns true, if the deadline of the task is set and expired. */
 func (tn *TaskNode) TaskNode_is_timeout() bool {
+	tn.lock.RLock()
+	defer tn.lock.RUnlock()
+
 	if tn.Tiemout_is_set {
 		if tn.Timeout.Before(time.Now()) {
-			return false
+			return true
 		}
 	}
-	return true
+	return false
+}
+
+/*
+the method returns the context of a calling. The deadline of the context is the Timepeice later, and not later
+than the Timeout of the task if it is set. The context has no deadline, if the Timepeice is 0 and the Timeout is unset.
+*/
+func (tn *TaskNode) TaskNode_context(parent context.Context) (context.Context, context.CancelFunc) {
+	tn.lock.RLock()
+	timepeice := tn.Timepeice
+	deadline := tn.Timeout
+	is_set := tn.Tiemout_is_set
+	tn.lock.RUnlock()
+
+	if timepeice > 0 {
+		if !is_set || time.Now().Add(timepeice).Before(deadline) {
+			deadline = time.Now().Add(timepeice)
+			is_set = true
+		}
+	}
+	if !is_set {
+		return context.WithCancel(parent)
+	}
+	return context.WithDeadline(parent, deadline)
+}
+
+/* the method returns the Timepeice of the task */
+func (tn *TaskNode) TaskNode_timepeice() time.Duration {
+	tn.lock.RLock()
+	defer tn.lock.RUnlock()
+
+	return tn.Timepeice
 }
@@ -0,0 +1,141 @@
+package databasic
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The processor of a procenode is versioned, so it is swapped while the broker is running. The ProceNode_swap
+installs a new version atomically, and each rawnode is handled by the version current while its handling starts:
+the rawnodes handled already, including their retries, finish on the old version, and the following rawnodes are
+handled by the new one. The ProceNode_rollback restores the previous version, the latest DEFAULT_PROCESSOR_HISTORY
+versions are kept for it. The version of the processor registered at first is 1.
+*/
+
+/* the following const should be cared by user */
+const (
+	DEFAULT_PROCESSOR_HISTORY int = 10
+)
+
+/* the error is returned by the ProceNode_rollback, if the procenode has only one version */
+var ErrNoPreviousVersion = errors.New("the procenode has no previous version")
+
+/* the error is returned by the ProceNode_swap, if the procenode is not registered by the ProceNode_register */
+var ErrNoProcessor = errors.New("the procenode has no processor")
+
+/* a version of the processor, the inflight is the number of rawnodes handled by it now */
+type processor_version struct {
+	version   int
+	processor Processor
+	time      time.Time
+	inflight  int64
+}
+
+/* the view of a version of the processor, which is returned by the ProceNode_versions */
+type ProcessorVersion struct {
+	Version  int       `json:"version"`
+	Time     time.Time `json:"time"`     /* the time while the version is installed */
+	Inflight int64     `json:"inflight"` /* the number of rawnodes handled by the version now */
+	Current  bool      `json:"current"`
+}
+
+/* the method installs the processor as the first version, it is called while registering */
+func (pn *ProceNode) version_init(processor Processor) {
+	pn.lock.Lock()
+	pn.versions = []*processor_version{{version: 1, processor: processor, time: pn.broker.clock.Now()}}
+	pn.lock.Unlock()
+}
+
+/*
+the method installs the operation as a new version of the processor, and returns the version. The operation is
+validated by processor_adapt, the current version is kept if it is invalid.
+*/
+func (pn *ProceNode) ProceNode_swap(operation interface{}) (int, error) {
+	processor, err := processor_adapt(operation)
+	if err != nil {
+		return 0, err
+	}
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+
+	if len(pn.versions) == 0 {
+		return 0, ErrNoProcessor
+	}
+	version := &processor_version{processor: processor, time: pn.broker.clock.Now()}
+	version.version = pn.versions[len(pn.versions)-1].version + 1
+	pn.versions = append(pn.versions, version)
+	if len(pn.versions) > DEFAULT_PROCESSOR_HISTORY {
+		pn.versions = append([]*processor_version(nil), pn.versions[len(pn.versions)-DEFAULT_PROCESSOR_HISTORY:]...)
+	}
+	log.Printf("The procenode named %s is swapped to the version %d.\n\r", pn.Id, version.version)
+
+	return version.version, nil
+}
+
+/* the method restores the previous version of the processor, and returns the version restored. */
+func (pn *ProceNode) ProceNode_rollback() (int, error) {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+
+	if len(pn.versions) < 2 {
+		return 0, ErrNoPreviousVersion
+	}
+	pn.versions = pn.versions[:len(pn.versions)-1]
+	previous := pn.versions[len(pn.versions)-1]
+	log.Printf("The procenode named %s is rolled back to the version %d.\n\r", pn.Id, previous.version)
+
+	return previous.version, nil
+}
+
+/* the method returns the current version of the processor, the 0 means the procenode is not registered */
+func (pn *ProceNode) ProceNode_version() int {
+	pn.lock.RLock()
+	defer pn.lock.RUnlock()
+
+	if len(pn.versions) == 0 {
+		return 0
+	}
+	return pn.versions[len(pn.versions)-1].version
+}
+
+/* the method returns the versions kept for the rollback, the current version is the last one. */
+func (pn *ProceNode) ProceNode_versions() []ProcessorVersion {
+	pn.lock.RLock()
+	defer pn.lock.RUnlock()
+
+	versions := make([]ProcessorVersion, 0, len(pn.versions))
+	for i, version := range pn.versions {
+		versions = append(versions, ProcessorVersion{
+			Version:  version.version,
+			Time:     version.time,
+			Inflight: atomic.LoadInt64(&version.inflight),
+			Current:  i == len(pn.versions)-1,
+		})
+	}
+	return versions
+}
+
+/* the method returns false, if the procenode is not registered by the ProceNode_register, so it has no processor */
+func (pn *ProceNode) version_valid() bool {
+	pn.lock.RLock()
+	defer pn.lock.RUnlock()
+
+	return len(pn.versions) != 0
+}
+
+/* the method returns the current version, which handles a rawnode until the version_release is called. */
+func (pn *ProceNode) version_acquire() *processor_version {
+	pn.lock.RLock()
+	version := pn.versions[len(pn.versions)-1]
+	pn.lock.RUnlock()
+
+	atomic.AddInt64(&version.inflight, 1)
+	return version
+}
+
+func (version *processor_version) version_release() {
+	atomic.AddInt64(&version.inflight, -1)
+}
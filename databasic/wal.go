@@ -0,0 +1,520 @@
+package databasic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+The write-ahead log records the rawnodes accepted by the Send_raw and the Emit, and marks them done while they
+are processed, dropped, spilled or discarded. The rawnodes not done, e.g. in the buffers or parked in the dead
+letter while the process crashes, are replayed by the WAL_replay after restarting. The log is compacted to
+the rawnodes not done while it is opened, and in the background while it grows larger than the
+DEFAULT_WAL_SEGMENT_SIZE and the rawnodes not done take less than half of it, so the rawnodes parked for long
+never make it compacted again and again. The type of the Raw must be registered by the gob.Register, and the log
+is disabled until the WAL_open.
+
+Each record is framed by the length and the crc32 of the gob encoded data, so the record broken by a crash is
+ignored while reading. The rawnode unable to write the log is not routed, the Send returns the ErrWALWrite.
+*/
+const (
+	WAL_FILE_NAME            string = "rawnode.wal"
+	DEFAULT_WAL_SEGMENT_SIZE int64  = 64 << 20
+)
+
+/* the error is returned by the Send and the Emit, if the rawnode unable to write the write-ahead log */
+var ErrWALWrite = errors.New("the rawnode unable to write the write-ahead log")
+
+type wal_record struct {
+	Seq  uint64
+	Done bool
+	Id   string
+	Key  string
+	Raw  interface{}
+}
+
+/* the entry of a rawnode not done, it is shared by the copies of the rawnode which are fanned out */
+type wal_entry struct {
+	record *wal_record
+	refs   int
+	size   int64      /* the size of the record in the log */
+	owner  *wal_state /* the log holding the entry, the entry is done in it even if the broker opens another one */
+}
+
+type wal_state struct {
+	lock     sync.Mutex
+	dir      string
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	live     int64 /* the size of the records not done */
+	segment  int64 /* the size of the log which the compaction is considered from */
+	seq      uint64
+	sync     bool
+	patterns [][]string
+	pending  map[uint64]*wal_entry
+	replay   []*wal_record
+	closed   bool
+
+	compacting chan struct{} /* the signal of the background compaction */
+}
+
+/*
+the function opens the write-ahead log in the dir. The rawnodes whose id matches one of the route patterns
+are logged, all the rawnodes are logged if no pattern is given. Each record survives the crash of the process,
+and the sync true flushes each record to the disk, which survives the crash of the system but is slow.
+The rawnodes not done are kept for the WAL_replay.
+*/
+func (b *Broker) WAL_open(dir string, sync bool, patterns ...string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	wal := &wal_state{dir: dir, sync: sync, segment: DEFAULT_WAL_SEGMENT_SIZE, pending: make(map[uint64]*wal_entry)}
+	wal.compacting = make(chan struct{}, 1)
+	for _, pattern := range patterns {
+		wal.patterns = append(wal.patterns, strings.Split(pattern, ROUTE_SEPARATOR))
+	}
+
+	records, err := wal_read(filepath.Join(dir, WAL_FILE_NAME))
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if record.Seq > wal.seq {
+			wal.seq = record.Seq
+		}
+		wal.pending[record.Seq] = &wal_entry{record: record, owner: wal}
+	}
+	for _, entry := range wal.pending {
+		wal.replay = append(wal.replay, entry.record)
+	}
+	sort.Slice(wal.replay, func(i, j int) bool { return wal.replay[i].Seq < wal.replay[j].Seq })
+
+	err = wal.compact()
+	if err != nil {
+		return err
+	}
+	go wal.compact_loop()
+	b.wal_lock.Lock()
+	old := b.wal
+	b.wal = wal
+	b.wal_lock.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+/*
+the function sends the rawnodes not done while the log is opened to the router again, which should be called
+after the procenodes are registered. It returns the number of the replayed rawnodes.
+*/
+func (b *Broker) WAL_replay() int {
+	wal := b.wal_get()
+	if wal == nil {
+		return 0
+	}
+	wal.lock.Lock()
+	replay := wal.replay
+	wal.replay = nil
+	var rawnodes []*RawNode
+	for _, record := range replay {
+		entry, ok := wal.pending[record.Seq]
+		if !ok {
+			continue
+		}
+		entry.refs++
+		rawnode := RawNode_create_key(record.Id, record.Key, record.Raw)
+		rawnode.wal = entry
+		rawnodes = append(rawnodes, rawnode)
+	}
+	wal.lock.Unlock()
+
+	for i, rawnode := range rawnodes {
+		if !b.Send_raw(rawnode) {
+			return i
+		}
+	}
+	return len(rawnodes)
+}
+
+/* the function flushes and closes the log, the rawnodes are not logged after closing. */
+func (b *Broker) WAL_close() error {
+	b.wal_lock.Lock()
+	wal := b.wal
+	b.wal = nil
+	b.wal_lock.Unlock()
+
+	if wal == nil {
+		return nil
+	}
+	return wal.close()
+}
+
+func (b *Broker) wal_get() *wal_state {
+	b.wal_lock.RLock()
+	defer b.wal_lock.RUnlock()
+
+	return b.wal
+}
+
+/*
+the function logs the rawnode, if the log is opened and the rawnode is not logged or a call. The error wrapping
+the ErrWALWrite is returned, if the rawnode unable to write the log, and it should not be routed.
+*/
+func (b *Broker) wal_append(rawnode *RawNode) error {
+	wal := b.wal_get()
+	if wal == nil || rawnode.wal != nil || rawnode.reply != nil || !wal.match(rawnode.Id) {
+		return nil
+	}
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if wal.closed {
+		return nil
+	}
+	record := &wal_record{Seq: wal.seq + 1, Id: rawnode.Id, Key: rawnode.Key, Raw: rawnode.Raw}
+	size := wal.size
+	err := wal.write(record)
+	if err != nil {
+		log.Printf("The rawnode named %s unable to write the wal: %s\n\r", rawnode.Id, err.Error())
+		return fmt.Errorf("%w: %s", ErrWALWrite, err.Error())
+	}
+	wal.seq++
+	entry := &wal_entry{record: record, refs: 1, size: wal.size - size, owner: wal}
+	wal.pending[record.Seq] = entry
+	wal.live += entry.size
+	rawnode.wal = entry
+	wal.compact_check()
+
+	return nil
+}
+
+/* the function shares the log entry of the rawnode with the copy */
+func wal_share(rawnode *RawNode, copied *RawNode) {
+	entry := rawnode.wal
+	if entry == nil {
+		return
+	}
+	entry.owner.lock.Lock()
+	entry.refs++
+	entry.owner.lock.Unlock()
+	copied.wal = entry
+}
+
+/* the function marks the rawnode done, the entry is done while all the copies of the rawnode are done. */
+func wal_done(rawnode *RawNode) {
+	entry := rawnode.wal
+	if entry == nil {
+		return
+	}
+	rawnode.wal = nil
+	wal := entry.owner
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	entry.refs--
+	if entry.refs > 0 || wal.closed {
+		return
+	}
+	if _, ok := wal.pending[entry.record.Seq]; !ok {
+		return
+	}
+	delete(wal.pending, entry.record.Seq)
+	wal.live -= entry.size
+	err := wal.write(&wal_record{Seq: entry.record.Seq, Done: true})
+	if err != nil {
+		log.Printf("The rawnode named %s unable to mark done in the wal: %s\n\r", entry.record.Id, err.Error())
+	}
+	wal.compact_check()
+}
+
+func (wal *wal_state) match(route string) bool {
+	if len(wal.patterns) == 0 {
+		return true
+	}
+	words := strings.Split(route, ROUTE_SEPARATOR)
+	for _, pattern := range wal.patterns {
+		if route_words_match(pattern, words) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+the method writes the record to the log, the wal lock must be held. The record written partly is truncated, if
+the writing is failed, so the following records are not lost behind it while reading.
+*/
+func (wal *wal_state) write(record *wal_record) error {
+	var data bytes.Buffer
+	err := gob.NewEncoder(&data).Encode(record)
+	if err != nil {
+		return err
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(data.Len()))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(data.Bytes()))
+	_, err = wal.writer.Write(header[:])
+	if err == nil {
+		_, err = wal.writer.Write(data.Bytes())
+	}
+	/* the record is written to the system at once, so it survives the crash of the process */
+	if err == nil {
+		err = wal.writer.Flush()
+	}
+	if err == nil && wal.sync {
+		err = wal.file.Sync()
+	}
+	if err != nil {
+		wal.writer.Reset(wal.file)
+		wal.file.Truncate(wal.size)
+		return err
+	}
+	wal.size += int64(len(header) + data.Len())
+
+	return nil
+}
+
+/* the method signals the background compaction, if it shrinks the log to half at least. the wal lock must be held. */
+func (wal *wal_state) compact_check() {
+	if wal.size <= wal.segment || wal.live*2 >= wal.size {
+		return
+	}
+	select {
+	case wal.compacting <- struct{}{}:
+	default:
+	}
+}
+
+/* the method returns the entries not done in the order of the sequence, the wal lock must be held. */
+func (wal *wal_state) entries() []*wal_entry {
+	entries := make([]*wal_entry, 0, len(wal.pending))
+	for _, entry := range wal.pending {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].record.Seq < entries[j].record.Seq })
+	return entries
+}
+
+/* the method rewrites the log with the records not done while it is opened, the wal lock must be held. */
+func (wal *wal_state) compact() error {
+	entries := wal.entries()
+	compacted, sizes, err := wal.compact_write(entries)
+	if err != nil {
+		return err
+	}
+	return wal.compact_commit(compacted, entries, sizes)
+}
+
+/*
+the method compacts the log in the background while it is signaled. The records not done are written to a new
+log without the wal lock, and the records appended or done meanwhile are caught up with the lock at last.
+*/
+func (wal *wal_state) compact_loop() {
+	for range wal.compacting {
+		wal.lock.Lock()
+		if wal.closed {
+			wal.lock.Unlock()
+			return
+		}
+		entries := wal.entries()
+		seq := wal.seq
+		wal.lock.Unlock()
+
+		compacted, sizes, err := wal.compact_write(entries)
+		if err != nil {
+			log.Printf("The wal unable to compact: %s\n\r", err.Error())
+			continue
+		}
+
+		wal.lock.Lock()
+		if wal.closed {
+			wal.lock.Unlock()
+			compacted.file.Close()
+			os.Remove(compacted.file.Name())
+			return
+		}
+		for _, entry := range entries {
+			if _, ok := wal.pending[entry.record.Seq]; !ok && err == nil {
+				err = compacted.write(&wal_record{Seq: entry.record.Seq, Done: true})
+			}
+		}
+		for _, entry := range wal.entries() {
+			if entry.record.Seq > seq && err == nil {
+				size := compacted.size
+				err = compacted.write(entry.record)
+				entries = append(entries, entry)
+				sizes = append(sizes, compacted.size-size)
+			}
+		}
+		if err == nil {
+			err = wal.compact_commit(compacted, entries, sizes)
+		} else {
+			compacted.file.Close()
+			os.Remove(compacted.file.Name())
+		}
+		wal.lock.Unlock()
+		if err != nil {
+			log.Printf("The wal unable to compact: %s\n\r", err.Error())
+		}
+	}
+}
+
+/* the method writes the records of the entries to a new log, and returns the sizes of them. */
+func (wal *wal_state) compact_write(entries []*wal_entry) (*wal_state, []int64, error) {
+	path := filepath.Join(wal.dir, WAL_FILE_NAME) + ".tmp"
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	compacted := &wal_state{dir: wal.dir, file: file, writer: bufio.NewWriter(file)}
+	sizes := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		size := compacted.size
+		err = compacted.write(entry.record)
+		if err != nil {
+			file.Close()
+			os.Remove(path)
+			return nil, nil, err
+		}
+		sizes = append(sizes, compacted.size-size)
+	}
+	return compacted, sizes, nil
+}
+
+/*
+the method replaces the log by the compacted one, the wal lock must be held. The compacted file is renamed and
+kept open, so the log is never left closed, and the log is kept if the renaming is failed. The directory is
+synced, so the renaming survives the crash of the system.
+*/
+func (wal *wal_state) compact_commit(compacted *wal_state, entries []*wal_entry, sizes []int64) error {
+	path := filepath.Join(wal.dir, WAL_FILE_NAME)
+	err := compacted.file.Sync()
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		compacted.file.Close()
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	if wal.file != nil {
+		wal.writer.Flush()
+		wal.file.Close()
+	}
+	wal.file = compacted.file
+	wal.writer = compacted.writer
+	wal.size = compacted.size
+	for i, entry := range entries {
+		entry.size = sizes[i]
+	}
+	wal.live = 0
+	for _, entry := range wal.pending {
+		wal.live += entry.size
+	}
+
+	return wal_sync_dir(wal.dir)
+}
+
+/* the function syncs the directory, so the files created or renamed in it survive the crash of the system */
+func wal_sync_dir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+func (wal *wal_state) close() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if wal.closed {
+		return nil
+	}
+	wal.closed = true
+	close(wal.compacting)
+
+	err := wal.writer.Flush()
+	if close_err := wal.file.Close(); err == nil {
+		err = close_err
+	}
+	return err
+}
+
+func WAL_open(dir string, sync bool, patterns ...string) error {
+	return global_broker.WAL_open(dir, sync, patterns...)
+}
+
+func WAL_replay() int {
+	return global_broker.WAL_replay()
+}
+
+func WAL_close() error {
+	return global_broker.WAL_close()
+}
+
+/* the function reads the log, and returns the records not done in the order of the sequence */
+func wal_read(path string) ([]*wal_record, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	pending := make(map[uint64]*wal_record)
+	var order []uint64
+	reader := bufio.NewReader(file)
+	for {
+		var header [8]byte
+		_, err = io.ReadFull(reader, header[:])
+		if err != nil {
+			break
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		_, err = io.ReadFull(reader, data)
+		if err != nil || crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+			/* the tail is broken by a crash, the following records are ignored */
+			log.Printf("The wal %s is broken at the tail, the broken record is ignored\n\r", path)
+			break
+		}
+		var record wal_record
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&record)
+		if err != nil {
+			return nil, fmt.Errorf("the record of wal unable to decode: %w", err)
+		}
+		if record.Done {
+			delete(pending, record.Seq)
+			continue
+		}
+		pending[record.Seq] = &record
+		order = append(order, record.Seq)
+	}
+
+	records := make([]*wal_record, 0, len(pending))
+	for _, seq := range order {
+		if record, ok := pending[seq]; ok {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/thb-cmyk/aliyum-demo/databasic"
+)
+
+/*
+the function quarantines the message that is malformed or unable to process to the dead letter store of the
+broker, and returns the id of the dead letter. The message is not quarantined and the error is returned, if the
+persistent store unable to write it.
+*/
+func deadLetterPut(properties map[string]interface{}, payload []byte, reason error) (string, error) {
+	return databasic.DeadLetter_store().DeadLetterStore_put(databasic.DeadLetter{
+		Topic:      fmt.Sprint(properties["topic"]),
+		Properties: properties,
+		Payload:    payload,
+		Reason:     reason.Error(),
+	})
+}
+
+/*
+the function handles the dead letter named id again. The message quarantined is handled by the messagePreHandle,
+and the data parked by the broker is sent to its route again. The dead letter is removed, if it is successful.
+*/
+func deadLetterReplay(id string) error {
+	letter, ok := databasic.DeadLetter_store().DeadLetterStore_get(id)
+	if !ok {
+		return fmt.Errorf("the dead letter %s is not found", id)
+	}
+	if letter.Route != "" {
+		return databasic.DeadLetter_replay(id)
+	}
+	return databasic.DeadLetter_store().DeadLetterStore_replay(id, func(letter databasic.DeadLetter) error {
+		return messagePreHandle(letter.Properties, letter.Payload)
+	})
+}
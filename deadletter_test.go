@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/thb-cmyk/aliyum-demo/databasic"
+)
+
+func TestDeadLetterStore(t *testing.T) {
+	databasic.All_Init()
+	failures := 1
+	procenode := databasic.ProceNode_register(func(ctx context.Context, tasknode *databasic.TaskNode, rawnode *databasic.RawNode) error {
+		if failures > 0 {
+			failures--
+			return errors.New("temporary")
+		}
+		return nil
+	}, "aliyun")
+	databasic.Subscribe("aliyun.#", procenode)
+	databasic.Broker_start(context.Background())
+	defer databasic.Shutdown(context.Background())
+
+	// the malformed message is returned as a error instead of panic, and it is quarantined to the store of the broker
+	properties := map[string]interface{}{"topic": 1}
+	err := messagePreHandle(properties, nil)
+	if err == nil {
+		t.Fatalf("the malformed message is handled without error")
+	}
+	message, _ := deadLetterPut(properties, nil, err)
+
+	// the data failed by the processer is parked in the same store
+	properties = map[string]interface{}{"topic": "/as/mqtt/status/pk001/dev001", "generateTime": int64(1)}
+	if err := messagePreHandle(properties, []byte(`{"status":"online"}`)); err != nil {
+		t.Fatalf("the message is not delivered: %s", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(databasic.DeadLetter_store().DeadLetterStore_list()) != 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the dead letters are %+v, want the message and the data", databasic.DeadLetter_store().DeadLetterStore_list())
+		}
+	}
+	letters := databasic.DeadLetter_store().DeadLetterStore_list()
+	if letters[0].Id != message || letters[1].Route != "aliyun.pk001.dev001.status" || letters[1].Reason != "temporary" {
+		t.Fatalf("the dead letters are %+v, want the message and the data", letters)
+	}
+
+	// the failed replay keep the dead letter and update the reason
+	err = deadLetterReplay(message)
+	letter, ok := databasic.DeadLetter_store().DeadLetterStore_get(message)
+	if err == nil || !ok || letter.Reason != err.Error() || letter.Replays != 1 {
+		t.Errorf("the failed replay return %v, the dead letter is %v", err, letter)
+	}
+
+	// the successful replay remove the dead letter, the data is sent to its route again
+	if err := deadLetterReplay(letters[1].Id); err != nil {
+		t.Errorf("the replay of the data return %v", err)
+	}
+	if _, ok := databasic.DeadLetter_store().DeadLetterStore_get(letters[1].Id); ok {
+		t.Errorf("the replayed dead letter is not removed")
+	}
+	if !databasic.DeadLetter_store().DeadLetterStore_discard(message) || len(databasic.DeadLetter_store().DeadLetterStore_list()) != 0 {
+		t.Errorf("the dead letter is not discarded")
+	}
+}
+
+func TestMessageDeliverClosed(t *testing.T) {
+	databasic.All_Init()
+	databasic.Broker_start(context.Background())
+	databasic.Shutdown(context.Background())
+
+	// the message is not malformed, so the error undelivered while the broker is shut down is not quarantined
+	properties := map[string]interface{}{"topic": "/as/mqtt/status/pk001/dev001", "generateTime": int64(1)}
+	err := messagePreHandle(properties, []byte(`{"status":"online"}`))
+	if !errors.Is(err, databasic.ErrBrokerClosed) {
+		t.Errorf("the message undelivered while the broker is shut down return %v", err)
+	}
+
+	properties = map[string]interface{}{"topic": "/pk001/dev001/user/unknown", "generateTime": int64(1)}
+	err = messagePreHandle(properties, nil)
+	if err == nil || errors.Is(err, databasic.ErrBrokerClosed) {
+		t.Errorf("the malformed message return %v", err)
+	}
+}
+
+func TestMessageDeviceKey(t *testing.T) {
+	databasic.All_Init()
+	keys := make(chan string, 1)
+	procenode := databasic.ProceNode_register(func(ctx context.Context, tasknode *databasic.TaskNode, rawnode *databasic.RawNode) error {
+		keys <- rawnode.Key
+		return nil
+	}, "aliyun")
+	databasic.Subscribe("aliyun.#", procenode)
+	databasic.Broker_start(context.Background())
+	defer databasic.Shutdown(context.Background())
+
+	// the device name is unique only in the product, so the key of the device includes the product key
+	properties := map[string]interface{}{"topic": "/as/mqtt/status/pk001/dev001", "generateTime": int64(1)}
+	if err := messagePreHandle(properties, []byte(`{"status":"online"}`)); err != nil {
+		t.Fatalf("the message is not delivered: %s", err)
+	}
+	select {
+	case key := <-keys:
+		if key != "pk001/dev001" {
+			t.Errorf("the key of the rawnode is %q, want pk001/dev001", key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("the rawnode is not processed")
+	}
+}
+
+func TestDebugTask(t *testing.T) {
+	databasic.All_Init()
+	databasic.Broker_start(context.Background())
+	defer databasic.Shutdown(context.Background())
+	procenode := databasic.ProceNode_register(func(ctx context.Context, tasknode *databasic.TaskNode, rawnode *databasic.RawNode) error {
+		return nil
+	}, "debug")
+	tasknode := databasic.TaskNode_register("debug", procenode, databasic.DEFAULT_TIMEPEICE)
+
+	request := func(method string, form url.Values) int {
+		recorder := httptest.NewRecorder()
+		debugTaskHandler(recorder, httptest.NewRequest(method, "/debug/broker/task?"+form.Encode(), nil))
+		return recorder.Code
+	}
+	if code := request(http.MethodGet, url.Values{"id": {"debug"}, "op": {"pause"}}); code != http.StatusMethodNotAllowed {
+		t.Errorf("the get request returns %d, want 405", code)
+	}
+	if code := request(http.MethodPost, url.Values{"id": {"debug"}, "op": {"stop"}}); code != http.StatusBadRequest {
+		t.Errorf("the unknown operation returns %d, want 400", code)
+	}
+	if code := request(http.MethodPost, url.Values{"id": {"debug"}, "op": {"resize"}, "value": {"big"}}); code != http.StatusBadRequest {
+		t.Errorf("the invalid size returns %d, want 400", code)
+	}
+	if code := request(http.MethodPost, url.Values{"id": {"debug"}, "op": {"pause"}}); code != http.StatusOK || !tasknode.TaskNode_is_paused() {
+		t.Errorf("the pause returns %d, want the task paused", code)
+	}
+	if code := request(http.MethodPost, url.Values{"id": {"debug"}, "op": {"resize"}, "value": {"8"}}); code != http.StatusOK || cap(tasknode.TaskNode_buffer()) != 8 {
+		t.Errorf("the resize returns %d, want the buffer of 8", code)
+	}
+	if code := request(http.MethodPost, url.Values{"id": {"debug"}, "op": {"unregister"}}); code != http.StatusOK || databasic.TaskNode_find("debug") != nil {
+		t.Errorf("the unregister returns %d, want the task unregistered", code)
+	}
+	if code := request(http.MethodPost, url.Values{"id": {"debug"}, "op": {"resume"}}); code != http.StatusBadRequest {
+		t.Errorf("the operation of the missing task returns %d, want 400", code)
+	}
+}
@@ -1,230 +1,360 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
-	"sync"
+	"time"
 
 	"github.com/thb-cmyk/aliyum-demo/databasic"
 )
 
-// define the structure including the http response and request and a waitgroup to synchronize databasic processer node and http sever
-type requestresponse struct {
-	resp http.ResponseWriter
-	requ *http.Request
-	wg   *sync.WaitGroup
+// the query of a device received from the http client, which is sent to the processer by the databasic.Call
+type deviceQuery struct {
+	deviceName string
+	index      int
 }
 
 /*
 the funciton aims to initialize a http server, which receive http request and send a response to the http client.
+It returns after the ctx is done and the requests in processing are finished.
 */
-func IntrefaceInit() {
+func IntrefaceInit(ctx context.Context) {
 	http.HandleFunc("/voltage", voltageHandler)
 	http.HandleFunc("/check_mode", checkmodeHandler)
 	http.HandleFunc("/error_info", errorinfoHandler)
 	http.HandleFunc("/status", statusHandler)
 
-	http.ListenAndServe(":8080", nil)
+	// the following handler is used to manage the dead letter store
+	http.HandleFunc("/deadletter", deadletterListHandler)
+	http.HandleFunc("/deadletter/inspect", deadletterInspectHandler)
+	http.HandleFunc("/deadletter/replay", deadletterReplayHandler)
+	http.HandleFunc("/deadletter/discard", deadletterDiscardHandler)
+
+	// the following handler is used to inspect the broker during an incident
+	http.HandleFunc("/debug/broker", debugBrokerHandler)
+	http.HandleFunc("/debug/broker/task", debugTaskHandler)
+
+	server := &http.Server{Addr: ":8080"}
+	go func() {
+		<-ctx.Done()
+		// the requests in processing are still handled by the broker, which is shut down after the http server
+		shutdown_ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		server.Shutdown(shutdown_ctx)
+	}()
+
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("the http server is stopped: %s\n\r", err.Error())
+	}
 }
 
 /*
-the function is a handler, the router route request received from client to proper handler
+the function parses the query of a device from the request, the index is 1 if it is not a number.
 */
-func voltageHandler(writer http.ResponseWriter, reader *http.Request) {
-
-	var wg sync.WaitGroup
+func queryParse(reader *http.Request) *deviceQuery {
+	query := &deviceQuery{index: 1}
 
-	wg.Add(1)
-
-	rr := requestresponse{writer, reader, &wg}
+	err := reader.ParseForm()
+	if err != nil {
+		fmt.Print(err.Error())
+	}
+	index, err := strconv.Atoi(reader.FormValue("index"))
+	if err != nil {
+		fmt.Print(err.Error())
+	} else {
+		query.index = index
+	}
+	query.deviceName = reader.FormValue("device_name")
 
-	rawnode := databasic.RawNode_create("voltage", &rr)
+	return query
+}
 
-	databasic.Send_raw(rawnode)
+/*
+the function calls the processer named route by the databasic with the query of the request, and responses the
+reply to the client. The call is canceled while the client is disconnected.
+*/
+func queryCall(writer http.ResponseWriter, reader *http.Request, route string) {
+	reply, err := databasic.Call(reader.Context(), route, queryParse(reader))
+	if err != nil {
+		switch {
+		case errors.Is(err, databasic.ErrBrokerClosed):
+			http.Error(writer, "the service is shutting down", http.StatusServiceUnavailable)
+		case errors.Is(err, databasic.ErrOverflowDropped), errors.Is(err, databasic.ErrOverflowRejected):
+			http.Error(writer, "the service is busy", http.StatusServiceUnavailable)
+		case errors.Is(err, context.DeadlineExceeded):
+			http.Error(writer, "the service is timeout", http.StatusGatewayTimeout)
+		default:
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
 
-	wg.Wait()
+	result, _ := reply.([]byte)
+	writer.Write(result)
+}
 
+/*
+the function is a handler, the router route request received from client to proper handler
+*/
+func voltageHandler(writer http.ResponseWriter, reader *http.Request) {
+	queryCall(writer, reader, "voltage")
 }
 
 /*
 the function is a handler, the router route request received from client to proper handler.
 */
 func checkmodeHandler(writer http.ResponseWriter, reader *http.Request) {
-	var wg sync.WaitGroup
-
 	fmt.Printf("location check_mode\n\r")
 
-	wg.Add(1)
-
-	rr := requestresponse{writer, reader, &wg}
-
-	rawnode := databasic.RawNode_create("check_mode", &rr)
-
-	databasic.Send_raw(rawnode)
-
-	wg.Wait()
+	queryCall(writer, reader, "check_mode")
 }
 
 /*
 the function is a handler, the router route request received from client to proper handler
 */
 func errorinfoHandler(writer http.ResponseWriter, reader *http.Request) {
-	var wg sync.WaitGroup
-
-	wg.Add(1)
-
-	rr := requestresponse{writer, reader, &wg}
-
-	rawnode := databasic.RawNode_create("error_info", &rr)
-
-	databasic.Send_raw(rawnode)
-
-	wg.Wait()
+	queryCall(writer, reader, "error_info")
 }
 
 func statusHandler(writer http.ResponseWriter, reader *http.Request) {
-	var wg sync.WaitGroup
+	queryCall(writer, reader, "status")
+}
 
-	wg.Add(1)
+/*
+create a processor to handle the query received from the http client.we should registry it to databasic
+*/
+func voltageProccesser(ctx context.Context, tasknode *databasic.TaskNode, query *deviceQuery) ([]byte, error) {
 
-	rr := requestresponse{writer, reader, &wg}
+	log.Print("voltageProcesser\n\r")
 
-	rawnode := databasic.RawNode_create("status", &rr)
+	result := Select(ctx, query.deviceName, "voltage", query.index)
 
-	databasic.Send_raw(rawnode)
+	fmt.Printf("len: %d, content: %s\n\r", len(result), result)
 
-	wg.Wait()
+	return result, nil
 }
 
 /*
-create a processor to handle the request received from the http client.we should registry it to databasic
+create a processor to handle the query received from the http client.we should registry it to databasic
 */
-func voltageProccesser(tasknode *databasic.TaskNode, rawnode *databasic.RawNode) bool {
+func checkmodeProccesser(ctx context.Context, tasknode *databasic.TaskNode, query *deviceQuery) ([]byte, error) {
 
-	log.Print("voltageProcesser\n\r")
+	result := Select(ctx, query.deviceName, "check_mode", query.index)
 
-	rr := rawnode.Raw.(*requestresponse)
+	fmt.Printf("len: %d, content: %s\n\r", len(result), result)
 
-	writer := rr.resp
+	return result, nil
+}
 
-	reader := rr.requ
+/*
+create a processor to handle the query received from the http client.we should registry it to databasic
+*/
+func errorinfoProccesser(ctx context.Context, tasknode *databasic.TaskNode, query *deviceQuery) ([]byte, error) {
 
-	var index int
+	result := Select(ctx, query.deviceName, "error_info", query.index)
 
-	err := reader.ParseForm()
-	if err != nil {
-		index = 1
-	}
-	index, err = strconv.Atoi(reader.FormValue("index"))
-	if err != nil {
-		fmt.Print(err.Error())
-	}
-	deviceName := reader.FormValue("device_name")
+	fmt.Printf("len: %d, content: %s\n\r", len(result), result)
 
-	result := Select(deviceName, "voltage", index)
+	return result, nil
+}
 
-	fmt.Printf("len: %d, content: %s\n\r", len(result), result)
+func statusProccesser(ctx context.Context, tasknode *databasic.TaskNode, query *deviceQuery) ([]byte, error) {
 
-	writer.Write(result)
+	result := Select(ctx, query.deviceName, "status", query.index)
 
-	rr.wg.Done()
+	fmt.Printf("len: %d, content: %s\n\r", len(result), result)
 
-	return true
+	return result, nil
 }
 
 /*
-create a processor to handle the request received from the http client.we should registry it to databasic
+the function is a handler, which return the snapshot of the broker as the text tables, or the json if the format is json.
+It is handled in the http go routine instead of the broker, so it works even if the broker is stalled.
 */
-func checkmodeProccesser(tasknode *databasic.TaskNode, rawnode *databasic.RawNode) bool {
-	rr := rawnode.Raw.(*requestresponse)
-
-	writer := rr.resp
+func debugBrokerHandler(writer http.ResponseWriter, reader *http.Request) {
+	snapshot := databasic.Broker_snapshot()
+	if reader.FormValue("format") == "json" {
+		result, err := json.Marshal(snapshot)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(result)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	snapshot.BrokerSnapshot_write(writer)
+}
 
-	reader := rr.requ
+// the operations of the task handled by the debugTaskHandler, which are sent to the controler of the broker as the monitors
+var debugTaskOperations = map[string]int{
+	"pause":      databasic.Pause,
+	"resume":     databasic.Resume,
+	"update":     databasic.Update,
+	"resize":     databasic.Resize,
+	"timepeice":  databasic.Timepeice,
+	"unregister": databasic.Unregister,
+}
 
-	var index int
+// the time waiting for the controler of the broker to acknowledge the operation of the task
+const DEBUG_TASK_TIMEOUT time.Duration = 5 * time.Second
 
-	err := reader.ParseForm()
-	if err != nil {
-		index = 1
+/*
+the function is a handler, which operates the task named id by the op, e.g. pause or resize it during an incident.
+The value is the procenode id for the update, the buffer size for the resize and the duration such as "5s" for the
+timepeice. The rawnodes left in the task unregistered are parked in the dead letter of the broker.
+*/
+func debugTaskHandler(writer http.ResponseWriter, reader *http.Request) {
+	if reader.Method != http.MethodPost {
+		http.Error(writer, "The method is not allowed.", http.StatusMethodNotAllowed)
+		return
 	}
-	index, err = strconv.Atoi(reader.FormValue("index"))
-	if err != nil {
-		fmt.Print(err.Error())
+	operation, ok := debugTaskOperations[reader.FormValue("op")]
+	if !ok {
+		http.Error(writer, "The operation is not supported.", http.StatusBadRequest)
+		return
 	}
-	deviceName := reader.FormValue("device_name")
 
-	result := Select(deviceName, "check_mode", index)
-	fmt.Printf("len: %d, content: %s\n\r", len(result), result)
+	var information interface{}
+	value := reader.FormValue("value")
+	switch operation {
+	case databasic.Update:
+		information = value
+	case databasic.Resize:
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		information = size
+	case databasic.Timepeice:
+		timepeice, err := time.ParseDuration(value)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		information = timepeice
+	}
 
+	ctx, cancel := context.WithTimeout(reader.Context(), DEBUG_TASK_TIMEOUT)
+	defer cancel()
+	err := databasic.Monitor_send(ctx, reader.FormValue("id"), operation, information)
+	if err != nil {
+		switch {
+		case errors.Is(err, databasic.ErrBrokerClosed):
+			http.Error(writer, "the service is shutting down", http.StatusServiceUnavailable)
+		case errors.Is(err, context.DeadlineExceeded):
+			http.Error(writer, "the controler is timeout", http.StatusGatewayTimeout)
+		default:
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	result, _ := json.Marshal(map[string]string{reader.FormValue("id"): "done"})
+	writer.Header().Set("Content-Type", "application/json")
 	writer.Write(result)
-
-	rr.wg.Done()
-
-	return true
 }
 
 /*
-create a processor to handle the request received from the http client.we should registry it to databasic
+the function is a handler, which list all the dead letters without the payload.
 */
-func errorinfoProccesser(tasknode *databasic.TaskNode, rawnode *databasic.RawNode) bool {
-	rr := rawnode.Raw.(*requestresponse)
-
-	writer := rr.resp
-
-	reader := rr.requ
-
-	var index int
-
-	err := reader.ParseForm()
-	if err != nil {
-		index = 1
-	}
-	index, err = strconv.Atoi(reader.FormValue("index"))
+func deadletterListHandler(writer http.ResponseWriter, reader *http.Request) {
+	result, err := json.Marshal(databasic.DeadLetter_store().DeadLetterStore_list())
 	if err != nil {
-		fmt.Print(err.Error())
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	deviceName := reader.FormValue("device_name")
-
-	result := Select(deviceName, "error_info", index)
-
-	fmt.Printf("len: %d, content: %s\n\r", len(result), result)
-
+	writer.Header().Set("Content-Type", "application/json")
 	writer.Write(result)
-
-	rr.wg.Done()
-
-	return true
 }
 
-func statusProccesser(tasknode *databasic.TaskNode, rawnode *databasic.RawNode) bool {
-	rr := rawnode.Raw.(*requestresponse)
-
-	writer := rr.resp
-
-	reader := rr.requ
-
-	var index int
-
-	err := reader.ParseForm()
-	if err != nil {
-		index = 1
+/*
+the function is a handler, which return the dead letter named id including the payload.
+*/
+func deadletterInspectHandler(writer http.ResponseWriter, reader *http.Request) {
+	letter, ok := databasic.DeadLetter_store().DeadLetterStore_get(reader.FormValue("id"))
+	if !ok {
+		http.Error(writer, "The dead letter is not found.", http.StatusNotFound)
+		return
 	}
-	index, err = strconv.Atoi(reader.FormValue("index"))
+	result, err := json.Marshal(struct {
+		databasic.DeadLetter
+		Payload string      `json:"payload"`
+		Raw     interface{} `json:"raw,omitempty"`
+	}{letter, string(letter.Payload), letter.Raw})
 	if err != nil {
-		fmt.Print(err.Error())
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	deviceName := reader.FormValue("device_name")
-
-	result := Select(deviceName, "status", index)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(result)
+}
 
-	fmt.Printf("len: %d, content: %s\n\r", len(result), result)
+/*
+the function is a handler, which handle the dead letter named id again. if the id is "all", all the
+dead letters are replayed. The result of each dead letter is responsed to the client.
+*/
+func deadletterReplayHandler(writer http.ResponseWriter, reader *http.Request) {
+	if reader.Method != http.MethodPost {
+		http.Error(writer, "The method is not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
 
+	ids := deadletterIds(reader.FormValue("id"))
+	results := make(map[string]string, len(ids))
+	for _, id := range ids {
+		err := deadLetterReplay(id)
+		if err != nil {
+			results[id] = err.Error()
+		} else {
+			results[id] = "replayed"
+		}
+	}
+	result, _ := json.Marshal(results)
+	writer.Header().Set("Content-Type", "application/json")
 	writer.Write(result)
+}
 
-	rr.wg.Done()
+/*
+the function is a handler, which discard the dead letter named id. if the id is "all", all the dead
+letters are discarded.
+*/
+func deadletterDiscardHandler(writer http.ResponseWriter, reader *http.Request) {
+	if reader.Method != http.MethodPost {
+		http.Error(writer, "The method is not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
 
-	return true
+	ids := deadletterIds(reader.FormValue("id"))
+	results := make(map[string]string, len(ids))
+	for _, id := range ids {
+		if databasic.DeadLetter_store().DeadLetterStore_discard(id) {
+			results[id] = "discarded"
+		} else {
+			results[id] = "The dead letter is not found."
+		}
+	}
+	result, _ := json.Marshal(results)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(result)
+}
+
+// the function return the dead letter ids matched with the id, which the "all" matching all ids
+func deadletterIds(id string) []string {
+	if id != "all" {
+		return []string{id}
+	}
+	letters := databasic.DeadLetter_store().DeadLetterStore_list()
+	ids := make([]string, 0, len(letters))
+	for _, letter := range letters {
+		ids = append(ids, letter.Id)
+	}
+	return ids
 }
@@ -1,11 +1,35 @@
 package main
 
 import (
+	"context"
+	"encoding/gob"
 	"log"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/thb-cmyk/aliyum-demo/databasic"
 )
 
+// the number of go routines processing the data received from aliyun
+const ALIYUN_CONCURRENCY int = 4
+
+// the buffer size of the task processing the data received from aliyun, the data is rejected to the amqp server while it is full
+const ALIYUN_BUFFER_SIZE int = 1000
+
+// the max rate and burst of the data received from a device, the data over the rate is dropped, so a misbehaving device never starves the others
+const ALIYUN_DEVICE_RATE float64 = 10
+const ALIYUN_DEVICE_BURST int = 50
+
+// the directory of the write-ahead log, which keeps the data received from aliyun until it is processed
+const WAL_DIR string = "data/wal"
+
+// the directory of the dead letter store, which keeps the message quarantined across the restart
+const DEADLETTER_DIR string = "data/deadletter"
+
+// the max time of draining the data left in the broker, while the service is stopped
+const SHUTDOWN_TIMEOUT time.Duration = 20 * time.Second
+
 // configure loger for the project
 func logConfig() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
@@ -17,24 +41,101 @@ func main() {
 
 	logConfig()
 
+	// the ctx is canceled by the SIGINT or SIGTERM, which stops the http server and the amqp client
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	databasic.All_Init()
 
-	databasic.Broker()
+	// the data types held by the rawnodes are registered, so the rawnodes can be written to the write-ahead log
+	gob.Register(&GeneralStructure{})
+	gob.Register(ValueStructure{})
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	err := databasic.WAL_open(WAL_DIR, false, "aliyun.#")
+	if err != nil {
+		log.Printf("the write-ahead log unable to open, the data is not durable: %s\n\r", err.Error())
+	}
+	defer databasic.WAL_close()
+
+	// the message quarantined and the data parked are kept in memory only, if the dead letter store unable to open
+	err = databasic.DeadLetter_open(DEADLETTER_DIR)
+	if err != nil {
+		log.Printf("the dead letter store unable to open, the dead letters are not durable: %s\n\r", err.Error())
+	}
+	defer databasic.DeadLetter_close()
+
+	// the broker is shut down by the following Shutdown after the http server, so the data left is drained
+	databasic.Broker_start(context.Background())
 
-	databasic.ProceNode_register(dataProccessor, "aliyun")
+	// the data of different devices is processed concurrently, and the data of one device is processed in order
+	aliyun := databasic.ProceNode_register_pool(databasic.TypedProcessor(dataProccessor), "aliyun", ALIYUN_CONCURRENCY, nil)
+	if aliyun != nil {
+		aliyun.ProceNode_set_overflow(databasic.OverflowPolicy{Mode: databasic.OVERFLOW_REJECT}, ALIYUN_BUFFER_SIZE)
+		// the data of all the products is processed by the procenode, a product or a device can be subscribed by
+		// another procenode with a more specific pattern, e.g. "aliyun.${productKey}.#"
+		databasic.Subscribe("aliyun.#", aliyun)
+	}
+	err = databasic.RateLimit_set_device(databasic.RATE_ANY_DEVICE, databasic.RateLimit{Rate: ALIYUN_DEVICE_RATE, Burst: ALIYUN_DEVICE_BURST})
+	if err != nil {
+		log.Printf("the rate limit of devices unable to set: %s\n\r", err.Error())
+	}
 
 	MysqlInit()
 
 	defer MysqlDeInit()
 
-	go Aliyun_Connect()
+	ThingModelInit()
+
+	// the thing models are refreshed by the job, instead of being loaded while the data arrives
+	if databasic.ProceNode_register(thingModelRefresher, "thingmodel.refresh") != nil {
+		job, err := databasic.Job_register("thingmodel.refresh", "thingmodel.refresh", THINGMODEL_REFRESH_SCHEDULE, nil)
+		if err != nil {
+			log.Printf("the job refreshing the thing models unable to register: %s\n\r", err.Error())
+		} else {
+			job.Job_set_jitter(THINGMODEL_REFRESH_JITTER)
+		}
+	}
+
+	// the data not processed before the last stopping is processed before the new data
+	replayed := databasic.WAL_replay()
+	if replayed > 0 {
+		log.Printf("%d data is replayed from the write-ahead log\n\r", replayed)
+	}
+
+	go Aliyun_Connect(ctx)
 
-	// the following processer node is used to handle the http request
-	databasic.ProceNode_register(voltageProccesser, "voltage")
-	databasic.ProceNode_register(checkmodeProccesser, "check_mode")
-	databasic.ProceNode_register(errorinfoProccesser, "error_info")
-	databasic.ProceNode_register(statusProccesser, "status")
+	// the following processer node is used to handle the http request, which is served ahead of the data received from aliyun
+	interactive := []*databasic.ProceNode{
+		databasic.ProceNode_register(databasic.TypedReply(voltageProccesser), "voltage"),
+		databasic.ProceNode_register(databasic.TypedReply(checkmodeProccesser), "check_mode"),
+		databasic.ProceNode_register(databasic.TypedReply(errorinfoProccesser), "error_info"),
+		databasic.ProceNode_register(databasic.TypedReply(statusProccesser), "status"),
+	}
+	for _, procenode := range interactive {
+		if procenode != nil {
+			procenode.ProceNode_set_priority(databasic.PRIORITY_INTERACTIVE, databasic.DEFAULT_WEIGHT)
+			// the http request is rejected with 503 while the buffer is full, waiting for the buffer would stall the
+			// router, and the data of all the other routes behind the request
+			procenode.ProceNode_set_overflow(databasic.OverflowPolicy{Mode: databasic.OVERFLOW_REJECT}, databasic.DEFAULT_BUFFER_SIZE)
+		}
+	}
 
-	IntrefaceInit()
+	IntrefaceInit(ctx)
 
+	// drain the data left in the broker before closing the mysql
+	shutdown_ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	report, err := databasic.Shutdown(shutdown_ctx)
+	if err != nil {
+		log.Printf("the broker is not drained: %s\n\r", err.Error())
+	}
+	if report != nil {
+		// the data admitted but not kept in the write-ahead log is parked, the amqp message of it is accepted already
+		for _, rawnode := range report.Rawnodes {
+			databasic.DeadLetter_park(rawnode)
+		}
+		log.Printf("the broker is shut down, %d data is undelivered, %d data is replayed after restarting and %d data is parked\n\r",
+			report.Total(), report.Logged, report.Parked+len(report.Rawnodes))
+	}
 }
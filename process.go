@@ -2,19 +2,30 @@ package main
 
 import (
 	"container/list"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/thb-cmyk/aliyum-demo/databasic"
 	"github.com/thb-cmyk/aliyum-demo/utils"
 )
 
 var db *sql.DB
 
+// the cached values are served for the time after the last insert of the process, the table may be written by other
+// processes meanwhile
+const CACHE_TTL time.Duration = time.Minute
+
 var tables *list.List
 
+// the lock protects the tables list, which is accessed by the concurrent processors
+var tables_lock sync.RWMutex
+
 // define the structure of check_mode, voltage and error_info
 type VoltageStructure struct {
 	Voltage    float64 `json:"voltage"`
@@ -41,6 +52,7 @@ type StatusStructure struct {
 }
 
 type GeneralStructure struct {
+	ProductKey string      `json:"product_key"`
 	DeviceName string      `json:"device_name"`
 	Time       string      `json:"time"`
 	Value      interface{} `json:"value"`
@@ -107,6 +119,26 @@ func MysqlInit() {
 	}
 }
 
+// check the table named table_name is exist or not
+func tableExist(table_name string) bool {
+	tables_lock.RLock()
+	defer tables_lock.RUnlock()
+
+	for e := tables.Front(); e != nil; e = e.Next() {
+		if e.Value == table_name {
+			return true
+		}
+	}
+	return false
+}
+
+// add the table named table_name to the tables list
+func tableAdd(table_name string) {
+	tables_lock.Lock()
+	tables.PushFront(table_name)
+	tables_lock.Unlock()
+}
+
 /**
  * @brief: deinit the mysql database
  */
@@ -119,27 +151,31 @@ func MysqlDeInit() {
 	db.Close()
 }
 
-func Insert(gt GeneralStructure) (sql.Result, error) {
-	value := gt.Value.(ValueStructure).Params
+func Insert(ctx context.Context, gt GeneralStructure) (sql.Result, error) {
+	vs, ok := gt.Value.(ValueStructure)
+	if !ok {
+		return nil, fmt.Errorf("the value of device %s is not a ValueStructure", gt.DeviceName)
+	}
+	value := vs.Params
 	deviceName := gt.DeviceName
 	for key, value := range value {
 		table_name := deviceName + key
 		fmt.Print(table_name)
 		switch key {
 		case "voltage":
-			voltage_value := value.(float64)
+			voltage_value, ok := value.(float64)
+			if !ok {
+				return nil, fmt.Errorf("the %s value %v of device %s is not a float64", key, value, deviceName)
+			}
 			var voltage VoltageStructure
 			voltage.DeviceName = deviceName
 			voltage.Voltage = voltage_value
 			voltage.Time = gt.Time
 			// find the table in the tables list
-			for e := tables.Front(); e != nil; e = e.Next() {
-				if e.Value == table_name {
-					// insert the value to the table
-					result, err := VoltageInsertStmt(voltage)
-					return result, err
-
-				}
+			if tableExist(table_name) {
+				// insert the value to the table
+				result, err := VoltageInsertStmt(ctx, voltage)
+				return result, err
 			}
 			// the table of named talbe_name is not exist
 			// create the table
@@ -149,22 +185,24 @@ func Insert(gt GeneralStructure) (sql.Result, error) {
 				return nil, err
 			}
 			// insert the value to the table
-			result, err := VoltageInsertStmt(voltage)
+			result, err := VoltageInsertStmt(ctx, voltage)
 			return result, err
 
 		case "check_mode":
-			check_mode_value := int(value.(float64))
+			number, ok := value.(float64)
+			if !ok {
+				return nil, fmt.Errorf("the %s value %v of device %s is not a number", key, value, deviceName)
+			}
+			check_mode_value := int(number)
 			var check_mode CheckModeStructure
 			check_mode.DeviceName = deviceName
 			check_mode.CheckMode = check_mode_value
 			check_mode.Time = gt.Time
 			// find the table in the tables list
-			for e := tables.Front(); e != nil; e = e.Next() {
-				if e.Value == table_name {
-					// insert the value to the table
-					result, err := CheckModeInsertStmt(check_mode)
-					return result, err
-				}
+			if tableExist(table_name) {
+				// insert the value to the table
+				result, err := CheckModeInsertStmt(ctx, check_mode)
+				return result, err
 			}
 			// the table of named talbe_name is not exist
 			// create the table
@@ -174,22 +212,24 @@ func Insert(gt GeneralStructure) (sql.Result, error) {
 				return nil, err
 			}
 			// insert the value to the table
-			result, err := CheckModeInsertStmt(check_mode)
+			result, err := CheckModeInsertStmt(ctx, check_mode)
 			return result, err
 
 		case "error_info":
-			error_info_value := int(value.(float64))
+			number, ok := value.(float64)
+			if !ok {
+				return nil, fmt.Errorf("the %s value %v of device %s is not a number", key, value, deviceName)
+			}
+			error_info_value := int(number)
 			var error_info ErrorInfoStructure
 			error_info.DeviceName = deviceName
 			error_info.ErrorInfo = error_info_value
 			error_info.Time = gt.Time
 			// find the table in the tables list
-			for e := tables.Front(); e != nil; e = e.Next() {
-				if e.Value == table_name {
-					// insert the value to the table
-					result, err := ErrorInfoInsertStmt(error_info)
-					return result, err
-				}
+			if tableExist(table_name) {
+				// insert the value to the table
+				result, err := ErrorInfoInsertStmt(ctx, error_info)
+				return result, err
 			}
 			// the table of named talbe_name is not exist
 			// create the table
@@ -199,22 +239,23 @@ func Insert(gt GeneralStructure) (sql.Result, error) {
 				return nil, err
 			}
 			// insert the value to the table
-			result, err := ErrorInfoInsertStmt(error_info)
+			result, err := ErrorInfoInsertStmt(ctx, error_info)
 			return result, err
 
 		case "status":
-			status_value := value.(string)
+			status_value, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("the %s value %v of device %s is not a string", key, value, deviceName)
+			}
 			var status StatusStructure
 			status.DeviceName = deviceName
 			status.Status = status_value
 			status.Time = gt.Time
 			// find the table in the tables list
-			for e := tables.Front(); e != nil; e = e.Next() {
-				if e.Value == table_name {
-					// insert the value to the table
-					result, err := StatusInsertStmt(status)
-					return result, err
-				}
+			if tableExist(table_name) {
+				// insert the value to the table
+				result, err := StatusInsertStmt(ctx, status)
+				return result, err
 			}
 			// the table of named talbe_name is not exist
 			// create the table
@@ -224,7 +265,7 @@ func Insert(gt GeneralStructure) (sql.Result, error) {
 				return nil, err
 			}
 			// insert the value to the table
-			result, err := StatusInsertStmt(status)
+			result, err := StatusInsertStmt(ctx, status)
 			return result, err
 
 		default:
@@ -236,45 +277,41 @@ func Insert(gt GeneralStructure) (sql.Result, error) {
 
 }
 
-func Select(deviceName string, table_type string, index int) []byte {
+func Select(ctx context.Context, deviceName string, table_type string, index int) []byte {
+	// the recent values are served by the cache, the database is selected only if the cache holds less or is stale
+	if data, ok := cacheSelect(deviceName, table_type, index); ok {
+		return data
+	}
 	switch table_type {
 	case "voltage":
 		tableName := deviceName + table_type
-		for e := tables.Front(); e != nil; e = e.Next() {
-			if e.Value == tableName {
-				data := VoltageSelectStmt(deviceName, index)
-				return data
-			}
+		if tableExist(tableName) {
+			data := VoltageSelectStmt(ctx, deviceName, index)
+			return data
 		}
 		data := []byte("The table is not exist.")
 		return data
 	case "check_mode":
 		tableName := deviceName + table_type
-		for e := tables.Front(); e != nil; e = e.Next() {
-			if e.Value == tableName {
-				data := CheckModeSelectStmt(deviceName, index)
-				return data
-			}
+		if tableExist(tableName) {
+			data := CheckModeSelectStmt(ctx, deviceName, index)
+			return data
 		}
 		data := []byte("The table is not exist.")
 		return data
 	case "error_info":
 		tableName := deviceName + table_type
-		for e := tables.Front(); e != nil; e = e.Next() {
-			if e.Value == tableName {
-				data := ErrorInfoSelectStmt(deviceName, index)
-				return data
-			}
+		if tableExist(tableName) {
+			data := ErrorInfoSelectStmt(ctx, deviceName, index)
+			return data
 		}
 		data := []byte("The table is not exist.")
 		return data
 	case "status":
 		tableName := deviceName + table_type
-		for e := tables.Front(); e != nil; e = e.Next() {
-			if e.Value == tableName {
-				data := StatusSelectStmt(deviceName, index)
-				return data
-			}
+		if tableExist(tableName) {
+			data := StatusSelectStmt(ctx, deviceName, index)
+			return data
 		}
 		data := []byte("The table is not exist.")
 		return data
@@ -285,6 +322,40 @@ func Select(deviceName string, table_type string, index int) []byte {
 	return data
 }
 
+// add the inserted value to the cache of the device and table type, which is named as the table, the id of the
+// inserted row is the sequence of the value. The cache is invalidated while the value unable to be cached, otherwise
+// it would be served without the inserted row
+func cachePut(deviceName string, table_type string, result sql.Result, value interface{}) {
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Printf("Unable to get the id of the %s of device %s, it is not cached.\n\r", table_type, deviceName)
+		databasic.Cache_invalidate(deviceName + table_type)
+		return
+	}
+	if databasic.Cache_put_seq(deviceName+table_type, id, value, nil) == nil {
+		log.Printf("Unable to cache the %s of device %s.\n\r", table_type, deviceName)
+		databasic.Cache_invalidate(deviceName + table_type)
+	}
+}
+
+// select the index newest values from the cache without the database, it returns false if the cache holds less than
+// index values, or the last value is cached before the CACHE_TTL, so the values written by other processes are read
+func cacheSelect(deviceName string, table_type string, index int) ([]byte, bool) {
+	datanodes, ok := databasic.Cache_fresh(deviceName+table_type, index, CACHE_TTL)
+	if !ok {
+		return nil, false
+	}
+	values := make([]interface{}, len(datanodes))
+	for i, datanode := range datanodes {
+		values[i] = datanode.Message
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
 func CreateTable(deviceName string, table_type string) error {
 	switch table_type {
 	case "voltage":
@@ -336,7 +407,7 @@ func CheckModeCreateStmt(deviceName string) error {
 		log.Panic("Unable to create the table of check_mode.\n\r", err.Error())
 		return err
 	}
-	tables.PushFront(deviceName + "check_mode")
+	tableAdd(deviceName + "check_mode")
 	return nil
 }
 
@@ -353,7 +424,7 @@ func VoltageCreateStmt(deviceName string) error {
 		log.Printf("Unable to create the table of voltage.\n\r", err.Error())
 		return err
 	}
-	tables.PushFront(deviceName + "voltage")
+	tableAdd(deviceName + "voltage")
 	return nil
 }
 
@@ -370,7 +441,7 @@ func ErrorInfoCreateStmt(deviceName string) error {
 		log.Panic("Unable to create the table of error_info.\n\r", err.Error())
 		return err
 	}
-	tables.PushFront(deviceName + "voltage")
+	tableAdd(deviceName + "voltage")
 	return nil
 }
 
@@ -387,11 +458,11 @@ func StatusCreateStmt(deviceName string) error {
 		log.Panic("Unable to create the table of status.\n\r", err.Error())
 		return err
 	}
-	tables.PushFront(deviceName + "status")
+	tableAdd(deviceName + "status")
 	return nil
 }
 
-func CheckModeInsertStmt(checkMode CheckModeStructure) (sql.Result, error) {
+func CheckModeInsertStmt(ctx context.Context, checkMode CheckModeStructure) (sql.Result, error) {
 
 	deviceName := checkMode.DeviceName
 	table_name := deviceName + "check_mode"
@@ -399,96 +470,100 @@ func CheckModeInsertStmt(checkMode CheckModeStructure) (sql.Result, error) {
 	value := checkMode.CheckMode
 
 	stmt_string := fmt.Sprintf("INSERT INTO %s (value, device_name, time) VALUES (%d, \"%s\", \"%s\")", table_name, value, deviceName, time)
-	stmt, err := db.Prepare(stmt_string)
+	stmt, err := db.PrepareContext(ctx, stmt_string)
 	if err != nil {
 		log.Panic("Unable to create the statement of insert to check_mode.\n\r", err.Error())
 		return nil, err
 	}
 	defer stmt.Close()
-	result, err := stmt.Exec()
+	result, err := stmt.ExecContext(ctx)
 	if err != nil {
 		log.Panic("Unable to insert to check_mode.\n\r", err.Error())
 		return nil, err
 	}
 	log.Println("Insert to check_mode successfully. The result is ", result)
+	cachePut(deviceName, "check_mode", result, checkMode)
 	return result, nil
 }
 
-func VoltageInsertStmt(voltage VoltageStructure) (sql.Result, error) {
+func VoltageInsertStmt(ctx context.Context, voltage VoltageStructure) (sql.Result, error) {
 	deviceName := voltage.DeviceName
 	time := voltage.Time
 	value := voltage.Voltage
 	table_name := deviceName + "voltage"
 
 	stmt_string := fmt.Sprintf("INSERT INTO %s (value, device_name, time) VALUES (%f, \"%s\", \"%s\")", table_name, value, deviceName, time)
-	stmt, err := db.Prepare(stmt_string)
+	stmt, err := db.PrepareContext(ctx, stmt_string)
 	if err != nil {
 		log.Panic("Unable to create the statement of insert to voltage. \n\r", err.Error())
 		return nil, err
 	}
 	defer stmt.Close()
-	result, err := stmt.Exec()
+	result, err := stmt.ExecContext(ctx)
 	if err != nil {
 		log.Panic("Unable to insert to voltage.\n\r", err.Error())
 		return nil, err
 	}
 	log.Println("Insert to voltage successfully. The result is ", result)
+	cachePut(deviceName, "voltage", result, voltage)
 	return result, nil
 }
 
-func ErrorInfoInsertStmt(errorInfo ErrorInfoStructure) (sql.Result, error) {
+func ErrorInfoInsertStmt(ctx context.Context, errorInfo ErrorInfoStructure) (sql.Result, error) {
 	deviceName := errorInfo.DeviceName
 	time := errorInfo.Time
 	value := errorInfo.ErrorInfo
 	table_name := deviceName + "error_info"
 
 	stmt_string := fmt.Sprintf("INSERT INTO %s (value, device_name, time) VALUES (%d, \"%s\", \"%s\")", table_name, value, deviceName, time)
-	stmt, err := db.Prepare(stmt_string)
+	stmt, err := db.PrepareContext(ctx, stmt_string)
 	if err != nil {
 		log.Printf("Unable to create the statement of insert to error_info. \n\r", err.Error())
 		return nil, err
 	}
 	defer stmt.Close()
-	result, err := stmt.Exec()
+	result, err := stmt.ExecContext(ctx)
 	if err != nil {
 		log.Printf("Unable to insert to error_info.\n\r", err.Error())
 		return nil, err
 	}
 	log.Println("Insert to error_info successfully. The result is ", result)
+	cachePut(deviceName, "error_info", result, errorInfo)
 	return result, nil
 }
 
-func StatusInsertStmt(status StatusStructure) (sql.Result, error) {
+func StatusInsertStmt(ctx context.Context, status StatusStructure) (sql.Result, error) {
 	deviceName := status.DeviceName
 	time := status.Time
 	value := status.Status
 	table_name := deviceName + "status"
 
 	stmt_string := fmt.Sprintf("INSERT INTO %s (value, device_name, time) VALUES (\"%s\", \"%s\", \"%s\")", table_name, value, deviceName, time)
-	stmt, err := db.Prepare(stmt_string)
+	stmt, err := db.PrepareContext(ctx, stmt_string)
 	if err != nil {
 		log.Panic("Unable to create the statement of insert to status.\n\r", err.Error())
 		return nil, err
 	}
 	defer stmt.Close()
-	result, err := stmt.Exec()
+	result, err := stmt.ExecContext(ctx)
 	if err != nil {
 		log.Panic("Unable to insert to status.\n\r", err.Error())
 		return nil, err
 	}
 	log.Println("Insert to status successfully. The result is ", result)
+	cachePut(deviceName, "status", result, status)
 	return result, nil
 }
 
-func CheckModeSelectStmt(deviceName string, index int) []byte {
+func CheckModeSelectStmt(ctx context.Context, deviceName string, index int) []byte {
 
 	stmt_string := fmt.Sprintf("SELECT value, device_name, time FROM %s ORDER BY id DESC LIMIT %d", deviceName+"check_mode", index)
-	stmt, err := db.Prepare(stmt_string)
+	stmt, err := db.PrepareContext(ctx, stmt_string)
 	if err != nil {
 		log.Panic("Unable to create the statement of select to check_mode. \n\r", err.Error())
 	}
 	defer stmt.Close()
-	rows, err := stmt.Query()
+	rows, err := stmt.QueryContext(ctx)
 	if err != nil {
 		log.Panic("Unable to select to check_mode.\n\r", err.Error())
 	}
@@ -510,15 +585,15 @@ func CheckModeSelectStmt(deviceName string, index int) []byte {
 
 }
 
-func VoltageSelectStmt(deviceName string, index int) []byte {
+func VoltageSelectStmt(ctx context.Context, deviceName string, index int) []byte {
 
 	stmt_string := fmt.Sprintf("SELECT value, device_name, time FROM %s ORDER BY id DESC LIMIT %d", deviceName+"voltage", index)
-	stmt, err := db.Prepare(stmt_string)
+	stmt, err := db.PrepareContext(ctx, stmt_string)
 	if err != nil {
 		log.Panic("Unable to create the statement of select to voltage. \n\r", err.Error())
 	}
 	defer stmt.Close()
-	rows, err := stmt.Query()
+	rows, err := stmt.QueryContext(ctx)
 	if err != nil {
 		log.Panic("Unable to select to voltage.\n\r", err.Error())
 	}
@@ -539,15 +614,15 @@ func VoltageSelectStmt(deviceName string, index int) []byte {
 	return keyStream
 }
 
-func ErrorInfoSelectStmt(deviceName string, index int) []byte {
+func ErrorInfoSelectStmt(ctx context.Context, deviceName string, index int) []byte {
 
 	stmt_string := fmt.Sprintf("SELECT value, device_name, time FROM %s ORDER BY id DESC LIMIT %d", deviceName+"error_info", index)
-	stmt, err := db.Prepare(stmt_string)
+	stmt, err := db.PrepareContext(ctx, stmt_string)
 	if err != nil {
 		log.Panic("Unable to create the statement of select to error_info. \n\r", err.Error())
 	}
 	defer stmt.Close()
-	rows, err := stmt.Query()
+	rows, err := stmt.QueryContext(ctx)
 	if err != nil {
 
 		log.Panic("Unable to select to error_info.\n\r", err.Error())
@@ -570,15 +645,15 @@ func ErrorInfoSelectStmt(deviceName string, index int) []byte {
 	return keyStream
 }
 
-func StatusSelectStmt(deviceName string, index int) []byte {
+func StatusSelectStmt(ctx context.Context, deviceName string, index int) []byte {
 
 	stmt_string := fmt.Sprintf("SELECT value, device_name, time FROM %s ORDER BY id DESC LIMIT %d", deviceName+"status", index)
-	stmt, err := db.Prepare(stmt_string)
+	stmt, err := db.PrepareContext(ctx, stmt_string)
 	if err != nil {
 		log.Panic("Unable to create the statement of select to status. \n\r", err.Error())
 	}
 	defer stmt.Close()
-	rows, err := stmt.Query()
+	rows, err := stmt.QueryContext(ctx)
 	if err != nil {
 		log.Panic("Unable to select to status.\n\r", err.Error())
 	}
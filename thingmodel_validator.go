@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	openapi "github.com/alibabacloud-go/darabonba-openapi/client"
+	iot "github.com/alibabacloud-go/iot-20180120/v3/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/thb-cmyk/aliyum-demo/databasic"
+	"github.com/thb-cmyk/aliyum-demo/utils"
+)
+
+// the validator checking the data received from aliyun against the published thing model
+var thingModels *ThingModelValidator
+
+const (
+	// the cached thing model is reloaded after the duration
+	THINGMODEL_CACHE_TTL time.Duration = 10 * time.Minute
+	// the failed loading is retried after the duration, which prevent to request the aliyun for each message
+	THINGMODEL_RETRY_TTL time.Duration = time.Minute
+	// the default endpoint of the aliyun iot platform
+	THINGMODEL_DEFAULT_ENDPOINT string = "iot.cn-shanghai.aliyuncs.com"
+	// the schedule of the job refreshing the cached thing models before they are expired, and the max random delay of it
+	THINGMODEL_REFRESH_SCHEDULE string        = "*/5 * * * *"
+	THINGMODEL_REFRESH_JITTER   time.Duration = time.Minute
+)
+
+// define the structure of the thing model tsl, only the properties is used to validate the data
+type ThingModel struct {
+	Properties []ThingModelProperty `json:"properties"`
+}
+
+type ThingModelProperty struct {
+	Identifier string             `json:"identifier"`
+	Name       string             `json:"name"`
+	Required   bool               `json:"required"`
+	DataType   ThingModelDataType `json:"dataType"`
+}
+
+// the specs is depend on the type, so it is decoded while validating
+type ThingModelDataType struct {
+	Type  string          `json:"type"`
+	Specs json.RawMessage `json:"specs"`
+}
+
+// the member of struct type is a property without required field
+type ThingModelMember struct {
+	Identifier string             `json:"identifier"`
+	Name       string             `json:"name"`
+	DataType   ThingModelDataType `json:"dataType"`
+}
+
+// the ParamIssue records the reason of a param rejected by the validator
+type ParamIssue struct {
+	Identifier string `json:"identifier"`
+	Reason     string `json:"reason"`
+}
+
+func (pi ParamIssue) String() string {
+	return pi.Identifier + ": " + pi.Reason
+}
+
+// the loader return the tsl string of the published thing model of the product
+type ThingModelLoader func(productKey string) (string, error)
+
+type thingModelEntry struct {
+	model  *ThingModel
+	err    error
+	loaded time.Time
+}
+
+// the loading in flight of a product, the callers of the same product wait for the done instead of loading again
+type thingModelLoading struct {
+	done  chan struct{}
+	entry *thingModelEntry
+}
+
+type ThingModelValidator struct {
+	lock    sync.Mutex
+	loader  ThingModelLoader
+	models  map[string]*thingModelEntry
+	loading map[string]*thingModelLoading
+}
+
+func NewThingModelValidator(loader ThingModelLoader) *ThingModelValidator {
+	return &ThingModelValidator{
+		loader:  loader,
+		models:  make(map[string]*thingModelEntry),
+		loading: make(map[string]*thingModelLoading),
+	}
+}
+
+/**
+ * @brief: init the validator, which load the published thing model from the aliyun iot platform
+ */
+func ThingModelInit() {
+	configmap := utils.GetYamlConfig("config/config.yaml")
+	accessKey := utils.GetElement("accessKey", configmap)
+	accessSecret := utils.GetElement("accessSecret", configmap)
+	iotInstanceId := utils.GetElement("iotInstanceId", configmap)
+	endpoint := THINGMODEL_DEFAULT_ENDPOINT
+	if _, ok := configmap["iotEndpoint"]; ok {
+		endpoint = utils.GetElement("iotEndpoint", configmap)
+	}
+
+	config := &openapi.Config{
+		AccessKeyId:     tea.String(accessKey),
+		AccessKeySecret: tea.String(accessSecret),
+		Endpoint:        tea.String(endpoint),
+	}
+	client, err := iot.NewClient(config)
+	if err != nil {
+		log.Printf("Unable to create the iot client, the thing model validation is disabled.\n\r error info: %s\n\r", err.Error())
+		return
+	}
+
+	thingModels = NewThingModelValidator(func(productKey string) (string, error) {
+		request := &iot.GetThingModelTslPublishedRequest{
+			IotInstanceId: tea.String(iotInstanceId),
+			ProductKey:    tea.String(productKey),
+			Simple:        tea.Bool(false),
+		}
+		response, err := client.GetThingModelTslPublished(request)
+		if err != nil {
+			return "", err
+		}
+		if !*response.Body.Success {
+			return "", fmt.Errorf("code: %s, error message: %s", *response.Body.Code, *response.Body.ErrorMessage)
+		}
+		if response.Body.Data == nil || response.Body.Data.TslStr == nil {
+			return "", fmt.Errorf("the product %s has no published thing model", productKey)
+		}
+		return *response.Body.Data.TslStr, nil
+	})
+}
+
+/*
+the method return the thing model of the product. the model is loaded by the loader at the first time
+and cached until the THINGMODEL_CACHE_TTL expired. The loading requests the aliyun without the lock, so
+the other products are not blocked, and the callers of the same product share one loading.
+*/
+func (tv *ThingModelValidator) Model(productKey string) (*ThingModel, error) {
+	tv.lock.Lock()
+	entry, ok := tv.models[productKey]
+	if ok {
+		ttl := THINGMODEL_CACHE_TTL
+		if entry.err != nil {
+			ttl = THINGMODEL_RETRY_TTL
+		}
+		if time.Since(entry.loaded) < ttl {
+			tv.lock.Unlock()
+			return entry.model, entry.err
+		}
+	}
+	loading, ok := tv.loading[productKey]
+	if ok {
+		tv.lock.Unlock()
+		<-loading.done
+		return loading.entry.model, loading.entry.err
+	}
+	loading = &thingModelLoading{done: make(chan struct{})}
+	tv.loading[productKey] = loading
+	tv.lock.Unlock()
+
+	loading.entry = tv.load(productKey)
+	tv.lock.Lock()
+	// the loading is dropped by the Invalidate, so the result of it is not cached
+	if tv.loading[productKey] == loading {
+		tv.models[productKey] = loading.entry
+		delete(tv.loading, productKey)
+	}
+	tv.lock.Unlock()
+	close(loading.done)
+
+	return loading.entry.model, loading.entry.err
+}
+
+// the method load the thing model of the product by the loader, the lock must not be held
+func (tv *ThingModelValidator) load(productKey string) *thingModelEntry {
+	entry := &thingModelEntry{loaded: time.Now()}
+	tsl, err := tv.loader(productKey)
+	if err == nil {
+		entry.model = new(ThingModel)
+		err = json.Unmarshal([]byte(tsl), entry.model)
+		if err != nil {
+			entry.model = nil
+		}
+	}
+	entry.err = err
+	return entry
+}
+
+/*
+the method reload the thing models of the cached products, which is called by the scheduled job, so the data
+received from aliyun never waits for the loading. It returns the last error of the loadings.
+*/
+func (tv *ThingModelValidator) Refresh() error {
+	tv.lock.Lock()
+	productKeys := make([]string, 0, len(tv.models))
+	for productKey := range tv.models {
+		productKeys = append(productKeys, productKey)
+	}
+	tv.lock.Unlock()
+
+	var last_err error
+	for _, productKey := range productKeys {
+		entry := tv.load(productKey)
+		if entry.err != nil {
+			// the model loaded before is kept until it is expired
+			log.Printf("Unable to refresh the thing model of product %s.\n\r error info: %s\n\r", productKey, entry.err.Error())
+			last_err = entry.err
+			continue
+		}
+		tv.lock.Lock()
+		tv.models[productKey] = entry
+		tv.lock.Unlock()
+	}
+	return last_err
+}
+
+/*
+create a processor to refresh the thing models, which is injected by the job of the databasic.
+*/
+func thingModelRefresher(ctx context.Context, tasknode *databasic.TaskNode, rawnode *databasic.RawNode) error {
+	if thingModels == nil {
+		return nil
+	}
+	return thingModels.Refresh()
+}
+
+// the method drop the cached thing model and the loading in flight, the next validating will load it again
+func (tv *ThingModelValidator) Invalidate(productKey string) {
+	tv.lock.Lock()
+	delete(tv.models, productKey)
+	delete(tv.loading, productKey)
+	tv.lock.Unlock()
+}
+
+/*
+the method validate the params against the thing model of the product. It returns the params passing
+the validation and the issues of the rejected params. A missing required property is also reported as
+an issue. The error is returned, only if the thing model is unable to load.
+*/
+func (tv *ThingModelValidator) Validate(productKey string, params map[string]interface{}) (map[string]interface{}, []ParamIssue, error) {
+	model, err := tv.Model(productKey)
+	if err != nil {
+		return params, nil, err
+	}
+
+	valid := make(map[string]interface{}, len(params))
+	var issues []ParamIssue
+
+	properties := make(map[string]*ThingModelProperty, len(model.Properties))
+	for i := range model.Properties {
+		properties[model.Properties[i].Identifier] = &model.Properties[i]
+	}
+
+	for key, value := range params {
+		property, ok := properties[key]
+		if !ok {
+			issues = append(issues, ParamIssue{key, "the property is not defined in the thing model"})
+			continue
+		}
+		reason := checkDataType(property.DataType, value)
+		if reason != "" {
+			issues = append(issues, ParamIssue{key, reason})
+			continue
+		}
+		valid[key] = value
+	}
+
+	for _, property := range model.Properties {
+		if _, ok := params[property.Identifier]; property.Required && !ok {
+			issues = append(issues, ParamIssue{property.Identifier, "the required property is missing"})
+		}
+	}
+
+	return valid, issues, nil
+}
+
+// the function return the reason of the value mismatched with the data type, or "" if matched
+func checkDataType(dt ThingModelDataType, value interface{}) string {
+	switch dt.Type {
+	case "int", "float", "double":
+		number, ok := value.(float64)
+		if !ok {
+			return fmt.Sprintf("the value %v is not a number", value)
+		}
+		if dt.Type == "int" && number != math.Trunc(number) {
+			return fmt.Sprintf("the value %v is not an integer", value)
+		}
+		var specs struct {
+			Min string `json:"min"`
+			Max string `json:"max"`
+		}
+		if reason := decodeSpecs(dt, &specs); reason != "" {
+			return reason
+		}
+		if min, err := strconv.ParseFloat(specs.Min, 64); err == nil && number < min {
+			return fmt.Sprintf("the value %v is less than the min %s", value, specs.Min)
+		}
+		if max, err := strconv.ParseFloat(specs.Max, 64); err == nil && number > max {
+			return fmt.Sprintf("the value %v is greater than the max %s", value, specs.Max)
+		}
+
+	case "enum", "bool":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			return fmt.Sprintf("the value %v is not an integer", value)
+		}
+		var specs map[string]interface{}
+		if reason := decodeSpecs(dt, &specs); reason != "" {
+			return reason
+		}
+		if _, ok := specs[strconv.Itoa(int(number))]; !ok {
+			return fmt.Sprintf("the value %v is not in the %s specs", value, dt.Type)
+		}
+
+	case "text":
+		text, ok := value.(string)
+		if !ok {
+			return fmt.Sprintf("the value %v is not a text", value)
+		}
+		var specs struct {
+			Length string `json:"length"`
+		}
+		if reason := decodeSpecs(dt, &specs); reason != "" {
+			return reason
+		}
+		// the length of the thing model counts the characters, not the bytes of utf-8
+		if length, err := strconv.Atoi(specs.Length); err == nil && utf8.RuneCountInString(text) > length {
+			return fmt.Sprintf("the length of text is greater than %s", specs.Length)
+		}
+
+	case "date":
+		switch date := value.(type) {
+		case string:
+			if _, err := strconv.ParseInt(date, 10, 64); err != nil {
+				return fmt.Sprintf("the value %v is not a utc timestamp", value)
+			}
+		case float64:
+		default:
+			return fmt.Sprintf("the value %v is not a utc timestamp", value)
+		}
+
+	case "struct":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Sprintf("the value %v is not a struct", value)
+		}
+		var members []ThingModelMember
+		if reason := decodeSpecs(dt, &members); reason != "" {
+			return reason
+		}
+		for _, member := range members {
+			field, ok := object[member.Identifier]
+			if !ok {
+				return fmt.Sprintf("the member %s is missing", member.Identifier)
+			}
+			if reason := checkDataType(member.DataType, field); reason != "" {
+				return member.Identifier + ": " + reason
+			}
+		}
+
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Sprintf("the value %v is not an array", value)
+		}
+		var specs struct {
+			Size string             `json:"size"`
+			Item ThingModelDataType `json:"item"`
+		}
+		if reason := decodeSpecs(dt, &specs); reason != "" {
+			return reason
+		}
+		if size, err := strconv.Atoi(specs.Size); err == nil && len(items) > size {
+			return fmt.Sprintf("the size of array is greater than %s", specs.Size)
+		}
+		for i, item := range items {
+			if reason := checkDataType(specs.Item, item); reason != "" {
+				return fmt.Sprintf("[%d]: %s", i, reason)
+			}
+		}
+
+	default:
+		return fmt.Sprintf("the data type %s is unknown", dt.Type)
+	}
+	return ""
+}
+
+// the function decode the specs of the data type, it return the reason if the specs is malformed, the empty specs is
+// not checked
+func decodeSpecs(dt ThingModelDataType, specs interface{}) string {
+	if len(dt.Specs) == 0 {
+		return ""
+	}
+	if err := json.Unmarshal(dt.Specs, specs); err != nil {
+		return fmt.Sprintf("the specs of the %s is malformed: %s", dt.Type, err.Error())
+	}
+	return ""
+}
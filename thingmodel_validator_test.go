@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testTsl = `{
+	"properties": [
+		{"identifier": "voltage", "required": true, "dataType": {"type": "float", "specs": {"min": "0", "max": "250"}}},
+		{"identifier": "check_mode", "dataType": {"type": "enum", "specs": {"0": "auto", "1": "manual"}}},
+		{"identifier": "error_info", "dataType": {"type": "int", "specs": {"min": "0", "max": "100"}}},
+		{"identifier": "label", "dataType": {"type": "text", "specs": {"length": "4"}}},
+		{"identifier": "broken", "dataType": {"type": "int", "specs": {"min": 0}}}
+	]
+}`
+
+func TestThingModelValidate(t *testing.T) {
+	loads := 0
+	validator := NewThingModelValidator(func(productKey string) (string, error) {
+		loads++
+		if productKey != "pk001" {
+			return "", errors.New("the product is not found")
+		}
+		return testTsl, nil
+	})
+
+	params := map[string]interface{}{
+		"voltage":    220.5,
+		"check_mode": float64(3),
+		"error_info": 1.5,
+		"label":      "toolong",
+		"unknown":    1.0,
+	}
+	valid, issues, err := validator.Validate("pk001", params)
+	if err != nil {
+		t.Fatalf("validate return a error: %s", err)
+	}
+	if len(valid) != 1 || valid["voltage"] != 220.5 {
+		t.Errorf("the valid params is %v, want only voltage", valid)
+	}
+	if len(issues) != 4 {
+		t.Errorf("the issues is %v, want 4 issues", issues)
+	}
+
+	// the missing required property is reported and the model is loaded from the cache
+	_, issues, _ = validator.Validate("pk001", map[string]interface{}{"check_mode": float64(1)})
+	if len(issues) != 1 || issues[0].Identifier != "voltage" {
+		t.Errorf("the issues is %v, want the missing voltage", issues)
+	}
+	if loads != 1 {
+		t.Errorf("the thing model is loaded %d times, want 1", loads)
+	}
+
+	// the wrong type is rejected instead of panic
+	valid, issues, _ = validator.Validate("pk001", map[string]interface{}{"voltage": "220"})
+	if len(valid) != 0 || len(issues) != 1 {
+		t.Errorf("the valid params is %v and the issues is %v, want the voltage rejected", valid, issues)
+	}
+
+	// the length of text counts the characters, and the malformed specs is reported instead of ignored
+	valid, issues, _ = validator.Validate("pk001", map[string]interface{}{"voltage": 220.0, "label": "电压正常", "broken": 1.0})
+	if len(valid) != 2 || valid["label"] != "电压正常" {
+		t.Errorf("the valid params is %v, want voltage and label", valid)
+	}
+	if len(issues) != 1 || issues[0].Identifier != "broken" {
+		t.Errorf("the issues is %v, want the malformed specs of broken", issues)
+	}
+
+	// the params is returned without validation, if the thing model is unable to load
+	valid, _, err = validator.Validate("pk002", params)
+	if err == nil || len(valid) != len(params) {
+		t.Errorf("validate the unknown product return %v, %v", valid, err)
+	}
+}
+
+func TestThingModelLoad(t *testing.T) {
+	var loads int64
+	release := make(chan struct{})
+	validator := NewThingModelValidator(func(productKey string) (string, error) {
+		atomic.AddInt64(&loads, 1)
+		if productKey == "pk001" {
+			<-release
+		}
+		return testTsl, nil
+	})
+
+	// the callers of the same product share one loading
+	var group sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			if model, err := validator.Model("pk001"); err != nil || model == nil {
+				t.Errorf("the shared loading returns %v, %v", model, err)
+			}
+		}()
+	}
+
+	// the other product is loaded while the loading of pk001 is blocked
+	loaded := make(chan error, 1)
+	go func() {
+		_, err := validator.Model("pk002")
+		loaded <- err
+	}()
+	select {
+	case err := <-loaded:
+		if err != nil {
+			t.Errorf("the thing model of pk002 unable to load: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the loading of pk002 is blocked by the loading of pk001")
+	}
+
+	close(release)
+	group.Wait()
+	if loads := atomic.LoadInt64(&loads); loads != 2 {
+		t.Errorf("the thing models are loaded %d times, want 2", loads)
+	}
+}